@@ -21,14 +21,8 @@ func main() {
 	em.SortAndMerge()
 
 	// 3. 生成各 shell 环境文件
-	if err := em.BuildBash("./env_generated.sh"); err != nil {
-		log.Fatalf("BuildBash error: %v", err)
-	}
-	if err := em.BuildZsh("./env_generated.zsh"); err != nil {
-		log.Fatalf("BuildZsh error: %v", err)
-	}
-	if err := em.BuildPsh("./env_generated.ps1"); err != nil {
-		log.Fatalf("BuildPsh error: %v", err)
+	if err := em.BuildAll(".", "env_generated"); err != nil {
+		log.Fatalf("BuildAll error: %v", err)
 	}
 
 	// 4. 写 meta 时间文件
@@ -42,7 +36,11 @@ func main() {
 		log.Fatalf("ReadEnvTime error: %v", err)
 	}
 	fmt.Println("Env generated at:", t.Format(time.RFC3339))
-	if time.Since(t) > 24*time.Hour {
+	stale, err := env.IsStale("./env_generated.meta", 24*time.Hour)
+	if err != nil {
+		log.Fatalf("IsStale error: %v", err)
+	}
+	if stale {
 		fmt.Println("Warning: Env is older than 24h, consider regenerating")
 	}
 
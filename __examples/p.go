@@ -11,6 +11,10 @@ import (
 func main() {
 	manager := &env.EnvManager{}
 
+	// 声明系统和内部组件 fragment 名称，解锁 0-19 和 20-99 优先级区间
+	env.RegisterSystemFragment("system_base")
+	env.RegisterInnerComponent("internal_service")
+
 	// 模拟三个 fragment，分别是系统、内部组件、自定义
 	systemFrag := &env.EnvFragment{
 		Name:     "system_base",
@@ -71,7 +75,11 @@ fi`},
 	}
 
 	// 添加 fragment
-	manager.fragments = append(manager.fragments, systemFrag, innerFrag, customFrag)
+	for _, frag := range []*env.EnvFragment{systemFrag, innerFrag, customFrag} {
+		if err := manager.AddFragment(frag); err != nil {
+			log.Fatalf("AddFragment error: %v", err)
+		}
+	}
 
 	// 排序合并
 	manager.SortAndMerge()
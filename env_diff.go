@@ -0,0 +1,65 @@
+// Copyright (C) Kumo inc. and its affiliates.
+// Author: Jeff.li lijippy@163.com
+// All rights reserved.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package env
+
+import "strings"
+
+// EnvDiff lists the differences between two merged environments, each
+// group ordered by key.
+type EnvDiff struct {
+	Added   []Change
+	Removed []Change
+	Changed []Change
+}
+
+// Diff compares the merged environments of before and after, e.g. the
+// current and the next release, and returns the keys added, removed and
+// changed by after. Both managers should have completed SortAndMerge; a
+// manager that has not is treated as an empty environment.
+func Diff(before, after *EnvManager) EnvDiff {
+	var d EnvDiff
+	for _, c := range diffMaps(before.Merged(), after.Merged(), "") {
+		switch c.Kind {
+		case ChangeAdded:
+			d.Added = append(d.Added, c)
+		case ChangeRemoved:
+			d.Removed = append(d.Removed, c)
+		default:
+			d.Changed = append(d.Changed, c)
+		}
+	}
+	return d
+}
+
+// Empty reports whether the environments are identical.
+func (d EnvDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// String renders the diff as a changelog with one line per change, added
+// keys first, then removed and changed keys, in the format of Change.String.
+func (d EnvDiff) String() string {
+	var sb strings.Builder
+	for _, group := range [][]Change{d.Added, d.Removed, d.Changed} {
+		for _, c := range group {
+			sb.WriteString(c.String())
+			sb.WriteByte('\n')
+		}
+	}
+	return sb.String()
+}
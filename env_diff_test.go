@@ -0,0 +1,29 @@
+package env
+
+import "testing"
+
+func newDiffManager(tb testing.TB, env map[string]string) *EnvManager {
+	tb.Helper()
+
+	em := &EnvManager{}
+	isNoErr(tb, em.AddFragment(&EnvFragment{Name: "app", Priority: 100, Env: env}))
+	isNoErr(tb, em.SortAndMergeStrict())
+	return em
+}
+
+func TestDiff(t *testing.T) {
+	before := newDiffManager(t, map[string]string{"PORT": "80", "HOST": "localhost", "OLD": "x"})
+	after := newDiffManager(t, map[string]string{"PORT": "8080", "HOST": "localhost", "NEW": "y"})
+
+	d := Diff(before, after)
+	isEqual(t, EnvDiff{
+		Added:   []Change{{Kind: ChangeAdded, Key: "NEW", New: "y"}},
+		Removed: []Change{{Kind: ChangeRemoved, Key: "OLD", Old: "x"}},
+		Changed: []Change{{Kind: ChangeModified, Key: "PORT", Old: "80", New: "8080"}},
+	}, d)
+	isFalse(t, d.Empty())
+	isEqual(t, "+ NEW=y\n- OLD=x\n~ PORT: 80 -> 8080\n", d.String())
+
+	isTrue(t, Diff(after, after).Empty())
+	isEqual(t, "", Diff(after, after).String())
+}
@@ -0,0 +1,172 @@
+// Copyright (C) Kumo inc. and its affiliates.
+// Author: Jeff.li lijippy@163.com
+// All rights reserved.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package env
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BuildDotenv writes the merged environment as a dotenv file with one
+// KEY=value line per variable, as read by docker-compose and similar tools.
+// Scripts are omitted and the ctime is written as a regular key named by
+// CtimeKey. With DotenvSections set, variables are grouped under a comment
+// naming the fragment whose value won the merge.
+func (e *EnvManager) BuildDotenv(dst string) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.buildDotenv(dst, e.active, e.keyAllowed)
+}
+
+func (e *EnvManager) buildDotenv(dst string, frags []*EnvFragment, allowed func(key string) bool) error {
+	if !e.sorted {
+		return fmt.Errorf("not build complete yet")
+	}
+	f, err := e.openOutput(dst)
+	if err != nil {
+		return err
+	}
+	if err := e.writeDotenv(f, dst, frags, allowed); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeDotenv writes frags to w as a dotenv file, leaving out the keys
+// allowed rejects. name identifies the output in log events.
+func (e *EnvManager) writeDotenv(w io.Writer, name string, frags []*EnvFragment, allowed func(key string) bool) error {
+	bw := bufio.NewWriter(w)
+	if !e.AppendOutput {
+		writeComment(bw, "#", e.Header)
+	}
+	if !e.NoCtime && !e.AppendOutput {
+		fmt.Fprintf(bw, "%s=%s\n", e.ctimeKey(), dotenvQuote(e.Ctime.Format(time.RFC3339)))
+	}
+	if !e.DotenvSections {
+		for _, k := range sortedKeys(e.merged) {
+			if !allowed(k) {
+				e.log().Debug("key filtered", "key", k, "fragment", e.owners[k].Name, "output", name, "reason", e.filterReason(k))
+				continue
+			}
+			e.writeDotenvVar(bw, k)
+		}
+		if e.DotenvScripts {
+			for _, frag := range frags {
+				writeDotenvScripts(bw, frag)
+			}
+		}
+		writeComment(bw, "#", e.Footer)
+		return e.flushDotenv(bw, name, frags)
+	}
+
+	for _, frag := range frags {
+		var keys []string
+		for _, orig := range append(sortedKeys(frag.Env), e.appliedDefaults(frag)...) {
+			k := e.envKey(orig)
+			if e.owners[k] != frag {
+				continue
+			}
+			if !allowed(k) {
+				e.log().Debug("key filtered", "key", k, "fragment", frag.Name, "output", name, "reason", e.filterReason(k))
+				continue
+			}
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if len(keys) == 0 && (!e.DotenvScripts || len(frag.Script) == 0) {
+			continue
+		}
+		fmt.Fprintf(bw, "\n# --- Fragment: %s ---\n", frag.Name)
+		writeComment(bw, "#", frag.Comment)
+		for _, k := range keys {
+			e.writeDotenvVar(bw, k)
+		}
+		if e.DotenvScripts {
+			writeDotenvScripts(bw, frag)
+		}
+	}
+	writeComment(bw, "#", e.Footer)
+	return e.flushDotenv(bw, name, frags)
+}
+
+// flushDotenv flushes bw, which keeps the first write error and returns it
+// from Flush, and logs the completed build.
+func (e *EnvManager) flushDotenv(bw *bufio.Writer, name string, frags []*EnvFragment) error {
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	e.log().Info("build complete", "output", name, "fragments", len(frags))
+	return nil
+}
+
+// writeDotenvVar writes the merged value of key, preceded by the fragment
+// that set it with Annotate set.
+func (e *EnvManager) writeDotenvVar(w io.Writer, key string) {
+	if e.Annotate {
+		note := "from " + e.owners[key].Name
+		if e.defaulted[key] != nil {
+			note = "default " + note
+		}
+		fmt.Fprintf(w, "# %s\n", note)
+	}
+	fmt.Fprintf(w, "%s=%s\n", key, dotenvQuote(e.merged[key]))
+}
+
+// writeDotenvScripts writes the scripts of frag as comment lines.
+func writeDotenvScripts(w io.Writer, frag *EnvFragment) {
+	for _, sc := range frag.Script {
+		fmt.Fprintf(w, "# script[%s] from %s:\n", sc.shellList(), frag.Name)
+		for _, line := range strings.Split(strings.TrimRight(sc.Data, "\n"), "\n") {
+			fmt.Fprintf(w, "#   %s\n", line)
+		}
+	}
+}
+
+// dotenvQuote returns v unquoted when it only holds characters that need no
+// quoting, single quoted when that is enough, and double quoted with
+// backslash escapes otherwise.
+func dotenvQuote(v string) string {
+	safe := true
+	for _, c := range v {
+		if !isDotenvSafe(c) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return v
+	}
+	if !strings.ContainsAny(v, "'\n\r") {
+		return "'" + v + "'"
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "\n", `\n`, "\r", `\r`)
+	return `"` + r.Replace(v) + `"`
+}
+
+func isDotenvSafe(c rune) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.ContainsRune("_-.,:/@%+=", c)
+}
@@ -0,0 +1,137 @@
+package env
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newDotenvManager(tb testing.TB) *EnvManager {
+	tb.Helper()
+
+	em := &EnvManager{}
+	isNoErr(tb, em.AddFragment(&EnvFragment{Name: "base", Priority: 100, Env: map[string]string{
+		"HOST": "localhost",
+		"PORT": "80",
+	}}))
+	isNoErr(tb, em.AddFragment(&EnvFragment{Name: "app", Priority: 110, Env: map[string]string{
+		"PORT":     "8080",
+		"GREETING": "hello world",
+	}}))
+	isNoErr(tb, em.SortAndMergeStrict())
+	return em
+}
+
+// readDotenv is a minimal dotenv reader: it skips blank and comment lines
+// and strips one level of quotes.
+func readDotenv(tb testing.TB, path string) map[string]string {
+	tb.Helper()
+
+	data, err := os.ReadFile(path)
+	isNoErr(tb, err)
+	result := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		isTrue(tb, ok)
+		if len(v) >= 2 && (v[0] == '\'' || v[0] == '"') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		result[k] = v
+	}
+	return result
+}
+
+func TestBuildDotenv(t *testing.T) {
+	em := newDotenvManager(t)
+	dst := filepath.Join(t.TempDir(), ".env")
+	isNoErr(t, em.BuildDotenv(dst))
+
+	out, err := os.ReadFile(dst)
+	isNoErr(t, err)
+	isFalse(t, strings.Contains(string(out), "#"))
+
+	values := readDotenv(t, dst)
+	isEqual(t, "localhost", values["HOST"])
+	isEqual(t, "8080", values["PORT"])
+	isEqual(t, "hello world", values["GREETING"])
+	isTrue(t, values[ENV_CTIME_KEY] != "")
+}
+
+func TestWriteDotenvError(t *testing.T) {
+	em := newDotenvManager(t)
+	isErrorWithMessage(t, em.writeDotenv(failingWriter{}, "fail", em.active, em.keyAllowed), "disk full")
+	em.DotenvSections = true
+	isErrorWithMessage(t, em.writeDotenv(failingWriter{}, "fail", em.active, em.keyAllowed), "disk full")
+}
+
+func TestBuildDotenvSections(t *testing.T) {
+	em := newDotenvManager(t)
+	em.DotenvSections = true
+	dst := filepath.Join(t.TempDir(), ".env")
+	isNoErr(t, em.BuildDotenv(dst))
+
+	out, err := os.ReadFile(dst)
+	isNoErr(t, err)
+	content := string(out)
+	base := strings.Index(content, "# --- Fragment: base ---\nHOST=localhost\n")
+	app := strings.Index(content, "# --- Fragment: app ---\nGREETING='hello world'\nPORT=8080\n")
+	isTrue(t, base > 0)
+	isTrue(t, app > base)
+	isEqual(t, 1, strings.Count(content, "PORT="))
+
+	values := readDotenv(t, dst)
+	isEqual(t, "localhost", values["HOST"])
+	isEqual(t, "8080", values["PORT"])
+	isEqual(t, "hello world", values["GREETING"])
+}
+
+func TestDotenvQuote(t *testing.T) {
+	for in, want := range map[string]string{
+		"":               "",
+		"plain":          "plain",
+		"/usr/bin:/bin":  "/usr/bin:/bin",
+		"hello world":    "'hello world'",
+		"a$b":            "'a$b'",
+		"it's":           `"it's"`,
+		"line1\nline2":   `"line1\nline2"`,
+		`say "hi" $HOME`: `'say "hi" $HOME'`,
+	} {
+		isEqual(t, want, dotenvQuote(in))
+	}
+}
+
+func TestBuildDotenvScripts(t *testing.T) {
+	em := newDotenvManager(t)
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "setup", Priority: 120, Script: []Script{
+		{Sh: "bash", Data: "if [ -z \"$HOST\" ]; then\n  export HOST=localhost\nfi\n"},
+	}}))
+	isNoErr(t, em.SortAndMergeStrict())
+	dir := t.TempDir()
+
+	dst := filepath.Join(dir, "plain.env")
+	isNoErr(t, em.BuildDotenv(dst))
+	out, err := os.ReadFile(dst)
+	isNoErr(t, err)
+	isFalse(t, strings.Contains(string(out), "script"))
+
+	em.DotenvScripts = true
+	isNoErr(t, em.BuildDotenv(dst))
+	out, err = os.ReadFile(dst)
+	isNoErr(t, err)
+	isTrue(t, strings.HasSuffix(string(out), `# script[bash] from setup:
+#   if [ -z "$HOST" ]; then
+#     export HOST=localhost
+#   fi
+`))
+	isEqual(t, "localhost", readDotenv(t, dst)["HOST"])
+
+	em.DotenvSections = true
+	isNoErr(t, em.BuildDotenv(dst))
+	out, err = os.ReadFile(dst)
+	isNoErr(t, err)
+	isTrue(t, strings.Contains(string(out), "# --- Fragment: setup ---\n# script[bash] from setup:\n"))
+}
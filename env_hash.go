@@ -0,0 +1,79 @@
+// Copyright (C) Kumo inc. and its affiliates.
+// Author: Jeff.li lijippy@163.com
+// All rights reserved.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package env
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Hash returns a hex SHA-256 fingerprint of the merged environment. It covers
+// the merged keys and values in key order, their ShellEnv overrides, the keys
+// removed by Unset, and with HashScripts set, the scripts of the merged
+// fragments in priority order, so it does not depend on the order fragments
+// were loaded in. The ctime is left out: merging the same fragments again
+// yields the same hash, which makes it suitable to skip regenerating outputs
+// that are up to date.
+func (e *EnvManager) Hash() (string, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.hash()
+}
+
+func (e *EnvManager) hash() (string, error) {
+	if !e.sorted {
+		return "", fmt.Errorf("not build complete yet")
+	}
+
+	h := sha256.New()
+	for _, k := range sortedKeys(e.merged) {
+		hashField(h, "env", k, e.merged[k])
+		if owner := e.owners[k]; owner != nil && owner.isLocal(k) {
+			hashField(h, "local", k)
+		}
+	}
+	for _, k := range sortedKeys(e.unset) {
+		hashField(h, "unset", k)
+	}
+	shellEnv := e.mergedShellEnv()
+	for _, sh := range sortedKeys(shellEnv) {
+		for _, k := range sortedKeys(shellEnv[sh]) {
+			hashField(h, "shell_env", sh, k, shellEnv[sh][k])
+		}
+	}
+	if e.HashScripts {
+		for _, frag := range e.active {
+			for _, sc := range frag.Script {
+				hashField(h, "script", frag.Name, sc.shellList(), strconv.Itoa(sc.Order), sc.Data)
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashField writes a record of length-prefixed fields, so that values holding
+// separators cannot make two different records hash the same.
+func hashField(w io.Writer, fields ...string) {
+	for _, f := range fields {
+		fmt.Fprintf(w, "%d:%s", len(f), f)
+	}
+	io.WriteString(w, "\n")
+}
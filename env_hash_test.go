@@ -0,0 +1,70 @@
+package env
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHash(t *testing.T) {
+	const base = "name: base\npriority: 100\nenv:\n  HOST: localhost\n  PORT: \"80\"\n"
+	const app = "name: app\npriority: 110\nenv:\n  PORT: \"8080\"\nscript:\n  - sh: bash\n    data: echo hi\n"
+
+	load := func(docs ...string) *EnvManager {
+		t.Helper()
+		em := &EnvManager{}
+		for _, doc := range docs {
+			isNoErr(t, em.FeedReader(strings.NewReader(doc), "test.yaml"))
+		}
+		isNoErr(t, em.SortAndMergeStrict())
+		return em
+	}
+
+	_, err := (&EnvManager{}).Hash()
+	isErrorWithMessage(t, err, "not build complete yet")
+
+	h1, err := load(base, app).Hash()
+	isNoErr(t, err)
+	isEqual(t, 64, len(h1))
+
+	// independent of load order and ctime
+	h2, err := load(app, base).Hash()
+	isNoErr(t, err)
+	isEqual(t, h1, h2)
+
+	// scripts only count with HashScripts
+	changed := strings.Replace(app, "echo hi", "echo bye", 1)
+	h3, err := load(base, changed).Hash()
+	isNoErr(t, err)
+	isEqual(t, h1, h3)
+
+	em := load(base, app)
+	em.HashScripts = true
+	h4, err := em.Hash()
+	isNoErr(t, err)
+	isTrue(t, h4 != h1)
+	em = load(base, changed)
+	em.HashScripts = true
+	h5, err := em.Hash()
+	isNoErr(t, err)
+	isTrue(t, h5 != h4)
+
+	// a changed value changes the hash
+	h6, err := load(base, strings.Replace(app, "8080", "8081", 1)).Hash()
+	isNoErr(t, err)
+	isTrue(t, h6 != h1)
+
+	// so does a key removed by Unset, though nothing merged changes
+	h7, err := load(base, app+"unset: [HTTP_PROXY]\n").Hash()
+	isNoErr(t, err)
+	isTrue(t, h7 != h1)
+}
+
+func TestHashFieldBoundaries(t *testing.T) {
+	a := &EnvManager{sorted: true, merged: map[string]string{"A": "1\nB=2"}}
+	b := &EnvManager{sorted: true, merged: map[string]string{"A": "1", "B": "2"}}
+	ha, err := a.Hash()
+	isNoErr(t, err)
+	hb, err := b.Hash()
+	isNoErr(t, err)
+	isTrue(t, ha != hb)
+}
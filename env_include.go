@@ -0,0 +1,184 @@
+// Copyright (C) Kumo inc. and its affiliates.
+// Author: Jeff.li lijippy@163.com
+// All rights reserved.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package env
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// resolveIncludes merges the files listed in frag.Include into frag. source
+// is the file frag was read from; include paths are relative to its
+// directory. Files are read from fsys, or from the OS file system if fsys is
+// nil.
+func resolveIncludes(frag *EnvFragment, source string, fsys fs.FS) error {
+	if len(frag.Include) == 0 {
+		return nil
+	}
+	start, err := includePath(fsys, source)
+	if err != nil {
+		return err
+	}
+	inc, err := loadIncludes(fsys, frag.Include, includeDir(fsys, source), []string{start})
+	if err != nil {
+		return err
+	}
+	mergeInclude(frag, inc)
+	return nil
+}
+
+// readScriptFiles reads the File of every script of frag into its Data.
+// source is the file frag was read from; script paths are relative to its
+// directory. Files are read from fsys, or from the OS file system if fsys is
+// nil.
+func readScriptFiles(frag *EnvFragment, source string, fsys fs.FS) error {
+	for i := range frag.Script {
+		sc := &frag.Script[i]
+		if sc.File == "" {
+			continue
+		}
+		if sc.Data != "" {
+			return fmt.Errorf("script %d has both data and file", i)
+		}
+		p := sc.File
+		if fsys != nil {
+			p = path.Join(includeDir(fsys, source), p)
+		} else if !filepath.IsAbs(p) {
+			p = filepath.Join(includeDir(fsys, source), p)
+		}
+		var data []byte
+		var err error
+		if fsys != nil {
+			data, err = fs.ReadFile(fsys, p)
+		} else {
+			data, err = os.ReadFile(p)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read script file for script %d: %w", i, err)
+		}
+		sc.Data, sc.File = string(data), ""
+	}
+	return nil
+}
+
+// loadIncludes reads the files at paths, relative to dir, with their own
+// includes resolved, and returns the variables and scripts they hold
+// combined into one fragment. chain lists the paths of the files including
+// them, outermost first, to detect cycles.
+func loadIncludes(fsys fs.FS, paths []string, dir string, chain []string) (*EnvFragment, error) {
+	acc := &EnvFragment{}
+	for _, p := range paths {
+		if fsys != nil {
+			p = path.Join(dir, p)
+		} else if !filepath.IsAbs(p) {
+			p = filepath.Join(dir, p)
+		}
+		id, err := includePath(fsys, p)
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(chain, id) {
+			return nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(chain, " -> "), id)
+		}
+		docs, err := readInclude(fsys, p)
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			if err := readScriptFiles(doc, p, fsys); err != nil {
+				return nil, fmt.Errorf("include %s: %w", p, err)
+			}
+			nested, err := loadIncludes(fsys, doc.Include, includeDir(fsys, p), append(chain[:len(chain):len(chain)], id))
+			if err != nil {
+				return nil, err
+			}
+			mergeInclude(doc, nested)
+			mergeInclude(doc, acc)
+			acc = doc
+		}
+	}
+	return acc, nil
+}
+
+// includePath returns the path identifying the file p in cycle checks: the
+// absolute path for the OS file system, the cleaned path within fsys.
+func includePath(fsys fs.FS, p string) (string, error) {
+	if fsys != nil {
+		return path.Clean(p), nil
+	}
+	return filepath.Abs(p)
+}
+
+func includeDir(fsys fs.FS, p string) string {
+	if fsys != nil {
+		return path.Dir(p)
+	}
+	return filepath.Dir(p)
+}
+
+// readInclude decodes the fragment documents of an included file.
+func readInclude(fsys fs.FS, fpath string) ([]*EnvFragment, error) {
+	var f fs.File
+	var err error
+	if fsys != nil {
+		f, err = fsys.Open(fpath)
+	} else {
+		f, err = os.Open(fpath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read include %s: %w", fpath, err)
+	}
+	defer f.Close()
+
+	var docs []*EnvFragment
+	dec := yaml.NewDecoder(f)
+	for {
+		var doc EnvFragment
+		if err := dec.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("failed to parse YAML in include %s: %w", fpath, err)
+		}
+		docs = append(docs, &doc)
+	}
+	return docs, nil
+}
+
+// mergeInclude adds the variables and scripts of inc to frag. Variables
+// already set by frag are kept and the scripts of inc run first.
+func mergeInclude(frag, inc *EnvFragment) {
+	if len(inc.Env) > 0 {
+		env := maps.Clone(inc.Env)
+		maps.Copy(env, frag.Env)
+		frag.Env = env
+	}
+	if len(inc.Script) > 0 {
+		frag.Script = append(slices.Clip(inc.Script), frag.Script...)
+	}
+}
@@ -0,0 +1,119 @@
+package env
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(tb testing.TB, dir string, files map[string]string) {
+	tb.Helper()
+	for name, data := range files {
+		fpath := filepath.Join(dir, name)
+		isNoErr(tb, os.MkdirAll(filepath.Dir(fpath), 0o755))
+		isNoErr(tb, os.WriteFile(fpath, []byte(data), 0o644))
+	}
+}
+
+func TestFeedFileInclude(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"common/base.yaml": `include: [proxy.yaml]
+env:
+  HOST: localhost
+  PORT: "80"
+script:
+  - sh: bash
+    data: echo base
+`,
+		"common/proxy.yaml": `env:
+  HTTP_PROXY: http://proxy:3128
+  HOST: proxy
+`,
+		"common/tls.yaml": `env:
+  PORT: "443"
+`,
+		"fragments/app.yaml": `name: app
+priority: 100
+include: [../common/base.yaml, ../common/tls.yaml]
+env:
+  NAME: app
+script:
+  - sh: bash
+    data: echo app
+---
+name: other
+priority: 110
+env:
+  NAME: other
+`,
+	})
+
+	em := &EnvManager{}
+	isNoErr(t, em.FeedFile(filepath.Join(dir, "fragments", "app.yaml")))
+	frags := em.Fragments()
+	isEqual(t, 2, len(frags))
+	isEqual(t, map[string]string{
+		"HOST":       "localhost",
+		"PORT":       "443",
+		"HTTP_PROXY": "http://proxy:3128",
+		"NAME":       "app",
+	}, frags[0].Env)
+	isEqual(t, 2, len(frags[0].Script))
+	isEqual(t, "echo base", frags[0].Script[0].Data)
+	isEqual(t, "echo app", frags[0].Script[1].Data)
+	isEqual(t, map[string]string{"NAME": "other"}, frags[1].Env)
+}
+
+func TestFeedFileIncludeCycle(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"app.yaml":  "name: app\npriority: 100\ninclude: [a.yaml]\n",
+		"a.yaml":    "include: [b.yaml]\n",
+		"b.yaml":    "include: [a.yaml]\n",
+		"self.yaml": "name: self\npriority: 100\ninclude: [self.yaml]\n",
+	})
+	abs := func(name string) string {
+		p, err := filepath.Abs(filepath.Join(dir, name))
+		isNoErr(t, err)
+		return p
+	}
+
+	em := &EnvManager{}
+	err := em.FeedFile(filepath.Join(dir, "app.yaml"))
+	isErrorWithMessage(t, err, "failed to include files for fragment app in "+filepath.Join(dir, "app.yaml")+
+		": include cycle: "+strings.Join([]string{abs("app.yaml"), abs("a.yaml"), abs("b.yaml"), abs("a.yaml")}, " -> "))
+
+	err = em.FeedFile(filepath.Join(dir, "self.yaml"))
+	isErrorWithMessage(t, err, "failed to include files for fragment self in "+filepath.Join(dir, "self.yaml")+
+		": include cycle: "+abs("self.yaml")+" -> "+abs("self.yaml"))
+	isEqual(t, 0, len(em.Fragments()))
+}
+
+func TestFeedFileIncludeDiamond(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"app.yaml":  "name: app\npriority: 100\ninclude: [a.yaml, b.yaml]\n",
+		"a.yaml":    "include: [base.yaml]\nenv:\n  A: a\n",
+		"b.yaml":    "include: [base.yaml]\nenv:\n  B: b\n",
+		"base.yaml": "env:\n  BASE: base\n",
+	})
+
+	em := &EnvManager{}
+	isNoErr(t, em.FeedFile(filepath.Join(dir, "app.yaml")))
+	isEqual(t, map[string]string{"A": "a", "B": "b", "BASE": "base"}, em.Fragments()[0].Env)
+}
+
+func TestFeedFileIncludeMissing(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"app.yaml": "name: app\npriority: 100\ninclude: [missing.yaml]\n",
+		"ok.yaml":  "name: ok\npriority: 100\n",
+	})
+
+	errs, err := (&EnvManager{}).FeedDirCollect(dir)
+	isNoErr(t, err)
+	isEqual(t, 1, len(errs))
+	isTrue(t, strings.Contains(errs[0].Error(), "failed to read include "+filepath.Join(dir, "missing.yaml")))
+}
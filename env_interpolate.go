@@ -0,0 +1,368 @@
+// Copyright (C) Kumo inc. and its affiliates.
+// Author: Jeff.li lijippy@163.com
+// All rights reserved.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package env
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// InterpolateMerged resolves $VAR and ${VAR} references in the merged values.
+// Fragments are walked in priority order and a reference resolves to the value
+// the variable has at that point, the same way sourcing a generated shell file
+// would: a fragment sees the keys of lower priority fragments and its own keys,
+// and a self reference such as PATH="$PATH:/opt/bin" refers to the value set
+// by a lower priority fragment. The shell builders then write the resolved
+// values as well, so every output agrees with Merged.
+//
+// References that cannot be resolved, either because the variable is not
+// defined or because of a reference cycle, are left as written. With strict set
+// they are reported as an error instead and the merged map is left unchanged.
+func (e *EnvManager) InterpolateMerged(strict bool) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.sorted {
+		return fmt.Errorf("not build complete yet")
+	}
+
+	resolved := make(map[string]string, len(e.merged))
+	values := make(map[*EnvFragment]map[string]string)
+	var errs []error
+	for _, frag := range e.active {
+		local := make(map[string]string, len(frag.Env))
+		visiting := make(map[string]bool)
+
+		var resolve func(key string) string
+		resolve = func(key string) string {
+			if v, ok := local[key]; ok {
+				return v
+			}
+			visiting[key] = true
+			cyclic := make(map[string]bool)
+			v, missing := expandRefs(frag.Env[key], func(name string) (string, bool) {
+				if _, own := frag.Env[name]; own && name != key {
+					if visiting[name] {
+						cyclic[name] = true
+						return "", false
+					}
+					return resolve(name), true
+				}
+				v, ok := resolved[name]
+				return v, ok
+			})
+			for _, name := range missing {
+				if cyclic[name] {
+					errs = append(errs, fmt.Errorf("reference cycle between %s and %s in fragment %s", key, name, frag.Name))
+				} else {
+					errs = append(errs, fmt.Errorf("undefined variable %s referenced by %s in fragment %s", name, key, frag.Name))
+				}
+			}
+			delete(visiting, key)
+			local[key] = v
+			return v
+		}
+
+		for _, k := range sortedKeys(frag.Env) {
+			resolve(k)
+		}
+		for orig, v := range local {
+			k := e.envKey(orig)
+			if e.isBlocked(frag, k) {
+				continue
+			}
+			if prepend, ok := frag.listMode(orig); ok {
+				v = joinList(resolved[k], v, e.listSeparator(), prepend)
+			}
+			resolved[k] = v
+			if values[frag] == nil {
+				values[frag] = make(map[string]string)
+			}
+			values[frag][k] = v
+		}
+		for _, orig := range frag.Unset {
+			if k := e.envKey(orig); !e.isBlocked(frag, k) {
+				delete(resolved, k)
+			}
+		}
+	}
+
+	// defaults apply last and see the final values of the other keys; a
+	// reference to another default gets its value as written
+	for _, k := range sortedKeys(e.defaulted) {
+		frag := e.defaulted[k]
+		v, missing := expandRefs(e.merged[k], func(name string) (string, bool) {
+			if e.defaulted[name] != nil {
+				return e.merged[name], true
+			}
+			v, ok := resolved[name]
+			return v, ok
+		})
+		for _, name := range missing {
+			errs = append(errs, fmt.Errorf("undefined variable %s referenced by %s in fragment %s", name, k, frag.Name))
+		}
+		resolved[k] = v
+		if values[frag] == nil {
+			values[frag] = make(map[string]string)
+		}
+		values[frag][k] = v
+	}
+
+	if strict && len(errs) > 0 {
+		return fmt.Errorf("interpolation failed: %w", errors.Join(errs...))
+	}
+	for k := range e.merged {
+		e.merged[k] = resolved[k]
+	}
+	e.interpolated = values
+	return nil
+}
+
+// ReferenceGraph maps every merged key whose value references other
+// variables with $VAR or ${VAR} to the names it references, sorted and
+// without duplicates. Names without a merged key are included, as they show
+// what InterpolateMerged leaves unresolved. A self reference such as PATH in
+// PATH="$PATH:/opt/bin" refers to the inherited value and is left out. The
+// graph reflects the merged values as they are, so it is empty for keys
+// InterpolateMerged already resolved. It returns nil before SortAndMerge.
+func (e *EnvManager) ReferenceGraph() map[string][]string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if !e.sorted {
+		return nil
+	}
+	graph := make(map[string][]string)
+	for k, v := range e.merged {
+		if refs := references(v, k); len(refs) > 0 {
+			graph[k] = refs
+		}
+	}
+	return graph
+}
+
+// references returns the sorted, distinct names referenced in s, leaving out
+// self.
+func references(s, self string) []string {
+	seen := make(map[string]bool)
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' {
+			continue
+		}
+		name, width := parseRef(s[i+1:])
+		if width > 0 && name != self {
+			seen[name] = true
+		}
+		i += width
+	}
+	return sortedKeys(seen)
+}
+
+// UnresolvedReferences maps every merged key whose value references
+// variables that are neither merged keys nor set in the process environment
+// to the names of those variables, sorted and without duplicates, as a
+// pre-flight check for references that would expand to nothing. Next to
+// $VAR and ${VAR} it understands the PowerShell forms $env:VAR and
+// ${env:VAR}. It returns nil before SortAndMerge.
+func (e *EnvManager) UnresolvedReferences() map[string][]string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if !e.sorted {
+		return nil
+	}
+	unresolved := make(map[string][]string)
+	for k, v := range e.merged {
+		var names []string
+		for _, name := range anyReferences(v) {
+			if _, ok := e.merged[name]; ok {
+				continue
+			}
+			if _, ok := os.LookupEnv(name); !ok {
+				names = append(names, name)
+			}
+		}
+		if len(names) > 0 {
+			unresolved[k] = names
+		}
+	}
+	return unresolved
+}
+
+// anyReferences returns the sorted, distinct names referenced in s in shell
+// or PowerShell syntax.
+func anyReferences(s string) []string {
+	seen := make(map[string]bool)
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' {
+			continue
+		}
+		name, width := parsePwshRef(s[i+1:])
+		if width == 0 {
+			name, width = parseRef(s[i+1:])
+		}
+		if width > 0 {
+			seen[name] = true
+		}
+		i += width
+	}
+	return sortedKeys(seen)
+}
+
+// parsePwshRef parses the variable name following a '$' in the PowerShell
+// forms env:NAME and {env:NAME}, where env is case insensitive. It returns the
+// name and the number of bytes consumed, or a zero width for other input.
+func parsePwshRef(s string) (string, int) {
+	braced := strings.HasPrefix(s, "{")
+	rest := strings.TrimPrefix(s, "{")
+	if len(rest) < 4 || !strings.EqualFold(rest[:4], "env:") {
+		return "", 0
+	}
+	name, width := parseRef(rest[4:])
+	if width == 0 || strings.HasPrefix(rest[4:], "{") {
+		return "", 0
+	}
+	if !braced {
+		return name, 4 + width
+	}
+	if !strings.HasPrefix(rest[4+width:], "}") {
+		return "", 0
+	}
+	return name, 4 + width + 2
+}
+
+// ReferenceCycles returns the groups of keys of graph, as returned by
+// ReferenceGraph, that reference each other in a cycle: each group holds
+// the keys from which every other key of the group can be reached. Groups
+// and the keys within them are sorted; nil means the graph has no cycle.
+func ReferenceCycles(graph map[string][]string) [][]string {
+	// Tarjan's strongly connected components
+	var (
+		cycles  [][]string
+		stack   []string
+		onStack = make(map[string]bool)
+		index   = make(map[string]int)
+		low     = make(map[string]int)
+	)
+	var visit func(k string)
+	visit = func(k string) {
+		index[k] = len(index)
+		low[k] = index[k]
+		stack = append(stack, k)
+		onStack[k] = true
+		for _, ref := range graph[k] {
+			if _, seen := index[ref]; !seen {
+				visit(ref)
+				low[k] = min(low[k], low[ref])
+			} else if onStack[ref] {
+				low[k] = min(low[k], index[ref])
+			}
+		}
+		if low[k] != index[k] {
+			return
+		}
+		var group []string
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			group = append(group, top)
+			if top == k {
+				break
+			}
+		}
+		if len(group) > 1 {
+			sort.Strings(group)
+			cycles = append(cycles, group)
+		}
+	}
+	for _, k := range sortedKeys(graph) {
+		if _, seen := index[k]; !seen {
+			visit(k)
+		}
+	}
+	sort.Slice(cycles, func(i, j int) bool { return cycles[i][0] < cycles[j][0] })
+	return cycles
+}
+
+// expandRefs replaces $NAME and ${NAME} references in s using lookup.
+// References lookup cannot resolve are kept verbatim and their names are
+// returned. A '$' that does not start a reference is kept as is.
+func expandRefs(s string, lookup func(name string) (string, bool)) (string, []string) {
+	var sb strings.Builder
+	var missing []string
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		name, width := parseRef(s[i+1:])
+		if width == 0 {
+			sb.WriteByte('$')
+			continue
+		}
+		if v, ok := lookup(name); ok {
+			sb.WriteString(v)
+		} else {
+			missing = append(missing, name)
+			sb.WriteString(s[i : i+1+width])
+		}
+		i += width
+	}
+	return sb.String(), missing
+}
+
+// parseRef parses the variable name following a '$'. It returns the name and
+// the number of bytes consumed, or a zero width if s does not start with
+// NAME or {NAME}.
+func parseRef(s string) (string, int) {
+	if strings.HasPrefix(s, "{") {
+		end := strings.IndexByte(s, '}')
+		if end < 0 || !isVarName(s[1:end]) {
+			return "", 0
+		}
+		return s[1:end], end + 1
+	}
+	n := 0
+	for n < len(s) && isVarByte(s[n], n == 0) {
+		n++
+	}
+	return s[:n], n
+}
+
+func isVarName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isVarByte(s[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func isVarByte(c byte, first bool) bool {
+	switch {
+	case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		return true
+	case c >= '0' && c <= '9':
+		return !first
+	}
+	return false
+}
@@ -0,0 +1,222 @@
+package env
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newInterpolateManager(tb testing.TB, frags ...*EnvFragment) *EnvManager {
+	tb.Helper()
+
+	em := &EnvManager{}
+	for _, frag := range frags {
+		isNoErr(tb, em.AddFragment(frag))
+	}
+	isNoErr(tb, em.SortAndMergeStrict())
+	return em
+}
+
+func TestInterpolateMerged(t *testing.T) {
+	em := newInterpolateManager(t,
+		&EnvFragment{Name: "base", Priority: 100, Env: map[string]string{
+			"SERVICE_HOST": "0.0.0.0",
+			"SERVICE_PORT": "8080",
+			"PATH":         "/usr/bin",
+		}},
+		&EnvFragment{Name: "app", Priority: 110, Env: map[string]string{
+			"SERVICE_URL": "http://$SERVICE_HOST:${SERVICE_PORT}",
+			"PATH":        "/opt/app/bin:$PATH",
+			"APP_HOME":    "/opt/app",
+			"APP_DATA":    "${APP_HOME}/data",
+			"PRICE":       "$5 and $$",
+		}},
+		&EnvFragment{Name: "late", Priority: 120, Env: map[string]string{
+			"SERVICE_PORT": "9090",
+		}},
+	)
+
+	isNoErr(t, em.InterpolateMerged(true))
+	merged := em.Merged()
+	// app resolves against what was merged before it, like a sourced file
+	isEqual(t, "http://0.0.0.0:8080", merged["SERVICE_URL"])
+	isEqual(t, "9090", merged["SERVICE_PORT"])
+	isEqual(t, "/opt/app/bin:/usr/bin", merged["PATH"])
+	isEqual(t, "/opt/app/data", merged["APP_DATA"])
+	isEqual(t, "$5 and $$", merged["PRICE"])
+}
+
+func TestInterpolateMergedBuild(t *testing.T) {
+	requireShell(t, "bash")
+
+	em := newInterpolateManager(t,
+		&EnvFragment{Name: "base", Priority: 100, Env: map[string]string{
+			"HOST":  "h",
+			"PORT":  "1",
+			"TOOLS": "/usr/bin",
+		}},
+		&EnvFragment{Name: "app", Priority: 110, Env: map[string]string{
+			"URL":   "http://$HOST:${PORT}",
+			"TOOLS": "/opt/${HOST}/bin",
+		}, Defaults: map[string]string{
+			"APP_HOME": "/opt/$HOST",
+		}, Append: []string{"TOOLS"}},
+	)
+	isNoErr(t, em.InterpolateMerged(true))
+
+	dir := t.TempDir()
+	isNoErr(t, em.BuildBash(filepath.Join(dir, "env.sh")))
+	isNoErr(t, em.BuildDotenv(filepath.Join(dir, ".env")))
+	dotenv := readDotenv(t, filepath.Join(dir, ".env"))
+
+	keys := []string{"APP_HOME", "HOST", "PORT", "TOOLS", "URL"}
+	script := `. "$1"; for k in ` + strings.Join(keys, " ") + `; do printf '%s\0' "${!k}"; done`
+	out, err := exec.Command("bash", "-c", script, "bash", filepath.Join(dir, "env.sh")).Output()
+	isNoErr(t, err)
+	values := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+	for i, k := range keys {
+		isEqual(t, dotenv[k], values[i])
+	}
+	isEqual(t, "http://h:1", values[4])
+	isEqual(t, "/opt/h", values[0])
+	isEqual(t, "/usr/bin:/opt/h/bin", values[3])
+}
+
+func TestInterpolateMergedUndefined(t *testing.T) {
+	em := newInterpolateManager(t,
+		&EnvFragment{Name: "app", Priority: 100, Env: map[string]string{
+			"URL": "http://${UNDEFINED_HOST}:$PORT",
+		}},
+	)
+
+	err := em.InterpolateMerged(true)
+	isTrue(t, err != nil)
+	isTrue(t, strings.Contains(err.Error(), "undefined variable UNDEFINED_HOST referenced by URL in fragment app"))
+	isTrue(t, strings.Contains(err.Error(), "undefined variable PORT referenced by URL in fragment app"))
+	isEqual(t, "http://${UNDEFINED_HOST}:$PORT", em.Merged()["URL"])
+
+	isNoErr(t, em.InterpolateMerged(false))
+	isEqual(t, "http://${UNDEFINED_HOST}:$PORT", em.Merged()["URL"])
+}
+
+func TestInterpolateMergedCycle(t *testing.T) {
+	em := newInterpolateManager(t,
+		&EnvFragment{Name: "app", Priority: 100, Env: map[string]string{
+			"A":    "$B",
+			"B":    "$A",
+			"SELF": "x$SELF",
+		}},
+	)
+
+	err := em.InterpolateMerged(true)
+	isTrue(t, err != nil)
+	isTrue(t, strings.Contains(err.Error(), "reference cycle between B and A in fragment app"))
+	isFalse(t, strings.Contains(err.Error(), "undefined variable A"))
+	isTrue(t, strings.Contains(err.Error(), "undefined variable SELF referenced by SELF"))
+
+	isNoErr(t, em.InterpolateMerged(false))
+	isEqual(t, "x$SELF", em.Merged()["SELF"])
+}
+
+func TestInterpolateMergedNotSorted(t *testing.T) {
+	isErrorWithMessage(t, (&EnvManager{}).InterpolateMerged(false), "not build complete yet")
+}
+
+func TestExpandRefs(t *testing.T) {
+	lookup := func(name string) (string, bool) {
+		if name == "A" {
+			return "1", true
+		}
+		return "", false
+	}
+	for in, want := range map[string]string{
+		"":          "",
+		"$A":        "1",
+		"${A}":      "1",
+		"$A$A":      "11",
+		"$AB":       "$AB",
+		"${A":       "${A",
+		"${}":       "${}",
+		"$":         "$",
+		"a$1":       "a$1",
+		"$A_":       "$A_",
+		"x${A}y$A.": "x1y1.",
+	} {
+		got, _ := expandRefs(in, lookup)
+		isEqual(t, want, got)
+	}
+}
+
+func TestReferenceGraph(t *testing.T) {
+	em := &EnvManager{}
+	isEqual(t, 0, len(em.ReferenceGraph()))
+
+	em = newInterpolateManager(t,
+		&EnvFragment{Name: "app", Priority: 100, Env: map[string]string{
+			"URL":   "http://$HOST:${PORT}/$HOST",
+			"HOST":  "localhost",
+			"PORT":  "8080",
+			"PATH":  "/opt/bin:$PATH",
+			"A":     "$B",
+			"B":     "${C}x",
+			"C":     "$A and $MISSING",
+			"D":     "$E",
+			"E":     "$D",
+			"PRICE": "5$",
+		}},
+	)
+	graph := em.ReferenceGraph()
+	isEqual(t, map[string][]string{
+		"URL": {"HOST", "PORT"},
+		"A":   {"B"},
+		"B":   {"C"},
+		"C":   {"A", "MISSING"},
+		"D":   {"E"},
+		"E":   {"D"},
+	}, graph)
+	isEqual(t, [][]string{{"A", "B", "C"}, {"D", "E"}}, ReferenceCycles(graph))
+
+	delete(graph, "E")
+	isEqual(t, [][]string{{"A", "B", "C"}}, ReferenceCycles(graph))
+	isEqual(t, 0, len(ReferenceCycles(map[string][]string{"X": {"Y"}, "Y": {"Z"}})))
+}
+
+func TestUnresolvedReferences(t *testing.T) {
+	isEqual(t, 0, len((&EnvManager{}).UnresolvedReferences()))
+
+	t.Setenv("UNRESOLVEDTEST_HOME", "/home/dev")
+	em := newInterpolateManager(t,
+		&EnvFragment{Name: "app", Priority: 100, Env: map[string]string{
+			"URL":   "http://$HOST:${PORT}/$BASE_PATH",
+			"HOST":  "localhost",
+			"CACHE": "$UNRESOLVEDTEST_HOME/.cache",
+			"WIN":   "$env:APPDATA_MISSING\\app;${env:HOST};$Env:TEMP_MISSING",
+			"PRICE": "5$ and $",
+		}},
+	)
+	isEqual(t, map[string][]string{
+		"URL": {"BASE_PATH", "PORT"},
+		"WIN": {"APPDATA_MISSING", "TEMP_MISSING"},
+	}, em.UnresolvedReferences())
+}
+
+func TestParsePwshRef(t *testing.T) {
+	for _, tt := range []struct {
+		in    string
+		name  string
+		width int
+	}{
+		{"env:HOME/x", "HOME", 8},
+		{"Env:PATH", "PATH", 8},
+		{"{env:HOME}x", "HOME", 10},
+		{"{env:HOME", "", 0},
+		{"env:", "", 0},
+		{"env:{X}", "", 0},
+		{"HOME", "", 0},
+	} {
+		name, width := parsePwshRef(tt.in)
+		isEqual(t, tt.name, name)
+		isEqual(t, tt.width, width)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright (C) Kumo inc. and its affiliates.
+// Author: Jeff.li lijippy@163.com
+// All rights reserved.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package env
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// BuildNodeEnvJSON writes the merged environment as a JSON object of string
+// values for Node tooling such as env-cmd. With an empty envName the object
+// is flat, as expected by `env-cmd -f .env.json`. Otherwise it is nested
+// under envName, the shape of an .env-cmdrc.json file used with
+// `env-cmd -e envName`. The ctime is included as a regular key named by
+// CtimeKey.
+func (e *EnvManager) BuildNodeEnvJSON(dst, envName string) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if !e.sorted {
+		return fmt.Errorf("not build complete yet")
+	}
+
+	vars := make(map[string]string, len(e.merged)+1)
+	if !e.NoCtime {
+		vars[e.ctimeKey()] = e.Ctime.Format(time.RFC3339)
+	}
+	for k, v := range e.merged {
+		if e.keyAllowed(k) {
+			vars[k] = v
+		}
+	}
+
+	var doc interface{} = vars
+	if envName != "" {
+		doc = map[string]map[string]string{envName: vars}
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal env to JSON: %w", err)
+	}
+	return e.writeFile(dst, append(data, '\n'))
+}
+
+// jsonEnv is the JSON layout produced by MarshalJSON and BuildJSON.
+type jsonEnv struct {
+	Ctime     string            `json:"ctime"`
+	Fragments int               `json:"fragments"`
+	Env       map[string]string `json:"env"`
+}
+
+// MarshalJSON implements json.Marshaler. It serializes the merged
+// environment with its metadata: the ctime and the number of fragments.
+// Keys dropped by Allowlist or Denylist are left out. encoding/json sorts map
+// keys, so the output is stable.
+func (e *EnvManager) MarshalJSON() ([]byte, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if !e.sorted {
+		return nil, fmt.Errorf("not build complete yet")
+	}
+	doc := jsonEnv{
+		Ctime:     e.Ctime.Format(time.RFC3339),
+		Fragments: len(e.active),
+		Env:       make(map[string]string, len(e.merged)),
+	}
+	for k, v := range e.merged {
+		if e.keyAllowed(k) {
+			doc.Env[k] = v
+		}
+	}
+	return json.Marshal(doc)
+}
+
+// BuildJSON writes the merged environment and its metadata as indented JSON,
+// in the format of MarshalJSON.
+func (e *EnvManager) BuildJSON(dst string) error {
+	data, err := e.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "  "); err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	return e.writeFile(dst, buf.Bytes())
+}
+
+// Meta is the manifest written by WriteMetaJSON.
+type Meta struct {
+	Ctime time.Time `json:"ctime"`
+	// Fragments lists the merged fragments in priority order.
+	Fragments []MetaFragment `json:"fragments"`
+	// Hash is the fingerprint of the merged environment, see Hash.
+	Hash string `json:"hash"`
+}
+
+// MetaFragment identifies a merged fragment in a Meta manifest.
+type MetaFragment struct {
+	Name   string `json:"name"`
+	Source string `json:"source,omitempty"`
+}
+
+// WriteMetaJSON writes a JSON manifest of the generated environment: the
+// ctime, the merged fragments with their sources, and the hash of the merged
+// environment. Compare the hash with a new one to tell whether generated
+// files are up to date. WriteMeta still writes the plain ctime.
+func (e *EnvManager) WriteMetaJSON(dst string) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.writeMetaJSON(dst)
+}
+
+func (e *EnvManager) writeMetaJSON(dst string) error {
+	hash, err := e.hash()
+	if err != nil {
+		return err
+	}
+	meta := Meta{
+		Ctime:     e.Ctime,
+		Fragments: make([]MetaFragment, 0, len(e.active)),
+		Hash:      hash,
+	}
+	for _, frag := range e.active {
+		meta.Fragments = append(meta.Fragments, MetaFragment{Name: frag.Name, Source: frag.Source})
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal meta to JSON: %w", err)
+	}
+	return e.writeFile(dst, append(data, '\n'))
+}
+
+// ReadMetaJSON reads a manifest written by WriteMetaJSON.
+func ReadMetaJSON(path string) (Meta, error) {
+	var meta Meta
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return Meta{}, fmt.Errorf("failed to parse meta %s: %w", path, err)
+	}
+	return meta, nil
+}
@@ -0,0 +1,114 @@
+package env
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newJSONManager(tb testing.TB) *EnvManager {
+	tb.Helper()
+
+	em := &EnvManager{}
+	isNoErr(tb, em.AddFragment(&EnvFragment{Name: "base", Priority: 100, Env: map[string]string{
+		"API_URL": "http://localhost:8080",
+		"QUOTE":   `say "hi"`,
+	}}))
+	isNoErr(tb, em.SortAndMergeStrict())
+	return em
+}
+
+func TestBuildNodeEnvJSON(t *testing.T) {
+	em := newJSONManager(t)
+	dst := filepath.Join(t.TempDir(), ".env.json")
+	isNoErr(t, em.BuildNodeEnvJSON(dst, ""))
+
+	data, err := os.ReadFile(dst)
+	isNoErr(t, err)
+	var vars map[string]string
+	isNoErr(t, json.Unmarshal(data, &vars))
+	isEqual(t, "http://localhost:8080", vars["API_URL"])
+	isEqual(t, `say "hi"`, vars["QUOTE"])
+	isEqual(t, em.Ctime.Format(time.RFC3339), vars[ENV_CTIME_KEY])
+	isEqual(t, 3, len(vars))
+	// keys are sorted, so regenerating produces the same file
+	isTrue(t, strings.Index(string(data), "API_URL") < strings.Index(string(data), "QUOTE"))
+}
+
+func TestBuildNodeEnvJSONNested(t *testing.T) {
+	em := newJSONManager(t)
+	em.Denylist = []string{"QUOTE"}
+	dst := filepath.Join(t.TempDir(), ".env-cmdrc.json")
+	isNoErr(t, em.BuildNodeEnvJSON(dst, "development"))
+
+	data, err := os.ReadFile(dst)
+	isNoErr(t, err)
+	var rc map[string]map[string]string
+	isNoErr(t, json.Unmarshal(data, &rc))
+	isEqual(t, 1, len(rc))
+	isEqual(t, "http://localhost:8080", rc["development"]["API_URL"])
+	_, ok := rc["development"]["QUOTE"]
+	isFalse(t, ok)
+
+	isErrorWithMessage(t, (&EnvManager{}).BuildNodeEnvJSON(dst, ""), "not build complete yet")
+}
+
+func TestMarshalJSON(t *testing.T) {
+	em := newJSONManager(t)
+	data, err := json.Marshal(em)
+	isNoErr(t, err)
+	isEqual(t, `{"ctime":"`+em.Ctime.Format(time.RFC3339)+`","fragments":1,"env":{"API_URL":"http://localhost:8080","QUOTE":"say \"hi\""}}`, string(data))
+
+	_, err = json.Marshal(&EnvManager{})
+	isTrue(t, err != nil)
+}
+
+func TestBuildJSON(t *testing.T) {
+	em := newJSONManager(t)
+	dst := filepath.Join(t.TempDir(), "env.json")
+	isNoErr(t, em.BuildJSON(dst))
+
+	data, err := os.ReadFile(dst)
+	isNoErr(t, err)
+	var doc struct {
+		Ctime     string            `json:"ctime"`
+		Fragments int               `json:"fragments"`
+		Env       map[string]string `json:"env"`
+	}
+	isNoErr(t, json.Unmarshal(data, &doc))
+	isEqual(t, 1, doc.Fragments)
+	isEqual(t, em.Ctime.Format(time.RFC3339), doc.Ctime)
+	isEqual(t, em.Merged(), doc.Env)
+
+	// stable output
+	isNoErr(t, em.BuildJSON(dst))
+	again, err := os.ReadFile(dst)
+	isNoErr(t, err)
+	isEqual(t, string(data), string(again))
+}
+
+func TestWriteMetaJSON(t *testing.T) {
+	em := newJSONManager(t)
+	isNoErr(t, em.FeedReader(strings.NewReader("name: app\npriority: 110\nenv:\n  PORT: \"8080\"\n"), "app.yaml"))
+	isNoErr(t, em.SortAndMergeStrict())
+	dst := filepath.Join(t.TempDir(), "meta.json")
+	isNoErr(t, em.WriteMetaJSON(dst))
+
+	meta, err := ReadMetaJSON(dst)
+	isNoErr(t, err)
+	hash, err := em.Hash()
+	isNoErr(t, err)
+	isTrue(t, em.Ctime.Equal(meta.Ctime))
+	isEqual(t, hash, meta.Hash)
+	isEqual(t, []MetaFragment{{Name: "base"}, {Name: "app", Source: "app.yaml"}}, meta.Fragments)
+
+	isErrorWithMessage(t, (&EnvManager{}).WriteMetaJSON(dst), "not build complete yet")
+
+	isNoErr(t, os.WriteFile(dst, []byte("2024-01-01T00:00:00Z"), 0o644))
+	_, err = ReadMetaJSON(dst)
+	isTrue(t, err != nil)
+	isTrue(t, strings.HasPrefix(err.Error(), "failed to parse meta "+dst))
+}
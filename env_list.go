@@ -0,0 +1,69 @@
+// Copyright (C) Kumo inc. and its affiliates.
+// Author: Jeff.li lijippy@163.com
+// All rights reserved.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package env
+
+import (
+	"os"
+	"strings"
+)
+
+// listMode reports how frag accumulates key: prepend is true when the
+// fragment's value goes in front of the existing one. ok is false when key
+// is not a list variable in frag and its value simply replaces the existing
+// one.
+func (frag *EnvFragment) listMode(key string) (prepend, ok bool) {
+	switch {
+	case matchAnyKey(frag.Prepend, key):
+		return true, true
+	case matchAnyKey(frag.Append, key):
+		return false, true
+	}
+	return false, false
+}
+
+// listSeparator returns ListSeparator, defaulting to the OS path list
+// separator.
+func (e *EnvManager) listSeparator() string {
+	if e.ListSeparator != "" {
+		return e.ListSeparator
+	}
+	return string(os.PathListSeparator)
+}
+
+// joinList adds the elements of value after, or with prepend before, those
+// of prev. Empty elements are dropped and only the first occurrence of an
+// element is kept, so the result preserves the order elements were first
+// seen in.
+func joinList(prev, value, sep string, prepend bool) string {
+	parts := []string{prev, value}
+	if prepend {
+		parts[0], parts[1] = value, prev
+	}
+	var out []string
+	seen := make(map[string]bool)
+	for _, part := range parts {
+		for _, elem := range strings.Split(part, sep) {
+			if elem == "" || seen[elem] {
+				continue
+			}
+			seen[elem] = true
+			out = append(out, elem)
+		}
+	}
+	return strings.Join(out, sep)
+}
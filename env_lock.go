@@ -0,0 +1,169 @@
+// Copyright (C) Kumo inc. and its affiliates.
+// Author: Jeff.li lijippy@163.com
+// All rights reserved.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package env
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"os"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ChangeKind tells how an entry differs between two states.
+type ChangeKind string
+
+const (
+	ChangeAdded    ChangeKind = "added"
+	ChangeRemoved  ChangeKind = "removed"
+	ChangeModified ChangeKind = "modified"
+)
+
+// Change is a single difference between two environment states.
+type Change struct {
+	Kind ChangeKind
+	// Key is the env key, or "fragment:<name>" for a fragment fingerprint.
+	Key string
+	Old string // empty for added entries
+	New string // empty for removed entries
+}
+
+func (c Change) String() string {
+	switch c.Kind {
+	case ChangeAdded:
+		return fmt.Sprintf("+ %s=%s", c.Key, c.New)
+	case ChangeRemoved:
+		return fmt.Sprintf("- %s=%s", c.Key, c.Old)
+	}
+	return fmt.Sprintf("~ %s: %s -> %s", c.Key, c.Old, c.New)
+}
+
+// lockFile is the on-disk layout written by WriteLock. Maps are marshaled
+// with sorted keys, which keeps the file stable and diff friendly.
+type lockFile struct {
+	Env       map[string]string `yaml:"env"`
+	Fragments map[string]string `yaml:"fragments"`
+}
+
+// WriteLock writes a lockfile capturing the merged environment and a
+// fingerprint of every fragment. Commit it and call VerifyLock in CI to
+// detect drift between the lockfile and the current fragments. The ctime is
+// not recorded, so regenerating an unchanged environment yields the same file.
+func (e *EnvManager) WriteLock(dst string) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	lock, err := e.lock()
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(lock)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lock: %w", err)
+	}
+	if err := e.writeFile(dst, data); err != nil {
+		return fmt.Errorf("failed to write lock file %s: %w", dst, err)
+	}
+	return nil
+}
+
+// VerifyLock compares the current state against the lockfile at path. It
+// reports whether they match and the changes from the lockfile to the
+// current state, ordered by key with env keys before fragments.
+func (e *EnvManager) VerifyLock(path string) (bool, []Change, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	current, err := e.lock()
+	if err != nil {
+		return false, nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to read lock file %s: %w", path, err)
+	}
+	var locked lockFile
+	if err := yaml.Unmarshal(data, &locked); err != nil {
+		return false, nil, fmt.Errorf("failed to parse lock file %s: %w", path, err)
+	}
+
+	changes := diffMaps(locked.Env, current.Env, "")
+	changes = append(changes, diffMaps(locked.Fragments, current.Fragments, "fragment:")...)
+	return len(changes) == 0, changes, nil
+}
+
+func (e *EnvManager) lock() (*lockFile, error) {
+	if !e.sorted {
+		return nil, fmt.Errorf("not build complete yet")
+	}
+	lock := &lockFile{
+		Env:       maps.Clone(e.merged),
+		Fragments: make(map[string]string, len(e.fragments)),
+	}
+	seen := make(map[string]int)
+	for _, frag := range e.fragments {
+		sum, err := fragmentFingerprint(frag)
+		if err != nil {
+			return nil, err
+		}
+		id := frag.Name
+		if seen[frag.Name]++; seen[frag.Name] > 1 {
+			id = fmt.Sprintf("%s#%d", frag.Name, seen[frag.Name])
+		}
+		lock.Fragments[id] = sum
+	}
+	return lock, nil
+}
+
+// fragmentFingerprint hashes the YAML form of a fragment. The source path is
+// left out so checkouts in different directories produce the same hash.
+func fragmentFingerprint(frag *EnvFragment) (string, error) {
+	content := *frag
+	content.Source = ""
+	data, err := yaml.Marshal(&content)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal fragment %s: %w", frag.Name, err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// diffMaps returns the changes turning before into after, ordered by key. Keys are
+// reported with prefix prepended.
+func diffMaps(before, after map[string]string, prefix string) []Change {
+	var changes []Change
+	for _, k := range sortedKeys(before) {
+		nv, ok := after[k]
+		switch {
+		case !ok:
+			changes = append(changes, Change{Kind: ChangeRemoved, Key: prefix + k, Old: before[k]})
+		case nv != before[k]:
+			changes = append(changes, Change{Kind: ChangeModified, Key: prefix + k, Old: before[k], New: nv})
+		}
+	}
+	for _, k := range sortedKeys(after) {
+		if _, ok := before[k]; !ok {
+			changes = append(changes, Change{Kind: ChangeAdded, Key: prefix + k, New: after[k]})
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
+	return changes
+}
@@ -0,0 +1,69 @@
+package env
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newLockManager(tb testing.TB) *EnvManager {
+	tb.Helper()
+
+	em := &EnvManager{}
+	isNoErr(tb, em.FeedReader(strings.NewReader(`name: base
+priority: 100
+env:
+  HOST: localhost
+  PORT: "80"
+---
+name: app
+priority: 110
+env:
+  PORT: "8080"
+`), "fragments.yaml"))
+	isNoErr(tb, em.SortAndMergeStrict())
+	return em
+}
+
+func TestVerifyLockMatching(t *testing.T) {
+	lock := filepath.Join(t.TempDir(), "env.lock")
+	isNoErr(t, newLockManager(t).WriteLock(lock))
+
+	// a fresh manager loading the same fragments from elsewhere still matches
+	em := newLockManager(t)
+	em.fragments[0].Source = "/elsewhere/fragments.yaml"
+	ok, changes, err := em.VerifyLock(lock)
+	isNoErr(t, err)
+	isTrue(t, ok)
+	isEqual(t, 0, len(changes))
+}
+
+func TestVerifyLockDrift(t *testing.T) {
+	lock := filepath.Join(t.TempDir(), "env.lock")
+	isNoErr(t, newLockManager(t).WriteLock(lock))
+
+	em := newLockManager(t)
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "extra", Priority: 120, Env: map[string]string{
+		"PORT":  "9090",
+		"DEBUG": "1",
+	}}))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	ok, changes, err := em.VerifyLock(lock)
+	isNoErr(t, err)
+	isFalse(t, ok)
+	isEqual(t, 3, len(changes))
+	isEqual(t, Change{Kind: ChangeAdded, Key: "DEBUG", New: "1"}, changes[0])
+	isEqual(t, Change{Kind: ChangeModified, Key: "PORT", Old: "8080", New: "9090"}, changes[1])
+	isEqual(t, ChangeAdded, changes[2].Kind)
+	isEqual(t, "fragment:extra", changes[2].Key)
+	isEqual(t, "~ PORT: 8080 -> 9090", changes[1].String())
+}
+
+func TestVerifyLockErrors(t *testing.T) {
+	em := newLockManager(t)
+	_, _, err := em.VerifyLock(filepath.Join(t.TempDir(), "missing.lock"))
+	isTrue(t, err != nil)
+
+	isErrorWithMessage(t, (&EnvManager{}).WriteLock("env.lock"), "not build complete yet")
+}
@@ -0,0 +1,70 @@
+// Copyright (C) Kumo inc. and its affiliates.
+// Author: Jeff.li lijippy@163.com
+// All rights reserved.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package env
+
+import (
+	"log/slog"
+	"strings"
+)
+
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// SetLogger sets the logger receiving structured events about the decisions
+// taken while feeding, merging and building: fragments loaded or rejected,
+// the winner of every merged key, overrides blocked, keys filtered out of an
+// output and the scripts written to it. Per key events are logged at debug
+// level. Events name keys and fragments but never carry values, so secrets
+// do not end up in logs. A nil logger, the default, discards all events.
+func (e *EnvManager) SetLogger(l *slog.Logger) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.logger = l
+}
+
+func (e *EnvManager) log() *slog.Logger {
+	if e.logger == nil {
+		return discardLogger
+	}
+	return e.logger
+}
+
+// filterReason describes why key is left out of the Build* output: by the
+// manager's Denylist or Allowlist, or otherwise by a per-output filter.
+func (e *EnvManager) filterReason(key string) string {
+	switch {
+	case matchAnyKey(e.Denylist, key):
+		return "denylist"
+	case len(e.Allowlist) > 0 && !matchAnyKey(e.Allowlist, key):
+		return "not in allowlist"
+	}
+	return "output filter"
+}
+
+// logMerge logs the outcome of a successful merge.
+func (e *EnvManager) logMerge() {
+	l := e.log()
+	for _, k := range sortedKeys(e.merged) {
+		sources := e.keySources[k]
+		l.Debug("merge winner", "key", k, "fragment", e.owners[k].Name,
+			"shadowed", strings.Join(sources[:len(sources)-1], ","))
+	}
+	for _, b := range e.blocked {
+		l.Warn("override blocked", "key", b.Key, "locked_by", b.LockedBy, "fragment", b.Fragment)
+	}
+	l.Info("merge complete", "fragments", len(e.active), "keys", len(e.merged), "conflicts", len(e.conflicts))
+}
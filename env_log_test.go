@@ -0,0 +1,54 @@
+package env
+
+import (
+	"bytes"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetLogger(t *testing.T) {
+	var buf bytes.Buffer
+	em := &EnvManager{Denylist: []string{"SECRET"}}
+	em.SetLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	isNoErr(t, em.FeedReader(strings.NewReader(`name: base
+priority: 100
+overridable: [PORT]
+env:
+  PORT: "80"
+  HOST: localhost
+  SECRET: s3cr3t
+script:
+  - sh: bash
+    data: echo base
+`), "base.yaml"))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "app", Priority: 110, Env: map[string]string{
+		"PORT": "8080",
+		"HOST": "0.0.0.0",
+	}}))
+	isTrue(t, em.AddFragment(&EnvFragment{Name: "bad", Priority: 1}) != nil)
+	isNoErr(t, em.SortAndMergeStrict())
+	dst := filepath.Join(t.TempDir(), "env.sh")
+	isNoErr(t, em.BuildBash(dst))
+
+	out := buf.String()
+	for _, want := range []string{
+		`level=INFO msg="fragment loaded" fragment=base priority=100 source=base.yaml`,
+		`level=WARN msg="fragment rejected" fragment=bad`,
+		`level=DEBUG msg="merge winner" key=PORT fragment=app shadowed=base`,
+		`level=WARN msg="override blocked" key=HOST locked_by=base fragment=app`,
+		`level=INFO msg="merge complete" fragments=2 keys=3 conflicts=1`,
+		`level=DEBUG msg="key filtered" key=SECRET fragment=base output=` + dst + ` reason=denylist`,
+		`level=DEBUG msg="script included" fragment=base shell=bash output=` + dst,
+		`level=INFO msg="build complete" output=` + dst,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log does not contain %q:\n%s", want, out)
+		}
+	}
+
+	// the default logger discards events
+	isNoErr(t, (&EnvManager{}).AddFragment(&EnvFragment{Name: "quiet", Priority: 100}))
+}
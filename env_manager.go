@@ -18,22 +18,74 @@
 package env
 
 import (
-	"bytes"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"gopkg.in/yaml.v3"
 )
 
+// SystemEnv holds the names of system fragments, which must use priorities
+// 0-19. Use RegisterSystemFragment rather than writing to it directly.
 var SystemEnv map[string]int = make(map[string]int)
 
+// InnerComponentEnv holds the names of internal component fragments, which
+// must use priorities 20-99. Use RegisterInnerComponent rather than writing
+// to it directly.
 var InnerComponentEnv map[string]int = make(map[string]int)
 
+// tierMu guards SystemEnv and InnerComponentEnv.
+var tierMu sync.RWMutex
+
+// RegisterSystemFragment declares name as a system fragment. Fragments with
+// that name must then use a priority in the 0-19 band, which is otherwise
+// rejected. Registration is global and affects every EnvManager.
+func RegisterSystemFragment(name string) {
+	tierMu.Lock()
+	defer tierMu.Unlock()
+	SystemEnv[name] = 1
+}
+
+// UnregisterSystemFragment removes a name registered by RegisterSystemFragment.
+func UnregisterSystemFragment(name string) {
+	tierMu.Lock()
+	defer tierMu.Unlock()
+	delete(SystemEnv, name)
+}
+
+// RegisterInnerComponent declares name as an internal component fragment.
+// Fragments with that name must then use a priority in the 20-99 band, which
+// is otherwise rejected. Registration is global and affects every EnvManager.
+func RegisterInnerComponent(name string) {
+	tierMu.Lock()
+	defer tierMu.Unlock()
+	InnerComponentEnv[name] = 1
+}
+
+// UnregisterInnerComponent removes a name registered by RegisterInnerComponent.
+func UnregisterInnerComponent(name string) {
+	tierMu.Lock()
+	defer tierMu.Unlock()
+	delete(InnerComponentEnv, name)
+}
+
 const (
 	ENV_CTIME_KEY = "ENV_CTIME"
 )
@@ -44,32 +96,365 @@ type EnvFragment struct {
 	Priority int               `yaml:"priority,omitempty"`
 	Env      map[string]string `yaml:"env,omitempty"`
 	Script   []Script          `yaml:"script,omitempty"`
-	Source   string            // file from which this fragment was loaded
+	// AllowOverride lists the keys this fragment may override when the
+	// manager runs with StrictMerge. Entries are key names or path.Match
+	// patterns, "*" allows overriding any key.
+	AllowOverride []string `yaml:"allow_override,omitempty"`
+	// Overridable, when present, lists the keys of this fragment that higher
+	// priority fragments may override; every other key of the fragment is
+	// locked. Entries are key names or path.Match patterns. When absent all
+	// keys can be overridden, an empty list locks them all.
+	Overridable []string `yaml:"overridable,omitempty"`
+	// Unset lists keys this fragment removes. During the merge a listed key
+	// is dropped from the merged environment as if a lower priority fragment
+	// never set it, while a higher priority fragment may set it again; a key
+	// locked by Overridable cannot be unset either. The shell builders emit
+	// an unset statement for every listed key, so variables inherited from
+	// the calling environment are removed too. A fragment cannot both set
+	// and unset the same key.
+	Unset []string `yaml:"unset,omitempty"`
+	// OS and Arch restrict the fragment to the listed operating systems and
+	// architectures, using runtime.GOOS and runtime.GOARCH names such as
+	// linux, darwin, windows or amd64, arm64. SortAndMerge leaves out
+	// fragments that do not match the manager's TargetOS and TargetArch.
+	// An empty list matches everything.
+	OS   []string `yaml:"os,omitempty"`
+	Arch []string `yaml:"arch,omitempty"`
+	// Tags group fragments into sets such as dev, prod or gpu. Once active
+	// tags are set with SetActiveTags, only fragments carrying at least one
+	// of them, and fragments without tags, take part in the merge.
+	Tags []string `yaml:"tags,omitempty"`
+	// Profile names the environment, such as dev, staging or prod, the
+	// fragment belongs to. A fragment with a profile only takes part in the
+	// merge when that profile is selected with SetProfile; fragments without
+	// a profile always do.
+	Profile string `yaml:"profile,omitempty"`
+	// Enabled switches the fragment off when set to false, e.g. for an
+	// experimental fragment kept next to the others. A disabled fragment is
+	// still fed and validated, but SortAndMerge leaves it out and Search
+	// only finds it with SearchOptions.IncludeDisabled. Absent means
+	// enabled, see IsEnabled.
+	Enabled *bool `yaml:"enabled,omitempty"`
+	// Comment is a note for readers of the generated files, written as
+	// comment lines below the fragment banner of the shell and sectioned
+	// dotenv outputs. It may span several lines.
+	Comment string `yaml:"comment,omitempty"`
+	// Append and Prepend mark keys as list variables such as PATH: instead
+	// of replacing the value merged so far, the fragment's value is added
+	// after (Append) or before (Prepend) it, joined with the manager's
+	// ListSeparator, keeping only the first occurrence of every element.
+	// Entries are key names or path.Match patterns.
+	Append  []string `yaml:"append,omitempty"`
+	Prepend []string `yaml:"prepend,omitempty"`
+	// Include lists YAML files whose variables and scripts are added to the
+	// fragment when it is fed from a file, so shared blocks can live in one
+	// base file. Paths are relative to the including file. Included files
+	// hold fragment documents, without the need for a name or priority, and
+	// may include further files; only their env and script entries are
+	// used. The fragment's own variables take precedence over included ones,
+	// later includes over earlier ones, and included scripts come first.
+	// Include cycles are reported as errors.
+	Include []string `yaml:"include,omitempty"`
+	// Prefix namespaces the keys of the fragment: when the fragment is fed,
+	// it is prepended to every key of Env, including included ones, of
+	// Defaults and of ShellEnv, and to the entries of Unset, Append,
+	// Prepend, Overridable, AllowOverride, Secrets and Local, which refer
+	// to the fragment's own keys. With prefix APP_, PORT becomes APP_PORT,
+	// and so it is merged, searched and reported by KeySources and
+	// Fragments.
+	Prefix string `yaml:"prefix,omitempty"`
+	// Defaults holds fallback values for keys no fragment sets. A default
+	// only applies when, after the merge, no fragment's Env set the key,
+	// whatever the priority of either fragment, so a base fragment can
+	// provide fallbacks without overriding anything. Between defaults for
+	// the same key the highest priority fragment wins. A key removed by
+	// Unset stays removed. A fragment cannot both set and default a key.
+	Defaults map[string]string `yaml:"defaults,omitempty"`
+	// Required lists keys that must end up set to a non-empty value, typically
+	// ones another fragment or the process environment has to provide.
+	// CheckRequired reports those missing after the merge. Entries are key
+	// names and are not affected by Prefix.
+	Required []string `yaml:"required,omitempty"`
+	// Secrets lists the keys holding secrets such as passwords or tokens,
+	// as key names or path.Match patterns. A key is secret for every
+	// fragment as soon as one fragment lists it; Search redacts its values.
+	Secrets []string `yaml:"secrets,omitempty"`
+	// ShellEnv overrides the values of Env keys in the output of single
+	// shells, keyed by shell name as in Script, e.g. a pwsh entry setting
+	// a path list with ; where Env uses :. BuildBash, BuildPsh and the other
+	// shell builders write the override of their shell, falling back to the
+	// Env value. Everything else, from the merge to Search and the dotenv
+	// and JSON outputs, uses Env. List variables cannot be overridden.
+	ShellEnv map[string]map[string]string `yaml:"shell_env,omitempty"`
+	// Local lists keys of the fragment that are set as shell variables
+	// without being exported, so they do not leak to child processes: KEY=...
+	// instead of export KEY=... in bash and zsh, $KEY in PowerShell, let in
+	// nushell and set instead of setenv in csh. cmd has no such distinction
+	// and sets them like other keys, as do the dotenv and JSON outputs.
+	// Entries are key names or path.Match patterns; keys not listed are
+	// exported.
+	Local  []string `yaml:"local,omitempty"`
+	Source string   // file from which this fragment was loaded
+	// LoadedAt records when the fragment was fed to the manager. It reflects
+	// load order rather than priority and does not affect merging.
+	LoadedAt time.Time `yaml:"-"`
+
+	// node is the YAML the fragment was decoded from, whose comments
+	// SaveAllYaml carries over.
+	node *yaml.Node
+	// autoPriority is set when Priority was assigned by AutoPriorities.
+	autoPriority bool
+}
+
+// IsEnabled reports whether the fragment takes part in the merge, which is
+// the case unless Enabled is set to false.
+func (frag *EnvFragment) IsEnabled() bool {
+	return frag.Enabled == nil || *frag.Enabled
 }
 
 // Script represents a shell script snippet in the environment fragment.
+// In YAML, sh takes either a single shell name or a list of them, e.g.
+// sh: [bash, zsh]; a list is decoded into Shells.
 type Script struct {
-	Sh   string `yaml:"sh"`   // shell type: bash, zsh, powershell
-	Data string `yaml:"data"` // script content
+	Sh     string   `yaml:"sh,omitempty"`     // shell type: bash, zsh, powershell
+	Shells []string `yaml:"shells,omitempty"` // further shells sharing the script
+	Data   string   `yaml:"data"`             // script content
+	// File names a file holding the script content, as an alternative to
+	// Data, relative to the fragment's Source. It is read into Data when
+	// the fragment is fed and then cleared, so Data always holds the script.
+	File string `yaml:"file,omitempty"`
+	// Order sequences scripts across fragments. Scripts without an order
+	// are written in their fragment's section, after its variables. Scripts
+	// with a non-zero order are written after every fragment, in ascending
+	// order, ties keeping fragment priority order and then slice order.
+	// A script for several shells takes the same place in the output of
+	// each of them, among the scripts of that shell.
+	Order int `yaml:"order,omitempty"`
 }
 
 // EnvManager manages multiple environment fragments and merged result.
+//
+// An EnvManager is safe for concurrent use by multiple goroutines. The
+// exported configuration fields such as Allowlist must not be changed while
+// other goroutines use the manager, and fragments must not be modified after
+// they have been added.
 type EnvManager struct {
+	mu sync.RWMutex
+
 	// fragments maintains the order of fragments as loaded.
-	Fragments []*EnvFragment
+	fragments []*EnvFragment
+	// active holds the fragments taking part in the last merge, in priority
+	// order.
+	active []*EnvFragment
+	// activeTags selects fragments by tag, see SetActiveTags.
+	activeTags []string
+	// profile selects fragments by profile, see SetProfile.
+	profile string
 	// merged contains the final merged key/value environment.
-	Merged map[string]string
-	// keySource maps environment keys to the fragment and file that defined them.
-	KeySources map[string][]string
+	merged map[string]string
+	// keySources maps environment keys to the fragments that defined them.
+	keySources map[string][]string
 	sorted     bool
-	Ctime      time.Time
+	// Ctime is the generation time written to the Build* outputs. It is set
+	// by SortAndMerge, see SetCTime.
+	Ctime time.Time
+	// fixedCtime, when set, replaces the current time in SortAndMerge.
+	fixedCtime time.Time
+	// conflicts lists the keys set by more than one fragment.
+	conflicts []Conflict
+	// owners maps each merged key to the fragment whose value won.
+	owners map[string]*EnvFragment
+	// blocked lists overrides rejected because the key was locked.
+	blocked []BlockedOverride
+	// unset maps the keys removed by a fragment's Unset list, and not set
+	// again by a higher priority fragment, to that fragment.
+	unset map[string]*EnvFragment
+	// defaulted maps the keys set from a fragment's Defaults to that
+	// fragment.
+	defaulted map[string]*EnvFragment
+	// listValues holds, per fragment, the accumulated value of the list
+	// variables it appends to or prepends to, where it differs from the
+	// fragment's own value.
+	listValues map[*EnvFragment]map[string]string
+	// interpolated holds, per fragment, the values InterpolateMerged
+	// resolved its keys and defaults to, keyed by merged key.
+	interpolated map[*EnvFragment]map[string]string
+	// effects maps fragment names to the keys they won and lost in the last
+	// merge, see FragmentEffect.
+	effects map[string]*fragmentEffect
+	// stats counts what the last successful merge processed.
+	stats MergeStats
+	// allYamlNode is the file last read by LoadAllYaml, whose top level
+	// comments SaveAllYaml carries over.
+	allYamlNode *yaml.Node
+
+	// logger receives the events described in SetLogger.
+	logger *slog.Logger
+
+	// Allowlist restricts the keys written by the Build* functions to those
+	// matching at least one entry. Entries are exact key names or
+	// path.Match style patterns such as "APP_*". An empty list allows all keys.
+	Allowlist []string
+	// Denylist drops keys matching any entry from the Build* output, even if
+	// they are allowed by Allowlist.
+	Denylist []string
+
+	// LenientPriorities turns priority band violations into warnings
+	// reported by Validate instead of errors failing Feed*. Fragments must
+	// still have a name.
+	LenientPriorities bool
+	// LenientValues turns values that are not valid UTF-8 or contain a byte
+	// order mark or control characters into warnings reported by Validate
+	// instead of errors failing Feed*. Tabs and line breaks are allowed, see
+	// ValidateOptions.CheckLineBreaks.
+	LenientValues bool
+	// warnings collects the problems tolerated while feeding fragments.
+	warnings []Warning
+
+	// AutoPriorities assigns sequential priorities in load order to custom
+	// tier fragments without a priority, starting at AutoPriorityBase, which
+	// defaults to 100. A priority of 0 then means "auto" instead of failing
+	// validation, so fragments can be added without picking a free priority.
+	AutoPriorities   bool
+	AutoPriorityBase int
+	// autoAssigned counts the priorities assigned by AutoPriorities.
+	autoAssigned int
+
+	// StrictSchema makes the Feed* functions reject fragment documents with
+	// keys EnvFragment does not define, such as a misspelled priorty or
+	// scripts, instead of silently ignoring them. The error names the file,
+	// the field and, for YAML, its line.
+	StrictSchema bool
+
+	// StrictDuplicates makes feeding a fragment whose name and source match
+	// a loaded one fail. By default the duplicate is skipped, so feeding the
+	// same file twice, e.g. with FeedFile and then a FeedDir covering it,
+	// loads its fragments, and runs their scripts, only once. Fragments
+	// without a source are never duplicates.
+	StrictDuplicates bool
+
+	// StrictRequired makes the merge fail with the error of CheckRequired
+	// when required keys are missing, see SortAndMergeStrict.
+	StrictRequired bool
+
+	// StrictMerge makes the merge fail when a key is defined by more than
+	// one fragment, unless the overriding fragment lists it in AllowOverride,
+	// see SortAndMergeStrict.
+	StrictMerge bool
+
+	// DotenvSections makes BuildDotenv group variables under a
+	// "# --- Fragment: name ---" comment for the fragment that set them.
+	// Leave it off for consumers that do not tolerate comments.
+	DotenvSections bool
+	// DotenvScripts makes BuildDotenv keep the fragment scripts as comments
+	// for reference. Dotenv has no notion of scripts, so they are dropped by
+	// default.
+	DotenvScripts bool
+
+	// Annotate makes the shell and dotenv builders comment every variable
+	// with the fragment it comes from, e.g. # from user_service, and for a
+	// value a higher priority fragment replaces, which one. The comment
+	// follows the assignment, or precedes it for cmd and dotenv.
+	Annotate bool
+
+	// TOMLFiles makes FeedDir, FeedDirCollect and FeedDirRecursive load
+	// .toml fragment files with FeedTOML besides the YAML ones.
+	TOMLFiles bool
+	// FragmentExtensions replaces the extensions of the YAML fragment files
+	// loaded by the directory feeders, .yaml and .yml by default, e.g. with
+	// []string{".yaml", ".fragment"} for files generated by another tool.
+	// Listing .toml loads .toml files as TOML, even without TOMLFiles; files
+	// of the other extensions are parsed as YAML.
+	FragmentExtensions []string
+
+	// HashScripts makes Hash cover the fragment scripts besides the merged
+	// variables.
+	HashScripts bool
+
+	// FlattenKeys turns fragment keys into valid environment variable names
+	// by replacing dots and any other character outside [A-Za-z0-9_] with
+	// '_', so DB.HOST is merged and written as DB_HOST. The merge fails if
+	// two different keys flatten to the same name.
+	FlattenKeys bool
+
+	// TargetOS and TargetArch select the platform fragments are merged for,
+	// see EnvFragment.OS. They default to runtime.GOOS and runtime.GOARCH;
+	// set them to generate the environment of another platform, e.g. a
+	// Windows environment on a Linux CI machine.
+	TargetOS   string
+	TargetArch string
+
+	// ListSeparator joins the elements of list variables, see
+	// EnvFragment.Append. It defaults to the OS path list separator, ':' on
+	// Unix and ';' on Windows.
+	ListSeparator string
+
+	// SecretKeys marks keys as secret for all fragments, like
+	// EnvFragment.Secrets, e.g. by naming convention with patterns such as
+	// "*_PASSWORD" or "*_TOKEN".
+	SecretKeys []string
+
+	// Header and Footer are written at the top and the bottom of the files
+	// generated by the shell and dotenv builders, e.g. for a license banner
+	// or an end marker. Lines already starting with the comment marker of
+	// the output, such as "#" for bash or "rem" for cmd, are written as
+	// they are; other lines are turned into comments.
+	Header string
+	Footer string
+
+	// AppendOutput makes the shell and dotenv builders add their output to
+	// the end of an existing file instead of replacing it, e.g. to compose
+	// the output of several managers into one shared profile script. Since
+	// the file already has a top, Header and the ctime banner and variable
+	// are left out, also from the output of the *To variants; Footer is
+	// still written. FileMode only applies when the file is created.
+	AppendOutput bool
+
+	// CtimeKey names the variable holding the ctime in the shell, dotenv and
+	// Node JSON outputs. The default is ENV_CTIME_KEY. NoCtime leaves the
+	// variable and the "generated at" comment out, which also makes the
+	// output independent of the time it was generated at. WriteMeta still
+	// records the ctime.
+	CtimeKey string
+	NoCtime  bool
+
+	// FileMode sets the permissions of the files written by the Build*
+	// functions, WriteMeta, WriteLock and SaveAllYaml. It defaults to 0644;
+	// use 0600 for files holding secrets.
+	FileMode os.FileMode
+
+	// QuoteMode selects how BuildBash, BuildZsh, BuildPsh and BuildNu quote
+	// values. Either way values are set literally, without expansion.
+	// Values with line breaks are always written on one line with escape
+	// sequences: $'...' in bash and zsh, `n and `r in PowerShell and \n in
+	// Nushell double quotes.
+	QuoteMode QuoteMode
 }
 
+// QuoteMode selects the quoting style of the shell builders.
+type QuoteMode int
+
+const (
+	// QuoteDouble writes values in double quotes, escaping the characters
+	// that would otherwise be expanded. This is the default.
+	QuoteDouble QuoteMode = iota
+	// QuoteSingle writes values in single quotes, inside which the shell
+	// expands nothing.
+	QuoteSingle
+)
+
 // validateFragment checks fragment priority according to its type.
 func validateFragment(frag *EnvFragment) error {
 	if frag.Name == "" {
 		return fmt.Errorf("fragment must have a name")
 	}
+	return validatePriority(frag)
+}
+
+// validatePriority checks that the fragment priority lies in the band of its tier.
+func validatePriority(frag *EnvFragment) error {
+	tierMu.RLock()
+	defer tierMu.RUnlock()
 	switch {
 	case SystemEnv[frag.Name] > 0: // builtin system fragment
 		if frag.Priority > 19 {
@@ -87,249 +472,2074 @@ func validateFragment(frag *EnvFragment) error {
 	return nil
 }
 
+// checkFragment validates frag before it is added. With LenientPriorities a
+// priority outside the band of the fragment's tier is recorded as a warning,
+// reported by Validate, instead of failing, and likewise malformed values
+// with LenientValues. With AutoPriorities a missing priority is assigned
+// first; a rejected fragment does not use up a priority.
+func (e *EnvManager) checkFragment(frag *EnvFragment) error {
+	if !e.AutoPriorities || frag.Priority != 0 || frag.Name == "" || registeredTier(frag.Name) != TierCustom {
+		return e.checkContent(frag)
+	}
+	frag.Priority = e.autoPriorityBase() + e.autoAssigned
+	if err := e.checkContent(frag); err != nil {
+		frag.Priority = 0
+		return err
+	}
+	e.autoAssigned++
+	frag.autoPriority = true
+	return nil
+}
+
+// autoPriorityBase returns the first priority assigned by AutoPriorities.
+func (e *EnvManager) autoPriorityBase() int {
+	if e.AutoPriorityBase == 0 {
+		return 100
+	}
+	return e.AutoPriorityBase
+}
+
+// adopt takes over frag from a scratch manager, assigning its priority again
+// if the scratch manager did, so the sequence continues that of e.
+func (e *EnvManager) adopt(frag *EnvFragment) {
+	if frag.autoPriority {
+		frag.Priority = e.autoPriorityBase() + e.autoAssigned
+		e.autoAssigned++
+	}
+	e.fragments = append(e.fragments, frag)
+}
+
+// scratch returns an empty manager with the settings of e that affect
+// feeding, to load fragments without touching e.
+func (e *EnvManager) scratch() *EnvManager {
+	return &EnvManager{
+		StrictSchema:       e.StrictSchema,
+		StrictDuplicates:   e.StrictDuplicates,
+		LenientPriorities:  e.LenientPriorities,
+		LenientValues:      e.LenientValues,
+		AutoPriorities:     e.AutoPriorities,
+		AutoPriorityBase:   e.AutoPriorityBase,
+		TOMLFiles:          e.TOMLFiles,
+		FragmentExtensions: e.FragmentExtensions,
+	}
+}
+
+// checkContent runs the checks of checkFragment. The warnings are recorded
+// only once every check has passed, so a rejected fragment leaves none.
+func (e *EnvManager) checkContent(frag *EnvFragment) error {
+	var warnings []Warning
+	if frag.Name == "" || !e.LenientPriorities {
+		if err := validateFragment(frag); err != nil {
+			return err
+		}
+	} else if err := validatePriority(frag); err != nil {
+		warnings = append(warnings, Warning{Fragment: frag.Name, Message: err.Error()})
+	}
+	if err := validateScripts(frag); err != nil {
+		return err
+	}
+	if err := validateShellEnv(frag); err != nil {
+		return err
+	}
+	if err := validateKeyLists(frag); err != nil {
+		return err
+	}
+	problems := malformedValues(frag)
+	if len(problems) > 0 && !e.LenientValues {
+		return fmt.Errorf("key %s: %s", problems[0].Key, problems[0].Message)
+	}
+	e.warnings = append(e.warnings, warnings...)
+	e.warnings = append(e.warnings, problems...)
+	return nil
+}
+
+// validateShellEnv rejects shell overrides for unknown shells, for keys the
+// fragment does not set and for list variables.
+func validateShellEnv(frag *EnvFragment) error {
+	for _, sh := range sortedKeys(frag.ShellEnv) {
+		if _, ok := shellDialects[sh]; !ok {
+			return fmt.Errorf("shell_env has unknown shell %q", sh)
+		}
+		for _, k := range sortedKeys(frag.ShellEnv[sh]) {
+			if _, ok := frag.Env[k]; !ok {
+				return fmt.Errorf("key %s has a %s override but is not set", k, sh)
+			}
+			if matchAnyKey(frag.Append, k) || matchAnyKey(frag.Prepend, k) {
+				return fmt.Errorf("key %s is a list variable and cannot have a %s override", k, sh)
+			}
+		}
+	}
+	return nil
+}
+
+// validateKeyLists rejects contradicting key lists: keys a fragment both
+// sets and unsets, and keys it both appends and prepends.
+func validateKeyLists(frag *EnvFragment) error {
+	for _, k := range frag.Unset {
+		if _, ok := frag.Env[k]; ok {
+			return fmt.Errorf("key %s is both set and unset", k)
+		}
+		if _, ok := frag.Defaults[k]; ok {
+			return fmt.Errorf("key %s is both defaulted and unset", k)
+		}
+	}
+	for k := range frag.Defaults {
+		if _, ok := frag.Env[k]; ok {
+			return fmt.Errorf("key %s is both set and defaulted", k)
+		}
+	}
+	for _, k := range frag.Append {
+		if matchAnyKey(frag.Prepend, k) {
+			return fmt.Errorf("key %s is both appended and prepended", k)
+		}
+	}
+	return nil
+}
+
+// Feed adds an in-memory fragment to the manager. It is equivalent to AddFragment.
 func (e *EnvManager) Feed(frag *EnvFragment) error {
-	if err := validateFragment(frag); err != nil {
+	return e.AddFragment(frag)
+}
+
+// AddFragment validates frag the same way FeedFile does and appends it to the
+// manager. Adding a fragment invalidates a previous SortAndMerge, which must
+// be run again before building.
+func (e *EnvManager) AddFragment(frag *EnvFragment) error {
+	frag.LoadedAt = time.Now()
+	if err := e.addFragment(frag); err != nil {
 		return fmt.Errorf("validation failed for fragment %s: %w", frag.Name, err)
 	}
-	e.Fragments = append(e.Fragments, frag)
-	return nil
+	return nil
+}
+
+// addFragment checks frag and appends it under the write lock.
+func (e *EnvManager) addFragment(frag *EnvFragment) error {
+	frag = applyPrefix(frag)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if skip, err := e.checkDuplicate(frag); skip || err != nil {
+		return err
+	}
+	if err := e.checkFragment(frag); err != nil {
+		e.log().Warn("fragment rejected", "fragment", frag.Name, "source", frag.Source, "error", err)
+		return err
+	}
+	e.fragments = append(e.fragments, frag)
+	e.sorted = false
+	e.log().Info("fragment loaded", "fragment", frag.Name, "priority", frag.Priority, "source", frag.Source)
+	return nil
+}
+
+// checkDuplicate reports whether frag has the name and source of a loaded
+// fragment and is to be skipped, or fails with StrictDuplicates.
+func (e *EnvManager) checkDuplicate(frag *EnvFragment) (bool, error) {
+	if frag.Source == "" {
+		return false, nil
+	}
+	source := filepath.Clean(frag.Source)
+	for _, loaded := range e.fragments {
+		if loaded.Name != frag.Name || loaded.Source == "" || filepath.Clean(loaded.Source) != source {
+			continue
+		}
+		if e.StrictDuplicates {
+			e.log().Warn("fragment rejected", "fragment", frag.Name, "source", frag.Source, "error", "duplicate")
+			return false, fmt.Errorf("fragment %s from %s is already loaded", frag.Name, frag.Source)
+		}
+		e.log().Info("fragment skipped", "fragment", frag.Name, "source", frag.Source, "duplicate", true)
+		return true, nil
+	}
+	return false, nil
+}
+
+// applyPrefix returns frag with its keys namespaced by its Prefix, see
+// EnvFragment.Prefix. The keys of a copy are changed, so frag itself keeps
+// its own keys, whether or not the copy is accepted.
+func applyPrefix(frag *EnvFragment) *EnvFragment {
+	if frag.Prefix == "" {
+		return frag
+	}
+	frag = frag.clone()
+	for _, m := range []*map[string]string{&frag.Env, &frag.Defaults} {
+		if *m == nil {
+			continue
+		}
+		prefixed := make(map[string]string, len(*m))
+		for k, v := range *m {
+			prefixed[frag.Prefix+k] = v
+		}
+		*m = prefixed
+	}
+	lists := []*[]string{
+		&frag.Unset, &frag.Append, &frag.Prepend, &frag.Overridable,
+		&frag.AllowOverride, &frag.Secrets, &frag.Local,
+	}
+	for _, keys := range lists {
+		if *keys == nil {
+			continue // keep a nil Overridable apart from an empty one
+		}
+		prefixed := make([]string, len(*keys))
+		for i, k := range *keys {
+			prefixed[i] = frag.Prefix + k
+		}
+		*keys = prefixed
+	}
+	for sh, overrides := range frag.ShellEnv {
+		prefixed := make(map[string]string, len(overrides))
+		for k, v := range overrides {
+			prefixed[frag.Prefix+k] = v
+		}
+		frag.ShellEnv[sh] = prefixed
+	}
+	return frag
+}
+
+// envKey returns the environment variable name for a fragment key, which is
+// the key itself unless FlattenKeys is set.
+func (e *EnvManager) envKey(key string) string {
+	if !e.FlattenKeys {
+		return key
+	}
+	return flattenKey(key)
+}
+
+// flattenKey replaces every character not allowed in an environment variable
+// name with '_', turning a dotted key such as DB.HOST into DB_HOST.
+func flattenKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r < utf8.RuneSelf && isVarByte(byte(r), false) {
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+// flattenCollisions reports keys that different original keys flatten to.
+// flattened maps a flattened key to the original keys and the fragments that
+// set them.
+func flattenCollisions(flattened map[string]map[string][]string) error {
+	var collisions []string
+	for k, origins := range flattened {
+		if len(origins) < 2 {
+			continue
+		}
+		var parts []string
+		for _, orig := range sortedKeys(origins) {
+			parts = append(parts, fmt.Sprintf("%s (%s)", orig, strings.Join(origins[orig], ", ")))
+		}
+		collisions = append(collisions, fmt.Sprintf("%s <- %s", k, strings.Join(parts, ", ")))
+	}
+	if len(collisions) == 0 {
+		return nil
+	}
+	sort.Strings(collisions)
+	return fmt.Errorf("flattened keys collide: %s", strings.Join(collisions, "; "))
+}
+
+// Absorb appends copies of the fragments loaded into other, e.g. to combine
+// a manager for base config with one for an overlay without reading the
+// files again. The fragments were validated by other and are not checked
+// again, except that duplicates of fragments loaded into e, see
+// StrictDuplicates, are left out. The previous merge is invalidated; run
+// SortAndMerge to merge the fragments of both by priority. Absorbing e into
+// itself does nothing.
+func (e *EnvManager) Absorb(other *EnvManager) {
+	if other == nil || other == e {
+		return
+	}
+	frags := other.Fragments()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, frag := range frags {
+		if skip, err := e.checkDuplicate(frag); skip || err != nil {
+			continue
+		}
+		e.fragments = append(e.fragments, frag)
+		e.sorted = false
+		e.log().Info("fragment loaded", "fragment", frag.Name, "priority", frag.Priority, "source", frag.Source)
+	}
+}
+
+// Fragments returns copies of the loaded fragments, with their name,
+// priority and Source, e.g. to list them. Before SortAndMerge they are in
+// load order, afterwards in priority order. Changing the copies does not
+// affect the manager.
+func (e *EnvManager) Fragments() []*EnvFragment {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	frags := make([]*EnvFragment, len(e.fragments))
+	for i, frag := range e.fragments {
+		frags[i] = frag.clone()
+	}
+	return frags
+}
+
+// SortedFragments returns copies of the loaded fragments in the order
+// SortAndMerge merges them, see there, whether or not it ran yet. Fragments
+// left out of the merge, e.g. by profile or tags, are included.
+func (e *EnvManager) SortedFragments() []*EnvFragment {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	frags := e.fragmentsByPriority()
+	for i, frag := range frags {
+		frags[i] = frag.clone()
+	}
+	return frags
+}
+
+// fragmentLess orders fragments by priority, then name, then source.
+func fragmentLess(a, b *EnvFragment) bool {
+	if a.Priority != b.Priority {
+		return a.Priority < b.Priority
+	}
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	return a.Source < b.Source
+}
+
+// clone returns a copy of frag that shares no maps or slices with it.
+func (frag *EnvFragment) clone() *EnvFragment {
+	c := *frag
+	c.Env = maps.Clone(frag.Env)
+	c.Defaults = maps.Clone(frag.Defaults)
+	c.Script = slices.Clone(frag.Script)
+	for i := range c.Script {
+		c.Script[i].Shells = slices.Clone(c.Script[i].Shells)
+	}
+	c.AllowOverride = slices.Clone(frag.AllowOverride)
+	c.Overridable = slices.Clone(frag.Overridable)
+	c.Unset = slices.Clone(frag.Unset)
+	c.OS = slices.Clone(frag.OS)
+	c.Arch = slices.Clone(frag.Arch)
+	c.Tags = slices.Clone(frag.Tags)
+	c.Append = slices.Clone(frag.Append)
+	c.Prepend = slices.Clone(frag.Prepend)
+	c.Include = slices.Clone(frag.Include)
+	c.Secrets = slices.Clone(frag.Secrets)
+	c.Local = slices.Clone(frag.Local)
+	c.Required = slices.Clone(frag.Required)
+	if frag.Enabled != nil {
+		enabled := *frag.Enabled
+		c.Enabled = &enabled
+	}
+	if frag.ShellEnv != nil {
+		c.ShellEnv = make(map[string]map[string]string, len(frag.ShellEnv))
+		for sh, overrides := range frag.ShellEnv {
+			c.ShellEnv[sh] = maps.Clone(overrides)
+		}
+	}
+	return &c
+}
+
+// RemoveFragment removes all fragments named name and reports whether any
+// was removed. Removing a fragment invalidates a previous SortAndMerge.
+func (e *EnvManager) RemoveFragment(name string) bool {
+	return e.removeFragments(func(frag *EnvFragment) bool { return frag.Name == name })
+}
+
+// RemoveFragmentBySource removes all fragments loaded from source, the file
+// path or source name they were fed with, and reports whether any was removed.
+func (e *EnvManager) RemoveFragmentBySource(source string) bool {
+	return e.removeFragments(func(frag *EnvFragment) bool { return frag.Source == source })
+}
+
+func (e *EnvManager) removeFragments(match func(*EnvFragment) bool) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	kept := e.fragments[:0]
+	for _, frag := range e.fragments {
+		if !match(frag) {
+			kept = append(kept, frag)
+		}
+	}
+	removed := len(kept) < len(e.fragments)
+	clear(e.fragments[len(kept):])
+	e.fragments = kept
+	if removed {
+		e.sorted = false
+	}
+	return removed
+}
+
+// FeedProcessEnv adds a fragment holding a snapshot of the process
+// environment, with the given name and priority, so generated files inherit
+// it as a base layer that other fragments override. With prefixes, only the
+// variables starting with one of them are taken. The fragment's Source is
+// "process" and the priority is validated like any other fragment's.
+func (e *EnvManager) FeedProcessEnv(name string, priority int, prefixes ...string) error {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			continue // e.g. the per-drive entries on Windows
+		}
+		if len(prefixes) > 0 && !slices.ContainsFunc(prefixes, func(p string) bool { return strings.HasPrefix(k, p) }) {
+			continue
+		}
+		env[k] = v
+	}
+	return e.AddFragment(&EnvFragment{Name: name, Priority: priority, Env: env, Source: "process"})
+}
+
+// FeedFile reads a YAML file containing one or more EnvFragments
+// and adds them to the manager, validating priorities.
+func (e *EnvManager) FeedFile(fpath string) error {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return fmt.Errorf("failed to read file %s: %w", fpath, err)
+	}
+	defer f.Close()
+
+	return e.FeedReader(f, fpath)
+}
+
+// FeedReader decodes one or more YAML EnvFragment documents from r and adds
+// them to the manager, validating priorities. sourceName is recorded as the
+// fragments' Source and used in error messages, which makes it possible to
+// feed fragments from embedded files, network streams or test buffers.
+// Empty documents, such as those around a leading or trailing ---
+// separator, are skipped; a document that is not a mapping is an error.
+// A key repeated within a mapping, such as an env key pasted twice, fails
+// the feed with an error naming the key and the lines defining it, rather
+// than silently keeping the last value.
+func (e *EnvManager) FeedReader(r io.Reader, sourceName string) error {
+	return e.feedReader(r, sourceName, nil, nil)
+}
+
+// feedReader implements FeedReader. Included files are read from fsys, or
+// from the OS file system if fsys is nil. With report set, invalid fragments
+// are passed to it and skipped instead of ending the feed; parse errors still
+// end it since the decoder cannot resume after them.
+func (e *EnvManager) feedReader(r io.Reader, sourceName string, fsys fs.FS, report func(error)) error {
+	// support multiple documents in one YAML file
+	dec := yaml.NewDecoder(r)
+	for {
+		var doc yaml.Node
+		if err := dec.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return fmt.Errorf("failed to parse YAML in %s: %w", sourceName, err)
+		}
+		if isEmptyDocument(&doc) {
+			continue // e.g. a leading or trailing ---
+		}
+		if e.StrictSchema {
+			if err := checkKnownFields(&doc); err != nil {
+				return fmt.Errorf("failed to parse YAML in %s: %w", sourceName, err)
+			}
+		}
+		var frag EnvFragment
+		if err := doc.Decode(&frag); err != nil {
+			return fmt.Errorf("failed to parse YAML in %s: %w", sourceName, err)
+		}
+
+		frag.Source = sourceName // track where this fragment came from
+		frag.LoadedAt = time.Now()
+		frag.node = &doc
+
+		if err := readScriptFiles(&frag, sourceName, fsys); err != nil {
+			err = fmt.Errorf("failed to read script files for fragment %s in %s: %w", frag.Name, sourceName, err)
+			if report == nil {
+				return err
+			}
+			report(err)
+			continue
+		}
+
+		if err := resolveIncludes(&frag, sourceName, fsys); err != nil {
+			err = fmt.Errorf("failed to include files for fragment %s in %s: %w", frag.Name, sourceName, err)
+			if report == nil {
+				return err
+			}
+			report(err)
+			continue
+		}
+
+		if err := e.addFragment(&frag); err != nil {
+			err = fmt.Errorf("validation failed for fragment %s in %s: %w", frag.Name, sourceName, err)
+			if report == nil {
+				return err
+			}
+			report(err)
+		}
+	}
+
+	return nil
+}
+
+// isEmptyDocument reports whether doc holds no content, as a document made
+// of nothing but comments or a null value does.
+func isEmptyDocument(doc *yaml.Node) bool {
+	if len(doc.Content) == 0 {
+		return true
+	}
+	n := doc.Content[0]
+	return n.Kind == yaml.ScalarNode && n.Tag == "!!null"
+}
+
+// FeedDir loads all YAML files from a directory, as selected by
+// FragmentExtensions, and TOML files with TOMLFiles set. Other files are
+// skipped.
+func (e *EnvManager) FeedDir(dir string) error {
+	return e.FeedDirCtx(context.Background(), dir)
+}
+
+// FeedDirCtx is like FeedDir but checks ctx before each file and returns
+// ctx.Err() once it is done. Fragments of the files fed before that are kept.
+func (e *EnvManager) FeedDirCtx(ctx context.Context, dir string) error {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		name := file.Name()
+		if !e.isFragmentFile(name) {
+			continue // skip non-fragment files
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		fpath := filepath.Join(dir, name)
+		if err := e.feedPath(fpath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FeedDirCollect loads all YAML files from a directory like FeedDir, but
+// does not stop at the first invalid file or fragment. Valid fragments are
+// added, and the errors of every file that failed to open or parse and of
+// every fragment that failed validation are returned together, each naming
+// the file and fragment. The error result is only set when dir itself cannot
+// be read.
+func (e *EnvManager) FeedDirCollect(dir string) ([]error, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	report := func(err error) { errs = append(errs, err) }
+	for _, file := range files {
+		if file.IsDir() || !e.isFragmentFile(file.Name()) {
+			continue
+		}
+		fpath := filepath.Join(dir, file.Name())
+		if isTOMLFile(fpath) {
+			if err := e.feedTOML(fpath, nil, report); err != nil {
+				report(err)
+			}
+			continue
+		}
+		f, err := os.Open(fpath)
+		if err != nil {
+			report(fmt.Errorf("failed to read file %s: %w", fpath, err))
+			continue
+		}
+		if err := e.feedReader(f, fpath, nil, report); err != nil {
+			report(err)
+		}
+		f.Close()
+	}
+	return errs, nil
+}
+
+// FeedDirRecursive loads all YAML files from dir and its subdirectories.
+// Non-YAML files are skipped. Files are fed in lexical order of their path,
+// so the load order does not depend on the file system.
+func (e *EnvManager) FeedDirRecursive(dir string) error {
+	return e.FeedDirRecursiveCtx(context.Background(), dir)
+}
+
+// FeedDirRecursiveCtx is like FeedDirRecursive but checks ctx while walking
+// dir and before each file, and returns ctx.Err() once it is done. Fragments
+// of the files fed before that are kept.
+func (e *EnvManager) FeedDirRecursiveCtx(ctx context.Context, dir string) error {
+	var paths []string
+	err := filepath.WalkDir(dir, func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.IsDir() && e.isFragmentFile(d.Name()) {
+			paths = append(paths, fpath)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(paths)
+	for _, fpath := range paths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := e.feedPath(fpath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FeedGlob loads the files matching pattern, in the syntax of filepath.Glob,
+// e.g. "env/env.*.yaml" to skip other YAML files in the same directory. Files
+// are fed in lexical order of their path, as TOML if they end in .toml and
+// as YAML otherwise, whatever TOMLFiles says. Directories are skipped, and a
+// pattern matching nothing feeds nothing.
+func (e *EnvManager) FeedGlob(pattern string) error {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	sort.Strings(paths)
+	for _, fpath := range paths {
+		if info, err := os.Stat(fpath); err == nil && info.IsDir() {
+			continue
+		}
+		if err := e.feedPath(fpath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FeedFS loads all YAML files, and TOML files with TOMLFiles set, from dir
+// and its subdirectories in fsys, such as an embed.FS holding default
+// fragments baked into the binary. Use "." for the root of fsys. Files are
+// fed in lexical order of their path, which is recorded as the fragments'
+// Source. Include paths are resolved within fsys.
+func (e *EnvManager) FeedFS(fsys fs.FS, dir string) error {
+	var paths []string
+	err := fs.WalkDir(fsys, dir, func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && e.isFragmentFile(d.Name()) {
+			paths = append(paths, fpath)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(paths)
+	for _, fpath := range paths {
+		if isTOMLFile(fpath) {
+			if err := e.feedTOML(fpath, fsys, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		f, err := fsys.Open(fpath)
+		if err != nil {
+			return fmt.Errorf("failed to read file %s: %w", fpath, err)
+		}
+		err = e.feedReader(f, fpath, fsys, nil)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isYAMLFile(name string) bool {
+	return strings.HasSuffix(name, ".yaml") || strings.HasSuffix(name, ".yml")
+}
+
+// isFragmentFile reports whether the directory feeders load the file name.
+func (e *EnvManager) isFragmentFile(name string) bool {
+	if e.TOMLFiles && isTOMLFile(name) {
+		return true
+	}
+	if len(e.FragmentExtensions) == 0 {
+		return isYAMLFile(name)
+	}
+	for _, ext := range e.FragmentExtensions {
+		if strings.HasSuffix(name, "."+strings.TrimPrefix(ext, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// feedPath feeds the YAML or TOML fragment file at fpath.
+func (e *EnvManager) feedPath(fpath string) error {
+	if isTOMLFile(fpath) {
+		return e.FeedTOML(fpath)
+	}
+	return e.FeedFile(fpath)
+}
+
+// SortAndMerge sorts the fragments by priority and merges their variables,
+// higher priority fragments overriding lower ones. Fragments of the same
+// priority are ordered by name and then by Source, so the result does not
+// depend on the order they were fed in; only fragments sharing all three
+// keep their load order. A merge that fails, e.g. with StrictMerge set,
+// leaves the manager unsorted, so the Build* functions fail until a merge
+// succeeds; use SortAndMergeStrict to get the error.
+func (e *EnvManager) SortAndMerge() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.sortAndMerge(); err != nil {
+		e.log().Warn("merge failed", "error", err)
+	}
+}
+
+// SortAndMergeStrict is like SortAndMerge but returns the error of a failed
+// merge: with StrictMerge set, one listing every key overridden without an
+// AllowOverride opt-in, with StrictRequired the missing required keys, and
+// with FlattenKeys colliding keys. The manager is left unsorted then.
+func (e *EnvManager) SortAndMergeStrict() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.sortAndMerge()
+}
+
+func (e *EnvManager) sortAndMerge() error {
+	e.merged = make(map[string]string)
+	// key -> slice of source fragment names
+	e.keySources = make(map[string][]string)
+
+	// Sort fragments by Priority ascending, ties broken by name and source
+	sort.SliceStable(e.fragments, func(i, j int) bool {
+		return fragmentLess(e.fragments[i], e.fragments[j])
+	})
+
+	// Select the enabled fragments for the target platform and active tags
+	e.active = nil
+	for _, frag := range e.fragments {
+		switch {
+		case !frag.IsEnabled():
+			e.log().Info("fragment skipped", "fragment", frag.Name, "enabled", false)
+		case !e.matchesPlatform(frag):
+			e.log().Info("fragment skipped", "fragment", frag.Name, "os", frag.OS, "arch", frag.Arch)
+		case !e.matchesTags(frag):
+			e.log().Info("fragment skipped", "fragment", frag.Name, "tags", frag.Tags)
+		case frag.Profile != "" && frag.Profile != e.profile:
+			e.log().Info("fragment skipped", "fragment", frag.Name, "profile", frag.Profile)
+		default:
+			e.active = append(e.active, frag)
+		}
+	}
+
+	// Merge
+	e.owners = make(map[string]*EnvFragment)
+	e.unset = make(map[string]*EnvFragment)
+	e.listValues = make(map[*EnvFragment]map[string]string)
+	e.interpolated = nil
+	settings := make(map[string][]FragmentValue)
+	assignments := 0
+	var collisions []string
+	e.blocked = nil
+	assigned := make(map[*EnvFragment][]string)
+	flattened := make(map[string]map[string][]string) // key -> original key -> fragments
+	for _, frag := range e.active {
+		for orig, v := range frag.Env {
+			k := e.envKey(orig)
+			if e.FlattenKeys {
+				if flattened[k] == nil {
+					flattened[k] = make(map[string][]string)
+				}
+				flattened[k][orig] = append(flattened[k][orig], frag.Name)
+			}
+			prev, exists := e.owners[k]
+			if exists && prev.locks(k) {
+				e.blocked = append(e.blocked, BlockedOverride{Key: k, LockedBy: prev.Name, Fragment: frag.Name, Value: v})
+				continue
+			}
+			if prepend, ok := frag.listMode(orig); ok {
+				if joined := joinList(e.merged[k], v, e.listSeparator(), prepend); joined != v {
+					v = joined
+					if e.listValues[frag] == nil {
+						e.listValues[frag] = make(map[string]string)
+					}
+					e.listValues[frag][k] = v
+				}
+			} else if exists && e.StrictMerge && !matchAnyKey(frag.AllowOverride, k) {
+				collisions = append(collisions, fmt.Sprintf("%s (%s, %s)", k, prev.Name, frag.Name))
+			}
+			assignments++
+			e.merged[k] = v
+			e.owners[k] = frag
+			e.keySources[k] = append(e.keySources[k], frag.Name)
+			settings[k] = append(settings[k], FragmentValue{Fragment: frag.Name, Value: v})
+			assigned[frag] = append(assigned[frag], k)
+			delete(e.unset, k)
+		}
+		for _, orig := range frag.Unset {
+			k := e.envKey(orig)
+			if prev, exists := e.owners[k]; exists && prev.locks(k) {
+				e.blocked = append(e.blocked, BlockedOverride{Key: k, LockedBy: prev.Name, Fragment: frag.Name})
+				continue
+			}
+			delete(e.merged, k)
+			delete(e.owners, k)
+			delete(e.keySources, k)
+			delete(settings, k)
+			e.unset[k] = frag
+		}
+	}
+	// Fill in defaults for the keys still absent, the highest priority
+	// default winning
+	e.defaulted = make(map[string]*EnvFragment)
+	for i := len(e.active) - 1; i >= 0; i-- {
+		frag := e.active[i]
+		for orig, v := range frag.Defaults {
+			k := e.envKey(orig)
+			if _, set := e.owners[k]; set || e.unset[k] != nil {
+				continue
+			}
+			e.merged[k] = v
+			e.owners[k] = frag
+			e.keySources[k] = []string{frag.Name}
+			e.defaulted[k] = frag
+			assigned[frag] = append(assigned[frag], k)
+		}
+	}
+
+	// Split the keys each fragment assigned by whether its value won
+	e.effects = make(map[string]*fragmentEffect)
+	for _, frag := range e.active {
+		eff := e.effects[frag.Name]
+		if eff == nil {
+			eff = &fragmentEffect{}
+			e.effects[frag.Name] = eff
+		}
+		for _, k := range assigned[frag] {
+			if e.owners[k] == frag {
+				eff.won = append(eff.won, k)
+			} else {
+				eff.shadowed = append(eff.shadowed, k)
+			}
+		}
+	}
+	for _, eff := range e.effects {
+		sort.Strings(eff.won)
+		sort.Strings(eff.shadowed)
+		eff.won, eff.shadowed = slices.Compact(eff.won), slices.Compact(eff.shadowed)
+	}
+
+	// Record keys set by more than one fragment, the last setting wins
+	e.conflicts = nil
+	for k, sources := range e.keySources {
+		if len(sources) < 2 {
+			continue
+		}
+		last := len(settings[k]) - 1
+		e.conflicts = append(e.conflicts, Conflict{
+			Key:      k,
+			Winner:   settings[k][last],
+			Shadowed: settings[k][:last],
+		})
+	}
+	sort.Slice(e.conflicts, func(i, j int) bool {
+		return e.conflicts[i].Key < e.conflicts[j].Key
+	})
+	sort.SliceStable(e.blocked, func(i, j int) bool {
+		return e.blocked[i].Key < e.blocked[j].Key
+	})
+	if err := flattenCollisions(flattened); err != nil {
+		e.sorted = false
+		return err
+	}
+	if len(collisions) > 0 {
+		e.sorted = false
+		sort.Strings(collisions)
+		return fmt.Errorf("strict merge: keys defined by more than one fragment: %s", strings.Join(collisions, ", "))
+	}
+	if e.StrictRequired {
+		if err := e.checkRequired(); err != nil {
+			e.sorted = false
+			return err
+		}
+	}
+	e.sorted = true
+	e.Ctime = time.Now()
+	if !e.fixedCtime.IsZero() {
+		e.Ctime = e.fixedCtime
+	}
+	e.stats = MergeStats{
+		Fragments:   len(e.active),
+		Skipped:     len(e.fragments) - len(e.active),
+		Keys:        len(e.merged),
+		Assignments: assignments,
+		Overridden:  len(e.conflicts),
+		Blocked:     len(e.blocked),
+	}
+	e.logMerge()
+	return nil
+}
+
+// FragmentValue is the value a fragment assigned to a key.
+type FragmentValue struct {
+	Fragment string
+	Value    string
+}
+
+// Conflict describes a key that was set by more than one fragment.
+type Conflict struct {
+	Key string
+	// Winner is the setting that ended up in the merged environment.
+	Winner FragmentValue
+	// Shadowed lists the overridden settings from lowest to highest priority.
+	Shadowed []FragmentValue
+}
+
+// Conflicts returns the keys overridden during the last SortAndMerge, sorted
+// by key. It is useful to catch accidental clobbers, such as a custom fragment
+// replacing PATH.
+func (e *EnvManager) Conflicts() []Conflict {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if !e.sorted {
+		return nil
+	}
+	return append([]Conflict(nil), e.conflicts...)
+}
+
+// isLocal reports whether key is set without being exported, see Local.
+func (frag *EnvFragment) isLocal(key string) bool {
+	return matchAnyKey(frag.Local, key)
+}
+
+// locks reports whether the fragment prevents higher priority fragments from
+// overriding key.
+func (frag *EnvFragment) locks(key string) bool {
+	return frag.Overridable != nil && !matchAnyKey(frag.Overridable, key)
+}
+
+// matchesPlatform reports whether frag applies to TargetOS and TargetArch.
+func (e *EnvManager) matchesPlatform(frag *EnvFragment) bool {
+	goos, goarch := e.TargetOS, e.TargetArch
+	if goos == "" {
+		goos = runtime.GOOS
+	}
+	if goarch == "" {
+		goarch = runtime.GOARCH
+	}
+	return (len(frag.OS) == 0 || slices.Contains(frag.OS, goos)) &&
+		(len(frag.Arch) == 0 || slices.Contains(frag.Arch, goarch))
+}
+
+// SetActiveTags restricts the merge to fragments carrying at least one of
+// tags and fragments without tags, so one set of fragments can serve several
+// profiles. Calling it without tags includes every fragment again. The
+// previous merge is invalidated; run SortAndMerge before building.
+func (e *EnvManager) SetActiveTags(tags ...string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.activeTags = append([]string(nil), tags...)
+	e.sorted = false
+}
+
+// SetProfile selects the profile whose fragments take part in the merge,
+// next to the fragments without a profile. An empty name selects only the
+// latter. The previous merge is invalidated; run SortAndMerge before
+// building.
+func (e *EnvManager) SetProfile(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.profile = name
+	e.sorted = false
+}
+
+// matchesTags reports whether frag is selected by the active tags.
+func (e *EnvManager) matchesTags(frag *EnvFragment) bool {
+	return matchTags(frag, e.activeTags)
+}
+
+// matchTags reports whether frag carries one of tags, or no tags at all.
+// Empty tags select every fragment.
+func matchTags(frag *EnvFragment, tags []string) bool {
+	if len(tags) == 0 || len(frag.Tags) == 0 {
+		return true
+	}
+	for _, tag := range frag.Tags {
+		if slices.Contains(tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// BlockedOverride is an assignment dropped during SortAndMerge because a
+// lower priority fragment did not list the key as overridable.
+type BlockedOverride struct {
+	Key      string
+	LockedBy string // fragment that owns the locked key
+	Fragment string // fragment whose assignment was dropped
+	Value    string // dropped value, empty for a dropped unset
+}
+
+// MergeStats counts what the last successful SortAndMerge processed.
+type MergeStats struct {
+	Fragments   int // fragments merged
+	Skipped     int // fragments left out by platform, tags or profile
+	Keys        int // unique keys in the merged environment
+	Assignments int // key assignments applied, overrides included
+	Overridden  int // keys set by more than one fragment, see Conflicts
+	Blocked     int // assignments and unsets dropped because the key was locked
+}
+
+// CheckRequired returns an error listing the keys required by the merged
+// fragments, see EnvFragment.Required, that are missing from the merged
+// environment or empty, each with the fragments requiring it.
+func (e *EnvManager) CheckRequired() error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if !e.sorted {
+		return fmt.Errorf("not build complete yet")
+	}
+	return e.checkRequired()
+}
+
+func (e *EnvManager) checkRequired() error {
+	missing := make(map[string][]string) // key -> requiring fragments
+	for _, frag := range e.active {
+		for _, orig := range frag.Required {
+			k := e.envKey(orig)
+			if e.merged[k] == "" && !slices.Contains(missing[k], frag.Name) {
+				missing[k] = append(missing[k], frag.Name)
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	var parts []string
+	for _, k := range sortedKeys(missing) {
+		parts = append(parts, fmt.Sprintf("%s (%s)", k, strings.Join(missing[k], ", ")))
+	}
+	return fmt.Errorf("required keys missing or empty: %s", strings.Join(parts, ", "))
+}
+
+// CTime returns the generation time written to the Build* outputs.
+func (e *EnvManager) CTime() time.Time {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.Ctime
+}
+
+// SetCTime fixes the generation time to t. SortAndMerge sets the ctime to
+// the current time unless a fixed time was set, so pinning it, e.g. to
+// SOURCE_DATE_EPOCH in CI, makes the generated files reproducible. A zero t
+// goes back to the current time on the next merge.
+func (e *EnvManager) SetCTime(t time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.fixedCtime = t
+	if !t.IsZero() {
+		e.Ctime = t
+	}
+}
+
+// LastMergeStats returns the statistics of the last successful SortAndMerge,
+// or zero stats before it.
+func (e *EnvManager) LastMergeStats() MergeStats {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if !e.sorted {
+		return MergeStats{}
+	}
+	return e.stats
+}
+
+// MergeReport summarizes decisions taken by the last SortAndMerge.
+type MergeReport struct {
+	// BlockedOverrides lists the overrides of locked keys, sorted by key.
+	BlockedOverrides []BlockedOverride
+}
+
+// fragmentValue returns the value frag assigns to its key orig, which for a
+// list variable includes the elements accumulated from lower priorities,
+// with its references resolved after InterpolateMerged.
+func (e *EnvManager) fragmentValue(frag *EnvFragment, orig string) string {
+	if v, ok := e.interpolated[frag][e.envKey(orig)]; ok {
+		return v
+	}
+	if v, ok := e.listValues[frag][e.envKey(orig)]; ok {
+		return v
+	}
+	return frag.Env[orig]
+}
+
+// defaultValue returns the default frag provides for its key orig, with its
+// references resolved after InterpolateMerged.
+func (e *EnvManager) defaultValue(frag *EnvFragment, orig string) string {
+	if v, ok := e.interpolated[frag][e.envKey(orig)]; ok {
+		return v
+	}
+	return frag.Defaults[orig]
+}
+
+// shellValue returns the value frag assigns to its key orig in the output of
+// d: the ShellEnv override of one of the shells of d, or fragmentValue.
+func (e *EnvManager) shellValue(frag *EnvFragment, orig string, d shellDialect) string {
+	for _, sh := range d.shells {
+		if v, ok := frag.ShellEnv[sh][orig]; ok {
+			return v
+		}
+	}
+	return e.fragmentValue(frag, orig)
+}
+
+// mergedShellEnv returns the ShellEnv overrides of the fragments owning the
+// merged keys, keyed by shell and merged key, or nil if there are none.
+func (e *EnvManager) mergedShellEnv() map[string]map[string]string {
+	var result map[string]map[string]string
+	for _, frag := range e.active {
+		for sh, overrides := range frag.ShellEnv {
+			for orig, v := range overrides {
+				k := e.envKey(orig)
+				if e.owners[k] != frag {
+					continue
+				}
+				if result == nil {
+					result = make(map[string]map[string]string)
+				}
+				if result[sh] == nil {
+					result[sh] = make(map[string]string)
+				}
+				result[sh][k] = v
+			}
+		}
+	}
+	return result
+}
+
+// appliedDefaults returns the sorted keys of frag.Defaults that the last
+// merge used, as written in the fragment.
+func (e *EnvManager) appliedDefaults(frag *EnvFragment) []string {
+	var keys []string
+	for _, orig := range sortedKeys(frag.Defaults) {
+		if e.defaulted[e.envKey(orig)] == frag {
+			keys = append(keys, orig)
+		}
+	}
+	return keys
+}
+
+// isBlocked reports whether the merge dropped frag's assignment or unset of
+// key because a lower priority fragment locks it.
+func (e *EnvManager) isBlocked(frag *EnvFragment, key string) bool {
+	for _, b := range e.blocked {
+		if b.Key == key && b.Fragment == frag.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeReport returns the report of the last SortAndMerge.
+func (e *EnvManager) MergeReport() MergeReport {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if !e.sorted {
+		return MergeReport{}
+	}
+	return MergeReport{
+		BlockedOverrides: append([]BlockedOverride(nil), e.blocked...),
+	}
+}
+
+// fragmentEffect holds the keys a fragment assigned in a merge, split by
+// whether its value made it into the merged environment.
+type fragmentEffect struct {
+	won      []string
+	shadowed []string
+}
+
+// FragmentEffect reports what the fragment named name contributed to the last
+// SortAndMerge: won lists the keys whose merged value it set, from Env or
+// Defaults, and shadowed the keys it set that a higher priority fragment
+// overrode or unset. Both are sorted. A fragment with neither has no effect
+// on the merged environment. Overrides rejected by a lock are reported by
+// MergeReport instead. It returns nil for fragments that took no part in the
+// merge, and before SortAndMerge.
+func (e *EnvManager) FragmentEffect(name string) (won, shadowed []string) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	eff, ok := e.effects[name]
+	if !e.sorted || !ok {
+		return nil, nil
+	}
+	return append([]string(nil), eff.won...), append([]string(nil), eff.shadowed...)
+}
+
+// KeySources returns the names of the fragments that set key during the last
+// SortAndMerge, from lowest to highest priority. The last one provided the
+// merged value. It returns nil for unknown keys.
+func (e *EnvManager) KeySources(key string) []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	sources, ok := e.keySources[key]
+	if !ok {
+		return nil
+	}
+	return append([]string(nil), sources...)
+}
+
+// AllKeySources returns a copy of the sources of every merged key, as
+// described in KeySources.
+func (e *EnvManager) AllKeySources() map[string][]string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	result := make(map[string][]string, len(e.keySources))
+	for k, sources := range e.keySources {
+		result[k] = append([]string(nil), sources...)
+	}
+	return result
+}
+
+// Merged returns a copy of the merged environment produced by SortAndMerge.
+// The copy can be modified freely. Before SortAndMerge it returns an empty map.
+func (e *EnvManager) Merged() map[string]string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	result := make(map[string]string, len(e.merged))
+	if !e.sorted {
+		return result
+	}
+	for k, v := range e.merged {
+		result[k] = v
+	}
+	return result
+}
+
+// Lookup returns the merged value of key and whether the merge set it, like
+// os.LookupEnv does for the process environment. It reports false before
+// SortAndMerge.
+func (e *EnvManager) Lookup(key string) (string, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if !e.sorted {
+		return "", false
+	}
+	v, ok := e.merged[key]
+	return v, ok
+}
+
+// GetValue returns the merged value of key, or an empty string if it is not
+// set, like os.Getenv. Use Lookup to tell an empty value from a missing key.
+func (e *EnvManager) GetValue(key string) string {
+	v, _ := e.Lookup(key)
+	return v
+}
+
+// ApplyToProcess sets every merged variable in the current process with
+// os.Setenv, overriding values already present in the process environment.
+func (e *EnvManager) ApplyToProcess() error {
+	return e.ApplyToProcessOverride(true)
+}
+
+// ApplyToProcessOverride sets the merged variables in the current process.
+// Since the merged map already holds the value of the highest priority
+// fragment for each key, the final value does not depend on iteration order.
+// Keys removed by a fragment's Unset list are unset. When override is false,
+// keys already present in the process environment are left untouched and
+// nothing is unset.
+func (e *EnvManager) ApplyToProcessOverride(override bool) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if !e.sorted {
+		return fmt.Errorf("not build complete yet")
+	}
+	for _, k := range sortedKeys(e.merged) {
+		if !override {
+			if _, exists := os.LookupEnv(k); exists {
+				continue
+			}
+		}
+		if err := os.Setenv(k, e.merged[k]); err != nil {
+			return fmt.Errorf("failed to set %s: %w", k, err)
+		}
+	}
+	if !override {
+		return nil
+	}
+	for _, k := range sortedKeys(e.unset) {
+		if err := os.Unsetenv(k); err != nil {
+			return fmt.Errorf("failed to unset %s: %w", k, err)
+		}
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of m in ascending order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// shellDialect describes how a Build* function writes one shell's syntax.
+type shellDialect struct {
+	shells  []string                        // Script shells included in the output
+	comment string                          // prefix of a comment line
+	assign  func(key, quoted string) string // statement that sets key to a quoted value
+	// local sets key as a shell variable that is not exported. It is nil
+	// when the shell has no such variables, and assign is used instead.
+	local  func(key, quoted string) string
+	unset  func(key string) string // statement that removes key
+	single func(string) string     // quotes a value so nothing is expanded
+	double func(string) string     // quotes a value in double quotes, escaped
+	// multiline quotes a value containing line breaks on a single line. It
+	// is nil when the shell cannot represent such a value.
+	multiline func(string) string
+	// trailing is set when a comment may follow a statement on its line.
+	trailing bool
+}
+
+var (
+	bashDialect = shellDialect{
+		shells:    []string{"bash"},
+		comment:   "#",
+		assign:    shExport,
+		local:     shLocal,
+		unset:     func(key string) string { return "unset " + key },
+		single:    shSingleQuote,
+		double:    shDoubleQuote,
+		multiline: shANSIQuote,
+		trailing:  true,
+	}
+	zshDialect = shellDialect{
+		shells:    []string{"zsh"},
+		comment:   "#",
+		assign:    shExport,
+		local:     shLocal,
+		unset:     func(key string) string { return "unset " + key },
+		single:    shSingleQuote,
+		double:    shDoubleQuote,
+		multiline: shANSIQuote,
+		trailing:  true,
+	}
+	pwshDialect = shellDialect{
+		shells:    []string{"pw", "pwsh", "powershell"},
+		comment:   "#",
+		assign:    func(key, quoted string) string { return "$Env:" + key + " = " + quoted },
+		local:     func(key, quoted string) string { return "$" + key + " = " + quoted },
+		unset:     func(key string) string { return "Remove-Item Env:" + key + " -ErrorAction SilentlyContinue" },
+		single:    pwshSingleQuote,
+		double:    pwshDoubleQuote,
+		multiline: pwshEscapedQuote,
+		trailing:  true,
+	}
+	nuDialect = shellDialect{
+		shells:    []string{"nu", "nushell"},
+		comment:   "#",
+		assign:    func(key, quoted string) string { return "$env." + key + " = " + quoted },
+		local:     func(key, quoted string) string { return "let " + key + " = " + quoted },
+		unset:     func(key string) string { return "hide-env --ignore-errors " + key },
+		single:    nuSingleQuote,
+		double:    nuDoubleQuote,
+		multiline: nuDoubleQuote,
+		trailing:  true,
+	}
+	cshDialect = shellDialect{
+		shells:   []string{"csh", "tcsh"},
+		comment:  "#",
+		assign:   func(key, quoted string) string { return "setenv " + key + " " + quoted },
+		local:    func(key, quoted string) string { return "set " + key + " = " + quoted },
+		unset:    func(key string) string { return "unsetenv " + key },
+		single:   cshQuote,
+		double:   cshQuote,
+		trailing: true,
+	}
+	cmdDialect = shellDialect{
+		shells:  []string{"cmd", "bat"},
+		comment: "rem",
+		assign:  func(key, quoted string) string { return `set "` + key + "=" + quoted + `"` },
+		unset:   func(key string) string { return `set "` + key + `="` },
+		single:  cmdQuote,
+		double:  cmdQuote,
+	}
+)
+
+func shExport(key, quoted string) string {
+	return "export " + key + "=" + quoted
+}
+
+func shLocal(key, quoted string) string {
+	return key + "=" + quoted
+}
+
+// set returns the statement setting key to a quoted value, as a shell
+// variable that is not exported if local is set and d supports it.
+func (d shellDialect) set(key, quoted string, local bool) string {
+	if local && d.local != nil {
+		return d.local(key, quoted)
+	}
+	return d.assign(key, quoted)
+}
+
+// quote quotes value according to mode. A value containing line breaks is
+// written in the multiline form of d regardless of mode, so every assignment
+// stays on one line.
+func (d shellDialect) quote(mode QuoteMode, value string) string {
+	if d.multiline != nil && hasLineBreak(value) {
+		return d.multiline(value)
+	}
+	if mode == QuoteSingle {
+		return d.single(value)
+	}
+	return d.double(value)
+}
+
+func hasLineBreak(s string) bool {
+	return strings.ContainsAny(s, "\r\n")
+}
+
+// includesAny reports whether the output of d includes a script for any of
+// the shells.
+func (d shellDialect) includesAny(shells []string) bool {
+	for _, sh := range shells {
+		if slices.Contains(d.shells, sh) {
+			return true
+		}
+	}
+	return false
 }
 
-// FeedFile reads a YAML file containing one or more EnvFragments
-// and adds them to the manager, validating priorities.
-func (e *EnvManager) FeedFile(fpath string) error {
-	data, err := os.ReadFile(fpath)
-	if err != nil {
-		return fmt.Errorf("failed to read file %s: %w", fpath, err)
+// fileMode returns the permissions of the files written by the manager.
+func (e *EnvManager) fileMode() os.FileMode {
+	if e.FileMode == 0 {
+		return 0o644
 	}
+	return e.FileMode
+}
 
-	// support multiple documents in one YAML file
-	dec := yaml.NewDecoder(bytes.NewReader(data))
-	for {
-		var frag EnvFragment
-		if err := dec.Decode(&frag); err != nil {
-			if err.Error() == "EOF" {
-				break
-			}
-			return fmt.Errorf("failed to parse YAML in %s: %w", fpath, err)
-		}
+// StdoutPath is the destination that makes the functions writing a file,
+// such as BuildBash("-"), write to standard output instead, for a quick look
+// at the output or to pipe it into another command.
+const StdoutPath = "-"
 
-		frag.Source = fpath // track which file this fragment came from
+// stdout receives the output written to StdoutPath.
+var stdout io.Writer = os.Stdout
 
-		if err := validateFragment(&frag); err != nil {
-			return fmt.Errorf("validation failed for fragment %s in %s: %w", frag.Name, fpath, err)
-		}
+// nopCloser adds a Close that does nothing to a writer.
+type nopCloser struct{ io.Writer }
 
-		e.Fragments = append(e.Fragments, &frag)
+func (nopCloser) Close() error { return nil }
+
+// createFile creates or truncates dst with the permissions of FileMode.
+// The mode is also applied to an existing file, so switching to 0600 makes
+// a previously generated file private. For StdoutPath it returns standard
+// output, which closing leaves open.
+func (e *EnvManager) createFile(dst string) (io.WriteCloser, error) {
+	if dst == StdoutPath {
+		return nopCloser{stdout}, nil
+	}
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, e.fileMode())
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(e.fileMode()); err != nil {
+		f.Close()
+		return nil, err
 	}
+	return f, nil
+}
 
-	return nil
+// openOutput opens dst for a shell or dotenv builder: like createFile, or
+// for appending with AppendOutput.
+func (e *EnvManager) openOutput(dst string) (io.WriteCloser, error) {
+	if !e.AppendOutput || dst == StdoutPath {
+		return e.createFile(dst)
+	}
+	return os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_APPEND, e.fileMode())
 }
 
-// FeedDir loads all YAML files from a directory. Non-YAML files are skipped.
-func (e *EnvManager) FeedDir(dir string) error {
-	files, err := os.ReadDir(dir)
+// writeFile writes data to dst like os.WriteFile, with the permissions of
+// FileMode.
+func (e *EnvManager) writeFile(dst string, data []byte) error {
+	f, err := e.createFile(dst)
 	if err != nil {
 		return err
 	}
-
-	for _, file := range files {
-		if file.IsDir() {
-			continue
-		}
-		name := file.Name()
-		if !strings.HasSuffix(name, ".yaml") && !strings.HasSuffix(name, ".yml") {
-			continue // skip non-YAML files
-		}
-
-		fpath := filepath.Join(dir, name)
-		if err := e.FeedFile(fpath); err != nil {
-			return err
-		}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
 	}
-
-	return nil
+	return err
 }
 
-func (e *EnvManager) SortAndMerge() {
-	if e.Merged == nil {
-		e.Merged = make(map[string]string)
+// writeComment writes text as comment lines starting with marker. Lines
+// already starting with marker are written unchanged.
+func writeComment(w io.Writer, marker, text string) {
+	if text == "" {
+		return
 	}
-	// key -> slice of source fragment names
-	e.KeySources = make(map[string][]string)
-
-	// Sort fragments by Priority ascending
-	sort.SliceStable(e.Fragments, func(i, j int) bool {
-		return e.Fragments[i].Priority < e.Fragments[j].Priority
-	})
-
-	// Merge
-	for _, frag := range e.Fragments {
-		for k, v := range frag.Env {
-			e.Merged[k] = v
-			e.KeySources[k] = append(e.KeySources[k], frag.Name)
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		switch {
+		case isCommentLine(line, marker):
+			fmt.Fprintln(w, line)
+		case line == "":
+			fmt.Fprintln(w, marker)
+		default:
+			fmt.Fprintf(w, "%s %s\n", marker, line)
 		}
 	}
+}
 
-	// Optional: attach sources info to fragments for debugging / search
-	for _, frag := range e.Fragments {
-		for k := range frag.Env {
-			// You could keep a map in EnvFragment: map[key] -> source frag name
-			// or just rely on keySources globally
-			_ = e.KeySources[k] // for potential future search/debug
-		}
+// isCommentLine reports whether line starts with the comment marker. A word
+// marker such as rem must be followed by a blank or end the line.
+func isCommentLine(line, marker string) bool {
+	rest, ok := strings.CutPrefix(line, marker)
+	if !ok {
+		return false
 	}
-	e.sorted = true
-	e.Ctime = time.Now()
+	return rest == "" || !isVarByte(marker[len(marker)-1], false) || rest[0] == ' ' || rest[0] == '\t'
 }
 
-func (e *EnvManager) BuildBash(dst string) error {
+// buildShell writes frags to the file dst in the syntax of d, see writeShell.
+func (e *EnvManager) buildShell(dst string, d shellDialect, frags []*EnvFragment, allowed func(key string) bool) error {
 	if !e.sorted {
 		return fmt.Errorf("not build complete yet")
 	}
-	f, err := os.Create(dst)
+	f, err := e.openOutput(dst)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	fmt.Fprintf(f, "# Env generated at %s\n", e.Ctime.Format(time.RFC3339))
-	fmt.Fprintf(f, "export ENV_CTIME=\"%s\"\n\n", e.Ctime.Format(time.RFC3339))
-	for _, frag := range e.Fragments {
-		fmt.Fprintf(f, "# --- Fragment: %s ---\n", frag.Name)
-		for k, v := range frag.Env {
-			fmt.Fprintf(f, "export %s=\"%s\"\n", k, v)
-		}
-		for _, sc := range frag.Script {
-			if sc.Sh == "bash" {
-				fmt.Fprintln(f, sc.Data)
-			}
-		}
-		fmt.Fprintln(f)
+	if err := e.writeShell(f, dst, d, frags, allowed); err != nil {
+		f.Close()
+		return err
 	}
-	return nil
+	return f.Close()
 }
 
-// BuildZsh generates a Zsh environment file from the loaded fragments.
-// Only scripts with Sh == "zsh" will be appended.
-func (e *EnvManager) BuildZsh(dst string) error {
+// writeShell writes frags to w in the syntax of d, leaving out the keys
+// allowed rejects. Keys are written in sorted order within each fragment, so
+// the output is deterministic. name identifies the output in log events.
+func (e *EnvManager) writeShell(
+	w io.Writer,
+	name string,
+	d shellDialect,
+	frags []*EnvFragment,
+	allowed func(key string) bool,
+) error {
 	if !e.sorted {
 		return fmt.Errorf("not build complete yet")
 	}
-	f, err := os.Create(dst)
-	if err != nil {
+	if err := e.checkRepresentable(d, frags, allowed); err != nil {
 		return err
 	}
-	defer f.Close()
-
-	fmt.Fprintf(f, "# Env generated at %s\n", e.Ctime.Format(time.RFC3339))
-	fmt.Fprintf(f, "export ENV_CTIME=\"%s\"\n", e.Ctime.Format(time.RFC3339))
-	for _, frag := range e.Fragments {
-		// Write fragment header
-		if frag.Name != "" {
-			fmt.Fprintf(f, "# --- Fragment: %s ---\n", frag.Name)
+	bw := bufio.NewWriter(w)
+	if !e.AppendOutput {
+		writeComment(bw, d.comment, e.Header)
+	}
+	if !e.NoCtime && !e.AppendOutput {
+		ctime := e.Ctime.Format(time.RFC3339)
+		fmt.Fprintf(bw, "%s Env generated at %s\n", d.comment, ctime)
+		fmt.Fprintf(bw, "%s\n\n", d.assign(e.ctimeKey(), d.quote(e.QuoteMode, ctime)))
+	}
+	for _, frag := range frags {
+		fmt.Fprintf(bw, "%s --- Fragment: %s ---\n", d.comment, frag.Name)
+		writeComment(bw, d.comment, frag.Comment)
+		for _, orig := range sortedKeys(frag.Env) {
+			k := e.envKey(orig)
+			if !allowed(k) {
+				e.log().Debug("key filtered", "key", k, "fragment", frag.Name, "output", name, "reason", e.filterReason(k))
+				continue
+			}
+			if e.isBlocked(frag, k) {
+				continue
+			}
+			value := d.quote(e.QuoteMode, e.shellValue(frag, orig, d))
+			e.writeStatement(bw, d, d.set(k, value, frag.isLocal(orig)), e.provenance(frag, k))
 		}
-
-		// Write environment variables
-		for k, v := range frag.Env {
-			fmt.Fprintf(f, "export %s=\"%s\"\n", k, v)
+		for _, orig := range e.appliedDefaults(frag) {
+			if k := e.envKey(orig); allowed(k) {
+				value := d.quote(e.QuoteMode, e.defaultValue(frag, orig))
+				e.writeStatement(bw, d, d.set(k, value, frag.isLocal(orig)), "default from "+frag.Name)
+			}
+		}
+		for _, orig := range frag.Unset {
+			if k := e.envKey(orig); allowed(k) && !e.isBlocked(frag, k) {
+				fmt.Fprintln(bw, d.unset(k))
+			}
 		}
-
-		// Write Zsh scripts
 		for _, sc := range frag.Script {
-			if sc.Sh == "zsh" {
-				fmt.Fprintln(f, sc.Data)
+			if sc.Order == 0 && d.includesAny(sc.shellNames()) {
+				e.log().Debug("script included", "fragment", frag.Name, "shell", sc.shellList(), "output", name)
+				fmt.Fprintln(bw, sc.Data)
 			}
 		}
-
-		// Separate fragments with a blank line
-		fmt.Fprintln(f)
+		fmt.Fprintln(bw)
+	}
+	if ordered := orderedScripts(frags, d); len(ordered) > 0 {
+		fmt.Fprintf(bw, "%s --- Ordered scripts ---\n", d.comment)
+		for _, o := range ordered {
+			e.log().Debug("script included", "fragment", o.frag.Name, "shell", o.script.shellList(), "output", name)
+			fmt.Fprintf(bw, "%s order %d: %s\n", d.comment, o.script.Order, o.frag.Name)
+			fmt.Fprintln(bw, o.script.Data)
+		}
+		fmt.Fprintln(bw)
+	}
+	writeComment(bw, d.comment, e.Footer)
+	// bufio.Writer keeps the first write error and returns it from Flush
+	if err := bw.Flush(); err != nil {
+		return err
 	}
+	e.log().Info("build complete", "output", name, "fragments", len(frags))
+	return nil
+}
 
+// checkRepresentable returns an error when d has no way to write a line
+// break and one of the values writeShell would write contains one. It runs
+// before anything is written, so a failing build leaves no partial script.
+func (e *EnvManager) checkRepresentable(d shellDialect, frags []*EnvFragment, allowed func(key string) bool) error {
+	if d.multiline != nil {
+		return nil
+	}
+	unrepresentable := func(k string, frag *EnvFragment) error {
+		return fmt.Errorf("key %s in fragment %s: value contains a line break, which %s cannot represent",
+			k, frag.Name, d.shells[0])
+	}
+	for _, frag := range frags {
+		for _, orig := range sortedKeys(frag.Env) {
+			k := e.envKey(orig)
+			if allowed(k) && !e.isBlocked(frag, k) && hasLineBreak(e.shellValue(frag, orig, d)) {
+				return unrepresentable(k, frag)
+			}
+		}
+		for _, orig := range e.appliedDefaults(frag) {
+			if k := e.envKey(orig); allowed(k) && hasLineBreak(e.defaultValue(frag, orig)) {
+				return unrepresentable(k, frag)
+			}
+		}
+	}
 	return nil
 }
 
+// writeStatement writes stmt as a line of the output of d. With Annotate set
+// note is added as a comment, after the statement if d allows it and on the
+// line before otherwise.
+func (e *EnvManager) writeStatement(w io.Writer, d shellDialect, stmt, note string) {
+	switch {
+	case !e.Annotate:
+		fmt.Fprintln(w, stmt)
+	case d.trailing:
+		fmt.Fprintf(w, "%s %s %s\n", stmt, d.comment, note)
+	default:
+		fmt.Fprintf(w, "%s %s\n%s\n", d.comment, note, stmt)
+	}
+}
+
+// provenance describes where the value frag assigns to key ended up: won by
+// frag, overridden or unset by a higher priority fragment.
+func (e *EnvManager) provenance(frag *EnvFragment, key string) string {
+	switch owner := e.owners[key]; {
+	case owner == frag:
+		return "from " + frag.Name
+	case owner != nil:
+		return "from " + frag.Name + ", overridden by " + owner.Name
+	case e.unset[key] != nil:
+		return "from " + frag.Name + ", unset by " + e.unset[key].Name
+	}
+	return "from " + frag.Name
+}
+
+// BuildBash generates a Bash environment file from the loaded fragments.
+// Values are quoted as selected by QuoteMode and are always set literally.
+// Only scripts with Sh == "bash" will be appended.
+func (e *EnvManager) BuildBash(dst string) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.buildShell(dst, bashDialect, e.active, e.keyAllowed)
+}
+
+// BuildBashTo is like BuildBash but writes to w, e.g. os.Stdout or a buffer.
+func (e *EnvManager) BuildBashTo(w io.Writer) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.writeShell(w, "writer", bashDialect, e.active, e.keyAllowed)
+}
+
+// BuildZsh generates a Zsh environment file from the loaded fragments.
+// Only scripts with Sh == "zsh" will be appended.
+func (e *EnvManager) BuildZsh(dst string) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.buildShell(dst, zshDialect, e.active, e.keyAllowed)
+}
+
+// BuildZshTo is like BuildZsh but writes to w.
+func (e *EnvManager) BuildZshTo(w io.Writer) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.writeShell(w, "writer", zshDialect, e.active, e.keyAllowed)
+}
+
 // BuildPsh generates a PowerShell environment file from the loaded fragments.
-// Only scripts with Sh == "pw" will be appended.
+// Only scripts with Sh == "pw", "pwsh" or "powershell" will be appended.
 func (e *EnvManager) BuildPsh(dst string) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.buildShell(dst, pwshDialect, e.active, e.keyAllowed)
+}
+
+// BuildPshTo is like BuildPsh but writes to w.
+func (e *EnvManager) BuildPshTo(w io.Writer) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.writeShell(w, "writer", pwshDialect, e.active, e.keyAllowed)
+}
+
+// BuildCmd generates a cmd.exe batch file from the loaded fragments, setting
+// each variable with a set "KEY=VALUE" line. QuoteMode does not apply: cmd has
+// a single quoting form, in which % is doubled and metacharacters outside the
+// quotes are escaped with ^. A set line cannot hold a line break, so a value
+// containing one is an error. Only scripts with Sh == "cmd" or "bat" will be
+// appended.
+func (e *EnvManager) BuildCmd(dst string) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.buildShell(dst, cmdDialect, e.active, e.keyAllowed)
+}
+
+// BuildCmdTo is like BuildCmd but writes to w.
+func (e *EnvManager) BuildCmdTo(w io.Writer) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.writeShell(w, "writer", cmdDialect, e.active, e.keyAllowed)
+}
+
+// BuildNu generates a Nushell environment file from the loaded fragments,
+// setting each variable with a $env.KEY = "value" line and removing unset
+// keys with hide-env. Values are quoted as selected by QuoteMode: Nushell
+// double quotes use backslash escapes, and single quoted values fall back to
+// double quotes when they contain a single quote or a control character.
+// Load the file with source-env. Only scripts with Sh == "nu" or "nushell"
+// will be appended.
+func (e *EnvManager) BuildNu(dst string) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.buildShell(dst, nuDialect, e.active, e.keyAllowed)
+}
+
+// BuildNuTo is like BuildNu but writes to w.
+func (e *EnvManager) BuildNuTo(w io.Writer) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.writeShell(w, "writer", nuDialect, e.active, e.keyAllowed)
+}
+
+// BuildCsh generates a csh/tcsh environment file from the loaded fragments,
+// e.g. for modulefiles on HPC systems, setting each variable with a setenv
+// KEY 'value' line and removing unset keys with unsetenv. QuoteMode does not
+// apply: csh double quotes expand $ and ` without a way to escape them, so
+// values are always single quoted, with ' and ! escaped outside the quotes.
+// csh cannot represent a line break in a value, so a value containing one
+// is an error. Load the file with source. Only scripts with Sh == "csh" or
+// "tcsh" will be appended.
+func (e *EnvManager) BuildCsh(dst string) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.buildShell(dst, cshDialect, e.active, e.keyAllowed)
+}
+
+// BuildCshTo is like BuildCsh but writes to w.
+func (e *EnvManager) BuildCshTo(w io.Writer) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.writeShell(w, "writer", cshDialect, e.active, e.keyAllowed)
+}
+
+// BuildBashCompletion writes a bash completion snippet that completes the
+// merged keys as arguments of commandName, e.g. for a CLI taking variable
+// names. Keys dropped by Allowlist or Denylist are not offered.
+func (e *EnvManager) BuildBashCompletion(dst, commandName string) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 	if !e.sorted {
 		return fmt.Errorf("not build complete yet")
 	}
-	f, err := os.Create(dst)
-	if err != nil {
-		return err
+	if commandName == "" {
+		return fmt.Errorf("command name must not be empty")
 	}
-	defer f.Close()
-	fmt.Fprintf(f, `$Env:ENV_CTIME = "%s"`+"\n", e.Ctime.Format(time.RFC3339))
-	for _, frag := range e.Fragments {
-		// Write fragment header
-		if frag.Name != "" {
-			fmt.Fprintf(f, "# --- Fragment: %s ---\n", frag.Name)
+	var keys []string
+	for _, k := range sortedKeys(e.merged) {
+		if e.keyAllowed(k) {
+			keys = append(keys, k)
 		}
+	}
 
-		// Write environment variables
-		for k, v := range frag.Env {
-			fmt.Fprintf(f, `$Env:%s = "%s"`+"\n", k, v)
-		}
+	var sb strings.Builder
+	if !e.NoCtime {
+		fmt.Fprintf(&sb, "# Bash completion generated at %s\n", e.Ctime.Format(time.RFC3339))
+	}
+	fmt.Fprintf(&sb, "complete -W %s %s\n", shSingleQuote(strings.Join(keys, " ")), shSingleQuote(commandName))
+	return e.writeFile(dst, []byte(sb.String()))
+}
 
-		// Write PowerShell scripts
-		for _, sc := range frag.Script {
-			if sc.Sh == "pw" {
-				fmt.Fprintln(f, sc.Data)
-			}
-		}
+// keyAllowed reports whether key passes the Allowlist and Denylist.
+func (e *EnvManager) keyAllowed(key string) bool {
+	if matchAnyKey(e.Denylist, key) {
+		return false
+	}
+	return len(e.Allowlist) == 0 || matchAnyKey(e.Allowlist, key)
+}
 
-		// Separate fragments with a blank line
-		fmt.Fprintln(f)
+// matchAnyKey reports whether key equals or matches any of the patterns.
+func matchAnyKey(patterns []string, key string) bool {
+	for _, p := range patterns {
+		if p == key {
+			return true
+		}
+		if ok, err := path.Match(p, key); err == nil && ok {
+			return true
+		}
 	}
+	return false
+}
 
-	return nil
+// DroppedKeys returns the sorted merged keys that the Build* functions leave
+// out because of Allowlist or Denylist. It returns nil before SortAndMerge.
+func (e *EnvManager) DroppedKeys() []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if !e.sorted {
+		return nil
+	}
+	var dropped []string
+	for k := range e.merged {
+		if !e.keyAllowed(k) {
+			dropped = append(dropped, k)
+		}
+	}
+	sort.Strings(dropped)
+	return dropped
 }
 
 // SearchResult holds a single search result
 type SearchResult struct {
 	FragmentName string // fragment name
-	Key          string // env key
-	Value        string // env value
+	Key          string // env key, or script[shells] for a script
+	Value        string // env value, "***" for secrets, or the script data
+
+	// InKey and InValue tell whether an env match is in the key, the value
+	// or both. Neither is set for script matches.
+	InKey   bool
+	InValue bool
+	// Line is the 1-based line of the first match within the script data,
+	// and MatchText the text it matched. Both are only set for script
+	// matches.
+	Line      int
+	MatchText string
 }
 
-// Search looks for the given pattern in all fragments' env keys and values.
-// Returns all matches with fragment information.
+// redacted replaces the values of secret keys in search results.
+const redacted = "***"
+
+// Search looks for the given pattern in all enabled fragments' env keys and
+// values. Returns all matches with fragment information. The values of
+// secret keys, see IsSecret, are redacted; use SearchOpts with RevealSecrets
+// to get them.
 func (e *EnvManager) Search(pattern string) ([]SearchResult, error) {
-	var re *regexp.Regexp
-	var err error
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	re, err := e.compileSearch(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []SearchResult
+	searchFragments(e.fragments, re, searchAll, e.secretKeys(), func(r SearchResult) bool {
+		results = append(results, r)
+		return true
+	})
+	return results, nil
+}
+
+// SearchStream is like Search but sends matches on the returned channel as
+// they are found. Both channels are closed once the search completes. The
+// error channel receives at most one error: an invalid pattern, a search
+// before SortAndMerge, or ctx.Err() when ctx is cancelled before the search
+// completes, in which case no further results are sent.
+func (e *EnvManager) SearchStream(ctx context.Context, pattern string) (<-chan SearchResult, <-chan error) {
+	results := make(chan SearchResult)
+	errc := make(chan error, 1)
+
+	// search a snapshot, so a slow consumer does not hold the lock
+	e.mu.RLock()
+	re, err := e.compileSearch(pattern)
+	frags := append([]*EnvFragment(nil), e.fragments...)
+	secrets := e.secretKeys()
+	e.mu.RUnlock()
+	if err != nil {
+		errc <- err
+		close(results)
+		close(errc)
+		return results, errc
+	}
+
+	go func() {
+		defer close(errc)
+		defer close(results)
+		searchFragments(frags, re, searchAll, secrets, func(r SearchResult) bool {
+			select {
+			case results <- r:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+		if err := ctx.Err(); err != nil {
+			errc <- err
+		}
+	}()
+	return results, errc
+}
+
+// IsSecret reports whether key holds a secret, as listed by the Secrets of
+// any fragment or by SecretKeys.
+func (e *EnvManager) IsSecret(key string) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return matchAnyKey(e.secretKeys(), key)
+}
+
+// secretKeys returns the patterns of every secret key.
+func (e *EnvManager) secretKeys() []string {
+	secrets := slices.Clone(e.SecretKeys)
+	for _, frag := range e.fragments {
+		secrets = append(secrets, frag.Secrets...)
+	}
+	return secrets
+}
+
+func (e *EnvManager) compileSearch(pattern string) (*regexp.Regexp, error) {
 	if !e.sorted {
 		return nil, fmt.Errorf("not build complete yet")
 	}
 	// try compile as regex
-	re, err = regexp.Compile(pattern)
+	re, err := regexp.Compile(pattern)
 	if err != nil {
 		return nil, fmt.Errorf("invalid pattern: %v", err)
 	}
+	return re, nil
+}
+
+// SearchOptions narrows down SearchOpts.
+type SearchOptions struct {
+	// CaseInsensitive matches the pattern regardless of case.
+	CaseInsensitive bool
+	// KeysOnly matches env keys only, ValuesOnly env values only. By
+	// default both are matched. They are mutually exclusive.
+	KeysOnly   bool
+	ValuesOnly bool
+	// IncludeScripts also matches script bodies, as Search does.
+	IncludeScripts bool
+	// ActiveOnly restricts the search to the fragments that took part in
+	// the last merge, honoring the profile, tags and target platform.
+	ActiveOnly bool
+	// FragmentFilter restricts the search to fragments whose name equals it
+	// or matches it as a path.Match pattern. Empty means all fragments.
+	FragmentFilter string
+	// RevealSecrets returns the values of secret keys instead of "***".
+	RevealSecrets bool
+	// IncludeDisabled also searches the fragments switched off with
+	// Enabled, which are skipped otherwise.
+	IncludeDisabled bool
+}
+
+// searchAll are the options of Search.
+var searchAll = SearchOptions{IncludeScripts: true}
+
+// SearchOpts is like Search with control over what is matched. The results
+// are in the same order as those of Search.
+func (e *EnvManager) SearchOpts(pattern string, opts SearchOptions) ([]SearchResult, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if opts.KeysOnly && opts.ValuesOnly {
+		return nil, fmt.Errorf("KeysOnly and ValuesOnly are mutually exclusive")
+	}
+	if opts.CaseInsensitive && !strings.HasPrefix(pattern, "(?i)") {
+		pattern = "(?i)" + pattern
+	}
+	re, err := e.compileSearch(pattern)
+	if err != nil {
+		return nil, err
+	}
 
+	frags := e.fragments
+	if opts.ActiveOnly {
+		frags = e.active
+	}
 	var results []SearchResult
-	for _, frag := range e.Fragments {
-		for k, v := range frag.Env {
-			if re.MatchString(k) || re.MatchString(v) {
-				results = append(results, SearchResult{
-					FragmentName: frag.Name,
-					Key:          k,
-					Value:        v,
-				})
+	searchFragments(frags, re, opts, e.secretKeys(), func(r SearchResult) bool {
+		results = append(results, r)
+		return true
+	})
+	return results, nil
+}
+
+// searchFragments calls emit for every env entry and script of frags matching
+// re as selected by opts, in fragment order, until emit returns false. The
+// values of keys matching secrets are redacted unless opts reveals them.
+func searchFragments(
+	frags []*EnvFragment,
+	re *regexp.Regexp,
+	opts SearchOptions,
+	secrets []string,
+	emit func(SearchResult) bool,
+) {
+	for _, frag := range frags {
+		if !frag.IsEnabled() && !opts.IncludeDisabled {
+			continue
+		}
+		if opts.FragmentFilter != "" && !matchAnyKey([]string{opts.FragmentFilter}, frag.Name) {
+			continue
+		}
+		for _, k := range sortedKeys(frag.Env) {
+			v := frag.Env[k]
+			inKey := !opts.ValuesOnly && re.MatchString(k)
+			inValue := !opts.KeysOnly && re.MatchString(v)
+			if inKey || inValue {
+				if !opts.RevealSecrets && matchAnyKey(secrets, k) {
+					v = redacted
+				}
+				if !emit(SearchResult{FragmentName: frag.Name, Key: k, Value: v, InKey: inKey, InValue: inValue}) {
+					return
+				}
 			}
 		}
 
-		// also search inside scripts
+		if !opts.IncludeScripts {
+			continue
+		}
 		for _, sc := range frag.Script {
-			if re.MatchString(sc.Data) {
-				results = append(results, SearchResult{
+			if loc := re.FindStringIndex(sc.Data); loc != nil {
+				r := SearchResult{
 					FragmentName: frag.Name,
-					Key:          fmt.Sprintf("script[%s]", sc.Sh),
+					Key:          fmt.Sprintf("script[%s]", sc.shellList()),
 					Value:        sc.Data,
-				})
+					Line:         strings.Count(sc.Data[:loc[0]], "\n") + 1,
+					MatchText:    sc.Data[loc[0]:loc[1]],
+				}
+				if !emit(r) {
+					return
+				}
 			}
 		}
 	}
-	return results, nil
 }
 
 func ExampleEnvYaml(dst string) error {
@@ -374,19 +2584,29 @@ script:
 	return nil
 }
 
+// ctimeKey returns the name of the ctime variable, see CtimeKey.
+func (e *EnvManager) ctimeKey() string {
+	if e.CtimeKey == "" {
+		return ENV_CTIME_KEY
+	}
+	return e.CtimeKey
+}
+
 // WriteMeta writes the EnvManager's ctime to a metadata file in RFC3339 format.
 func (e *EnvManager) WriteMeta(dst string) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 	if !e.sorted {
 		return fmt.Errorf("not gen yet")
 	}
 
-	f, err := os.Create(dst)
+	f, err := e.createFile(dst)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	_, err = f.WriteString(e.Ctime.Format(time.RFC3339))
+	_, err = io.WriteString(f, e.Ctime.Format(time.RFC3339))
 	return err
 }
 
@@ -403,55 +2623,229 @@ func ReadEnvTime(dst string) (time.Time, error) {
 	return t, nil
 }
 
+// IsStale reports whether the environment recorded by the meta file at
+// metaPath was generated more than ttl ago. The file may be written by
+// WriteMeta or WriteMetaJSON. A missing file counts as stale, so callers
+// generate the environment when it was never generated. A file that cannot
+// be parsed is reported with a MetaParseError.
+func IsStale(metaPath string, ttl time.Duration) (bool, error) {
+	data, err := os.ReadFile(metaPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var ctime time.Time
+	if text := strings.TrimSpace(string(data)); strings.HasPrefix(text, "{") {
+		var meta Meta
+		err = json.Unmarshal(data, &meta)
+		ctime = meta.Ctime
+	} else {
+		ctime, err = time.Parse(time.RFC3339, text)
+	}
+	if err != nil {
+		return false, MetaParseError{Path: metaPath, Err: err}
+	}
+	return time.Since(ctime) > ttl, nil
+}
+
+// MergedFragmentName and MergedFragmentPriority are the name and priority of
+// the fragment written by BuildMergedYAML.
+const (
+	MergedFragmentName     = "merged"
+	MergedFragmentPriority = 100
+)
+
+// ExportMergedFragment returns the result of the last merge as a single
+// fragment: its Env is the merged environment, its Unset lists the keys
+// removed by the merge, and it carries the scripts and secret keys of the
+// merged fragments in priority order. Building it alone produces the same
+// variables as the fragments it was merged from. It returns nil before
+// SortAndMerge.
+func (e *EnvManager) ExportMergedFragment(name string, priority int) *EnvFragment {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.exportMergedFragment(name, priority)
+}
+
+func (e *EnvManager) exportMergedFragment(name string, priority int) *EnvFragment {
+	if !e.sorted {
+		return nil
+	}
+	frag := &EnvFragment{
+		Name:     name,
+		Priority: priority,
+		Env:      maps.Clone(e.merged),
+		Unset:    sortedKeys(e.unset),
+		ShellEnv: e.mergedShellEnv(),
+	}
+	for _, f := range e.active {
+		frag.Script = append(frag.Script, f.Script...)
+		frag.Secrets = append(frag.Secrets, f.Secrets...)
+	}
+	for _, k := range sortedKeys(e.merged) {
+		if e.owners[k].isLocal(k) {
+			frag.Local = append(frag.Local, k)
+		}
+	}
+	return frag
+}
+
+// BuildMergedYAML writes the fragment returned by ExportMergedFragment, named
+// MergedFragmentName with priority MergedFragmentPriority, to dst as YAML, to
+// archive the merged state. Keys are sorted, so an unchanged environment
+// produces the same file.
+func (e *EnvManager) BuildMergedYAML(dst string) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	frag := e.exportMergedFragment(MergedFragmentName, MergedFragmentPriority)
+	if frag == nil {
+		return fmt.Errorf("not build complete yet")
+	}
+	data, err := yaml.Marshal(frag)
+	if err != nil {
+		return fmt.Errorf("failed to marshal merged fragment: %w", err)
+	}
+	return e.writeFile(dst, data)
+}
+
+// allYaml is the layout of the file written by SaveAllYaml.
+type allYaml struct {
+	Sorted    bool           `yaml:"sorted"`
+	CTime     string         `yaml:"ctime"`
+	Fragments []*EnvFragment `yaml:"fragments"`
+}
+
 // SaveAllYaml saves the EnvManager's fragments, sorted flag, and ctime to a YAML file.
 // merged and keySources are not saved since they are runtime-generated.
+// Comments are carried over from the YAML the fragments were fed or loaded
+// from: those on a fragment, its keys and list entries, and with a file read
+// by LoadAllYaml, those at the top of that file.
 func (e *EnvManager) SaveAllYaml(path string) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 	if !e.sorted {
 		return fmt.Errorf("not sorte yet")
 	}
-	type dumpStruct struct {
-		Sorted    bool           `yaml:"sorted"`
-		CTime     string         `yaml:"ctime"`
-		Fragments []*EnvFragment `yaml:"fragments"`
-	}
 
-	d := dumpStruct{
+	d := allYaml{
 		Sorted:    e.sorted,
 		CTime:     e.Ctime.Format(time.RFC3339),
-		Fragments: e.Fragments,
+		Fragments: e.fragments,
+	}
+	var root yaml.Node
+	if err := root.Encode(&d); err != nil {
+		return fmt.Errorf("failed to marshal EnvManager to YAML: %w", err)
+	}
+	if e.allYamlNode != nil {
+		copyComments(&root, e.allYamlNode, "fragments")
+	}
+	if seq := mappingValue(&root, "fragments"); seq != nil {
+		for i, frag := range e.fragments {
+			if frag.node != nil && i < len(seq.Content) {
+				copyComments(seq.Content[i], frag.node, "")
+			}
+		}
 	}
 
-	data, err := yaml.Marshal(&d)
+	data, err := yaml.Marshal(&root)
 	if err != nil {
 		return fmt.Errorf("failed to marshal EnvManager to YAML: %w", err)
 	}
 
-	if err := os.WriteFile(path, data, 0644); err != nil {
+	if err := e.writeFile(path, data); err != nil {
 		return fmt.Errorf("failed to write YAML file %s: %w", path, err)
 	}
 	return nil
 }
 
+// copyComments copies the comments of src to dst where dst has none,
+// following mapping keys by name and sequence entries by position. The
+// value of the mapping key skip is left alone.
+func copyComments(dst, src *yaml.Node, skip string) {
+	if src.Kind == yaml.DocumentNode {
+		if dst.HeadComment == "" {
+			dst.HeadComment = src.HeadComment
+		}
+		if len(src.Content) > 0 {
+			copyComments(dst, src.Content[0], skip)
+		}
+		return
+	}
+	if dst.HeadComment == "" {
+		dst.HeadComment = src.HeadComment
+	}
+	if dst.LineComment == "" {
+		dst.LineComment = src.LineComment
+	}
+	if dst.FootComment == "" {
+		dst.FootComment = src.FootComment
+	}
+	switch {
+	case dst.Kind == yaml.MappingNode && src.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(dst.Content); i += 2 {
+			for j := 0; j+1 < len(src.Content); j += 2 {
+				if dst.Content[i].Value != src.Content[j].Value {
+					continue
+				}
+				copyComments(dst.Content[i], src.Content[j], "")
+				if dst.Content[i].Value != skip {
+					copyComments(dst.Content[i+1], src.Content[j+1], "")
+				}
+				break
+			}
+		}
+	case dst.Kind == yaml.SequenceNode && src.Kind == yaml.SequenceNode:
+		for i := 0; i < len(dst.Content) && i < len(src.Content); i++ {
+			copyComments(dst.Content[i], src.Content[i], "")
+		}
+	}
+}
+
+// mappingValue returns the value of key in the mapping node n, or nil.
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	if n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
 // LoadAllYaml loads the EnvManager from a YAML file saved by SaveAllYaml.
 // After loading, it automatically calls SortAndMerge() to rebuild merged and keySources.
 func (e *EnvManager) LoadAllYaml(path string) error {
-	type dumpStruct struct {
-		Sorted    bool           `yaml:"sorted"`
-		CTime     string         `yaml:"ctime"`
-		Fragments []*EnvFragment `yaml:"fragments"`
-	}
-
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return fmt.Errorf("failed to read YAML file %s: %w", path, err)
 	}
 
-	var d dumpStruct
-	if err := yaml.Unmarshal(data, &d); err != nil {
+	var root yaml.Node
+	var d allYaml
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return fmt.Errorf("failed to unmarshal YAML: %w", err)
+	}
+	if err := root.Decode(&d); err != nil {
 		return fmt.Errorf("failed to unmarshal YAML: %w", err)
 	}
+	if seq := mappingValue(&root, "fragments"); seq != nil && len(seq.Content) == len(d.Fragments) {
+		for i, frag := range d.Fragments {
+			frag.node = seq.Content[i]
+		}
+	}
 
-	e.Fragments = d.Fragments
+	e.allYamlNode = &root
+	e.fragments = d.Fragments
 	e.sorted = d.Sorted
 	if d.CTime != "" {
 		if t, err := time.Parse(time.RFC3339, d.CTime); err == nil {
@@ -460,6 +2854,5 @@ func (e *EnvManager) LoadAllYaml(path string) error {
 	}
 
 	// rebuild merged and keySources
-	e.SortAndMerge()
-	return nil
+	return e.sortAndMerge()
 }
@@ -0,0 +1,2186 @@
+package env
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestAddFragment(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.AddFragment(&EnvFragment{
+		Name:     "web",
+		Priority: 100,
+		Env:      map[string]string{"PORT": "8080"},
+	}))
+	isNoErr(t, em.SortAndMergeStrict())
+	isTrue(t, em.sorted)
+
+	isNoErr(t, em.AddFragment(&EnvFragment{
+		Name:     "override",
+		Priority: 150,
+		Env:      map[string]string{"PORT": "9090"},
+	}))
+	isFalse(t, em.sorted)
+	isEqual(t, 2, len(em.Fragments()))
+
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, "9090", em.Merged()["PORT"])
+}
+
+func TestAddFragmentInvalid(t *testing.T) {
+	em := &EnvManager{}
+	err := em.AddFragment(&EnvFragment{Name: "low", Priority: 5})
+	isTrue(t, err != nil)
+	isTrue(t, strings.Contains(err.Error(), "custom fragment low priority must >=100"))
+	isEqual(t, 0, len(em.Fragments()))
+
+	err = em.AddFragment(&EnvFragment{Priority: 100})
+	isErrorWithMessage(t, err, "validation failed for fragment : fragment must have a name")
+}
+
+func TestRegisterFragmentTiers(t *testing.T) {
+	RegisterSystemFragment("os")
+	RegisterInnerComponent("runtime")
+	t.Cleanup(func() {
+		UnregisterSystemFragment("os")
+		UnregisterInnerComponent("runtime")
+	})
+
+	em := &EnvManager{}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "os", Priority: 5}))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "runtime", Priority: 50}))
+	isErrorWithMessage(t, em.AddFragment(&EnvFragment{Name: "os", Priority: 50}),
+		"validation failed for fragment os: system fragment os priority must be 0-19, got 50")
+	isErrorWithMessage(t, em.AddFragment(&EnvFragment{Name: "runtime", Priority: 100}),
+		"validation failed for fragment runtime: internal component runtime priority must be 20-99, got 100")
+
+	UnregisterSystemFragment("os")
+	isErrorWithMessage(t, em.AddFragment(&EnvFragment{Name: "os", Priority: 5}),
+		"validation failed for fragment os: custom fragment os priority must >=100, got 5")
+}
+
+func TestRemoveFragment(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.FeedReader(strings.NewReader("name: base\npriority: 100\nenv:\n  PORT: \"80\"\n---\nname: web\npriority: 110\nenv:\n  PORT: \"8080\"\n"), "a.yaml"))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "web", Priority: 120, Env: map[string]string{"HOST": "x"}}))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	isTrue(t, em.RemoveFragment("web"))
+	isFalse(t, em.sorted)
+	isEqual(t, 1, len(em.Fragments()))
+	isFalse(t, em.RemoveFragment("web"))
+
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, map[string]string{"PORT": "80"}, em.Merged())
+
+	isFalse(t, em.RemoveFragmentBySource("b.yaml"))
+	isTrue(t, em.sorted)
+	isTrue(t, em.RemoveFragmentBySource("a.yaml"))
+	isEqual(t, 0, len(em.Fragments()))
+}
+
+func newFilterManager(tb testing.TB) *EnvManager {
+	tb.Helper()
+
+	em := &EnvManager{}
+	isNoErr(tb, em.AddFragment(&EnvFragment{
+		Name:     "app",
+		Priority: 100,
+		Env: map[string]string{
+			"APP_PORT":    "8080",
+			"APP_HOST":    "0.0.0.0",
+			"DB_PASSWORD": "hunter2",
+		},
+	}))
+	isNoErr(tb, em.SortAndMergeStrict())
+	return em
+}
+
+func TestBuildAllowlist(t *testing.T) {
+	em := newFilterManager(t)
+	em.Allowlist = []string{"APP_*"}
+
+	dst := filepath.Join(t.TempDir(), "env.sh")
+	isNoErr(t, em.BuildBash(dst))
+	out, err := os.ReadFile(dst)
+	isNoErr(t, err)
+	isTrue(t, strings.Contains(string(out), `export APP_PORT="8080"`))
+	isTrue(t, strings.Contains(string(out), `export APP_HOST="0.0.0.0"`))
+	isFalse(t, strings.Contains(string(out), "DB_PASSWORD"))
+	isEqual(t, []string{"DB_PASSWORD"}, em.DroppedKeys())
+}
+
+func TestBuildDenylist(t *testing.T) {
+	em := newFilterManager(t)
+	em.Allowlist = []string{"APP_*", "DB_PASSWORD"}
+	em.Denylist = []string{"DB_PASSWORD", "APP_HOST"}
+
+	dst := filepath.Join(t.TempDir(), "env.ps1")
+	isNoErr(t, em.BuildPsh(dst))
+	out, err := os.ReadFile(dst)
+	isNoErr(t, err)
+	isTrue(t, strings.Contains(string(out), `$Env:APP_PORT = "8080"`))
+	isFalse(t, strings.Contains(string(out), "APP_HOST"))
+	isFalse(t, strings.Contains(string(out), "DB_PASSWORD"))
+	isEqual(t, []string{"APP_HOST", "DB_PASSWORD"}, em.DroppedKeys())
+}
+
+func TestDroppedKeysNotSorted(t *testing.T) {
+	em := &EnvManager{Denylist: []string{"*"}}
+	isEqual(t, []string(nil), em.DroppedKeys())
+}
+
+func TestMerged(t *testing.T) {
+	em := &EnvManager{}
+	isEqual(t, map[string]string{}, em.Merged())
+
+	isNoErr(t, em.AddFragment(&EnvFragment{
+		Name:     "base",
+		Priority: 100,
+		Env:      map[string]string{"HOST": "localhost", "PORT": "80"},
+	}))
+	isNoErr(t, em.AddFragment(&EnvFragment{
+		Name:     "override",
+		Priority: 110,
+		Env:      map[string]string{"PORT": "8080"},
+	}))
+	isEqual(t, map[string]string{}, em.Merged())
+
+	isNoErr(t, em.SortAndMergeStrict())
+	merged := em.Merged()
+	isEqual(t, map[string]string{"HOST": "localhost", "PORT": "8080"}, merged)
+
+	merged["PORT"] = "1"
+	isEqual(t, "8080", em.Merged()["PORT"])
+}
+
+func TestApplyToProcess(t *testing.T) {
+	em := &EnvManager{}
+	isErrorWithMessage(t, em.ApplyToProcess(), "not build complete yet")
+
+	isNoErr(t, em.AddFragment(&EnvFragment{
+		Name:     "base",
+		Priority: 100,
+		Env:      map[string]string{"ENV_TEST_APPLY_A": "base", "ENV_TEST_APPLY_B": "base"},
+	}))
+	isNoErr(t, em.AddFragment(&EnvFragment{
+		Name:     "override",
+		Priority: 110,
+		Env:      map[string]string{"ENV_TEST_APPLY_A": "override"},
+	}))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	t.Setenv("ENV_TEST_APPLY_A", "")
+	t.Setenv("ENV_TEST_APPLY_B", "")
+	isNoErr(t, em.ApplyToProcess())
+	isEqual(t, "override", os.Getenv("ENV_TEST_APPLY_A"))
+	isEqual(t, "base", os.Getenv("ENV_TEST_APPLY_B"))
+}
+
+func TestApplyToProcessNoOverride(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.AddFragment(&EnvFragment{
+		Name:     "base",
+		Priority: 100,
+		Env:      map[string]string{"ENV_TEST_APPLY_SET": "new", "ENV_TEST_APPLY_UNSET": "new"},
+	}))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	t.Setenv("ENV_TEST_APPLY_SET", "existing")
+	t.Setenv("ENV_TEST_APPLY_UNSET", "")
+	os.Unsetenv("ENV_TEST_APPLY_UNSET")
+	isNoErr(t, em.ApplyToProcessOverride(false))
+	isEqual(t, "existing", os.Getenv("ENV_TEST_APPLY_SET"))
+	isEqual(t, "new", os.Getenv("ENV_TEST_APPLY_UNSET"))
+}
+
+func TestFragmentsLoadedAt(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.yaml")
+	second := filepath.Join(dir, "second.yaml")
+	isNoErr(t, os.WriteFile(first, []byte("name: first\npriority: 200\n"), 0o644))
+	isNoErr(t, os.WriteFile(second, []byte("name: second\npriority: 100\n"), 0o644))
+
+	em := &EnvManager{}
+	isNoErr(t, em.FeedFile(first))
+	time.Sleep(time.Millisecond)
+	isNoErr(t, em.FeedFile(second))
+	time.Sleep(time.Millisecond)
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "third", Priority: 150}))
+
+	frags := em.Fragments()
+	isEqual(t, 3, len(frags))
+	isEqual(t, first, frags[0].Source)
+	isFalse(t, frags[0].LoadedAt.IsZero())
+	isTrue(t, frags[1].LoadedAt.After(frags[0].LoadedAt))
+	isTrue(t, frags[2].LoadedAt.After(frags[1].LoadedAt))
+
+	// priority order differs from load order, timestamps keep the latter
+	isNoErr(t, em.SortAndMergeStrict())
+	frags = em.Fragments()
+	isEqual(t, "second", frags[0].Name)
+	isEqual(t, "first", frags[2].Name)
+	isTrue(t, frags[2].LoadedAt.Before(frags[0].LoadedAt))
+}
+
+func TestBuildBashCompletion(t *testing.T) {
+	em := newFilterManager(t)
+	em.Denylist = []string{"DB_*"}
+
+	dst := filepath.Join(t.TempDir(), "completion.bash")
+	isNoErr(t, em.BuildBashCompletion(dst, "envctl"))
+	out, err := os.ReadFile(dst)
+	isNoErr(t, err)
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	isEqual(t, 2, len(lines))
+	isEqual(t, "complete -W 'APP_HOST APP_PORT' 'envctl'", lines[1])
+
+	em.NoCtime = true
+	isNoErr(t, em.BuildBashCompletion(dst, "envctl"))
+	out, err = os.ReadFile(dst)
+	isNoErr(t, err)
+	isEqual(t, "complete -W 'APP_HOST APP_PORT' 'envctl'\n", string(out))
+
+	isErrorWithMessage(t, em.BuildBashCompletion(dst, ""), "command name must not be empty")
+	isErrorWithMessage(t, (&EnvManager{}).BuildBashCompletion(dst, "envctl"), "not build complete yet")
+}
+
+func TestBuildBashCompletionQuoting(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.SortAndMergeStrict())
+
+	dst := filepath.Join(t.TempDir(), "completion.bash")
+	isNoErr(t, em.BuildBashCompletion(dst, "it's"))
+	out, err := os.ReadFile(dst)
+	isNoErr(t, err)
+	isTrue(t, strings.HasSuffix(string(out), "complete -W '' 'it'\\''s'\n"))
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestBuildTo(t *testing.T) {
+	em := newFilterManager(t)
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		build   func(*EnvManager, string) error
+		buildTo func(*EnvManager, io.Writer) error
+	}{
+		{(*EnvManager).BuildBash, (*EnvManager).BuildBashTo},
+		{(*EnvManager).BuildZsh, (*EnvManager).BuildZshTo},
+		{(*EnvManager).BuildPsh, (*EnvManager).BuildPshTo},
+		{(*EnvManager).BuildCmd, (*EnvManager).BuildCmdTo},
+	} {
+		dst := filepath.Join(dir, "env")
+		isNoErr(t, tt.build(em, dst))
+		want, err := os.ReadFile(dst)
+		isNoErr(t, err)
+
+		var buf bytes.Buffer
+		isNoErr(t, tt.buildTo(em, &buf))
+		isEqual(t, string(want), buf.String())
+
+		isErrorWithMessage(t, tt.buildTo(em, failingWriter{}), "disk full")
+		isErrorWithMessage(t, tt.buildTo(&EnvManager{}, &buf), "not build complete yet")
+	}
+}
+
+func TestBuildCmd(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.AddFragment(&EnvFragment{
+		Name:     "win",
+		Priority: 100,
+		Env: map[string]string{
+			"PROGRESS": "100%",
+			"ARGS":     `a & b "c & d" ^e`,
+		},
+		Script: []Script{
+			{Sh: "cmd", Data: "call setup.bat"},
+			{Sh: "bat", Data: "echo ready"},
+			{Sh: "bash", Data: "echo bash"},
+		},
+	}))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	dst := filepath.Join(t.TempDir(), "env.bat")
+	isNoErr(t, em.BuildCmd(dst))
+	out, err := os.ReadFile(dst)
+	isNoErr(t, err)
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	isTrue(t, strings.HasPrefix(lines[0], "rem Env generated at "))
+	isTrue(t, strings.HasPrefix(lines[1], `set "ENV_CTIME=`))
+	isEqual(t, []string{
+		"rem --- Fragment: win ---",
+		`set "ARGS=a & b "c ^& d" ^e"`,
+		`set "PROGRESS=100%%"`,
+		"call setup.bat",
+		"echo ready",
+	}, lines[3:])
+}
+
+func TestConflicts(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "user", Priority: 150, Env: map[string]string{"PATH": "/home/user/bin"}}))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "base", Priority: 100, Env: map[string]string{"PATH": "/usr/bin", "LANG": "C"}}))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "tools", Priority: 120, Env: map[string]string{"PATH": "/opt/bin", "EDITOR": "vi"}}))
+	isEqual(t, []Conflict(nil), em.Conflicts())
+
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, []Conflict{{
+		Key:    "PATH",
+		Winner: FragmentValue{Fragment: "user", Value: "/home/user/bin"},
+		Shadowed: []FragmentValue{
+			{Fragment: "base", Value: "/usr/bin"},
+			{Fragment: "tools", Value: "/opt/bin"},
+		},
+	}}, em.Conflicts())
+}
+
+func TestStrictMerge(t *testing.T) {
+	em := &EnvManager{StrictMerge: true}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "base", Priority: 100, Env: map[string]string{
+		"PATH": "/usr/bin", "LANG": "C", "LOG_LEVEL": "info",
+	}}))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "user", Priority: 150, Env: map[string]string{
+		"PATH": "/home/user/bin", "LANG": "en_US.UTF-8", "LOG_LEVEL": "debug",
+	}, AllowOverride: []string{"LOG_*"}}))
+
+	err := em.SortAndMergeStrict()
+	isErrorWithMessage(t, err, "strict merge: keys defined by more than one fragment: LANG (base, user), PATH (base, user)")
+	isFalse(t, em.sorted)
+	isEqual(t, map[string]string{}, em.Merged())
+
+	// SortAndMerge reports nothing, but the manager stays unsorted
+	em.SortAndMerge()
+	isFalse(t, em.sorted)
+	isErrorWithMessage(t, em.BuildBashTo(io.Discard), "not build complete yet")
+
+	em.fragments[1].AllowOverride = []string{"*"}
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, "debug", em.Merged()["LOG_LEVEL"])
+
+	em.StrictMerge = false
+	em.fragments[1].AllowOverride = nil
+	isNoErr(t, em.SortAndMergeStrict())
+}
+
+func TestStrictMergeAllowOverrideYAML(t *testing.T) {
+	dir := t.TempDir()
+	isNoErr(t, os.WriteFile(filepath.Join(dir, "a.yaml"), []byte(`name: base
+priority: 100
+env:
+  PATH: /usr/bin
+---
+name: user
+priority: 150
+allow_override: [PATH]
+env:
+  PATH: /home/user/bin
+`), 0o644))
+
+	em := &EnvManager{StrictMerge: true}
+	isNoErr(t, em.FeedDir(dir))
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, "/home/user/bin", em.Merged()["PATH"])
+}
+
+func TestFlattenKeys(t *testing.T) {
+	em := &EnvManager{FlattenKeys: true}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "db", Priority: 100, Env: map[string]string{
+		"DB.HOST":       "localhost",
+		"DB.PORT":       "5432",
+		"cache-size.mb": "64",
+	}}))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "prod", Priority: 110, Env: map[string]string{
+		"DB.HOST": "db.internal",
+	}}))
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, map[string]string{
+		"DB_HOST":       "db.internal",
+		"DB_PORT":       "5432",
+		"cache_size_mb": "64",
+	}, em.Merged())
+	isEqual(t, []string{"db", "prod"}, em.KeySources("DB_HOST"))
+
+	dst := filepath.Join(t.TempDir(), "env.sh")
+	isNoErr(t, em.BuildBash(dst))
+	data, err := os.ReadFile(dst)
+	isNoErr(t, err)
+	isTrue(t, strings.Contains(string(data), `export DB_HOST="db.internal"`))
+	isFalse(t, strings.Contains(string(data), "DB.HOST"))
+}
+
+func TestFlattenKeysCollision(t *testing.T) {
+	em := &EnvManager{FlattenKeys: true}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "base", Priority: 100, Env: map[string]string{
+		"DB_HOST": "a",
+		"DB.PORT": "1",
+		"DB-PORT": "2",
+	}}))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "app", Priority: 110, Env: map[string]string{
+		"DB.HOST": "b",
+	}}))
+	isErrorWithMessage(t, em.SortAndMergeStrict(),
+		"flattened keys collide: DB_HOST <- DB.HOST (app), DB_HOST (base); DB_PORT <- DB-PORT (base), DB.PORT (base)")
+	isFalse(t, em.sorted)
+
+	// without flattening the keys are distinct
+	em.FlattenKeys = false
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, 4, len(em.Merged()))
+}
+
+func TestUnset(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.FeedReader(strings.NewReader(`name: base
+priority: 100
+overridable: [DEBUG, PROXY]
+env:
+  DEBUG: "1"
+  PROXY: http://proxy
+  LOCKED: keep
+---
+name: prod
+priority: 110
+unset: [DEBUG, PROXY, LOCKED, INHERITED]
+---
+name: late
+priority: 120
+env:
+  PROXY: http://other
+`), "frags.yaml"))
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, map[string]string{"PROXY": "http://other", "LOCKED": "keep"}, em.Merged())
+	isTrue(t, em.KeySources("DEBUG") == nil)
+	isEqual(t, []string{"late"}, em.KeySources("PROXY"))
+	isEqual(t, []BlockedOverride{{Key: "LOCKED", LockedBy: "base", Fragment: "prod"}}, em.MergeReport().BlockedOverrides)
+
+	var buf bytes.Buffer
+	isNoErr(t, em.BuildBashTo(&buf))
+	out := buf.String()
+	isTrue(t, strings.Contains(out, "# --- Fragment: prod ---\nunset DEBUG\nunset PROXY\nunset INHERITED\n"))
+	buf.Reset()
+	isNoErr(t, em.BuildPshTo(&buf))
+	isTrue(t, strings.Contains(buf.String(), "Remove-Item Env:DEBUG -ErrorAction SilentlyContinue\n"))
+
+	t.Setenv("INHERITED", "x")
+	t.Setenv("DEBUG", "x")
+	isNoErr(t, em.ApplyToProcess())
+	_, ok := os.LookupEnv("INHERITED")
+	isFalse(t, ok)
+	_, ok = os.LookupEnv("DEBUG")
+	isFalse(t, ok)
+	isEqual(t, "http://other", os.Getenv("PROXY"))
+
+	isErrorWithMessage(t, em.AddFragment(&EnvFragment{Name: "both", Priority: 130, Env: map[string]string{"A": "1"}, Unset: []string{"A"}}),
+		"validation failed for fragment both: key A is both set and unset")
+}
+
+func TestUnsetBash(t *testing.T) {
+	requireShell(t, "bash")
+
+	em := &EnvManager{}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "base", Priority: 100, Env: map[string]string{"A": "1", "B": "2"}}))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "app", Priority: 110, Unset: []string{"A", "HOME"}}))
+	isNoErr(t, em.SortAndMergeStrict())
+	dst := filepath.Join(t.TempDir(), "env.sh")
+	isNoErr(t, em.BuildBash(dst))
+
+	out, err := exec.Command("bash", "-c", `. "$1"; echo "${A-unset} ${B-unset} ${HOME-unset}"`, "bash", dst).Output()
+	isNoErr(t, err)
+	isEqual(t, "unset 2 unset\n", string(out))
+}
+
+func TestListAccumulation(t *testing.T) {
+	em := &EnvManager{ListSeparator: ":"}
+	isNoErr(t, em.FeedReader(strings.NewReader(`name: base
+priority: 100
+env:
+  PATH: /usr/bin:/bin
+  LD_LIBRARY_PATH: /usr/lib
+---
+name: app
+priority: 110
+prepend: [PATH]
+append: ["LD_*"]
+env:
+  PATH: /opt/app/bin:/usr/bin
+  LD_LIBRARY_PATH: /opt/app/lib::/usr/lib
+---
+name: tools
+priority: 120
+append: [PATH]
+env:
+  PATH: /opt/tools/bin
+`), "frags.yaml"))
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, "/opt/app/bin:/usr/bin:/bin:/opt/tools/bin", em.Merged()["PATH"])
+	isEqual(t, "/usr/lib:/opt/app/lib", em.Merged()["LD_LIBRARY_PATH"])
+	isNoErr(t, em.InterpolateMerged(true))
+	isEqual(t, "/opt/app/bin:/usr/bin:/bin:/opt/tools/bin", em.Merged()["PATH"])
+
+	var buf bytes.Buffer
+	isNoErr(t, em.BuildBashTo(&buf))
+	isTrue(t, strings.Contains(buf.String(), "# --- Fragment: app ---\nexport LD_LIBRARY_PATH=\"/usr/lib:/opt/app/lib\"\nexport PATH=\"/opt/app/bin:/usr/bin:/bin\"\n"))
+	isTrue(t, strings.Contains(buf.String(), `export PATH="/opt/app/bin:/usr/bin:/bin:/opt/tools/bin"`))
+
+	// list keys are not collisions under StrictMerge
+	em.StrictMerge = true
+	isNoErr(t, em.SortAndMergeStrict())
+
+	isErrorWithMessage(t, em.AddFragment(&EnvFragment{Name: "both", Priority: 130, Append: []string{"PATH"}, Prepend: []string{"PATH"}}),
+		"validation failed for fragment both: key PATH is both appended and prepended")
+}
+
+func TestLastMergeStats(t *testing.T) {
+	em := &EnvManager{}
+	isEqual(t, MergeStats{}, em.LastMergeStats())
+
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "base", Priority: 100, Overridable: []string{"PORT"}, Env: map[string]string{
+		"PORT": "80",
+		"HOST": "localhost",
+	}}))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "app", Priority: 110, Env: map[string]string{
+		"PORT": "8080",
+		"HOST": "0.0.0.0",
+		"MODE": "dev",
+	}}))
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, MergeStats{Fragments: 2, Keys: 3, Assignments: 4, Overridden: 1, Blocked: 1}, em.LastMergeStats())
+
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "late", Priority: 120}))
+	isEqual(t, MergeStats{}, em.LastMergeStats())
+}
+
+func TestPlatformFragments(t *testing.T) {
+	em := &EnvManager{TargetOS: "linux", TargetArch: "amd64"}
+	isNoErr(t, em.FeedReader(strings.NewReader(`name: common
+priority: 100
+env:
+  EDITOR: vi
+---
+name: mac
+priority: 110
+os: [darwin]
+env:
+  EDITOR: open -e
+---
+name: linux-arm
+priority: 120
+os: [linux]
+arch: [arm64]
+env:
+  ARCH: arm64
+---
+name: unix
+priority: 130
+os: [linux, darwin]
+env:
+  SHELL_RC: .bashrc
+`), "platforms.yaml"))
+
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, map[string]string{"EDITOR": "vi", "SHELL_RC": ".bashrc"}, em.Merged())
+	isEqual(t, 2, em.LastMergeStats().Skipped)
+	isEqual(t, 4, len(em.Fragments()))
+	var buf bytes.Buffer
+	isNoErr(t, em.BuildBashTo(&buf))
+	isFalse(t, strings.Contains(buf.String(), "Fragment: mac"))
+
+	em.TargetOS, em.TargetArch = "darwin", "arm64"
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, map[string]string{"EDITOR": "open -e", "SHELL_RC": ".bashrc"}, em.Merged())
+
+	em.TargetOS = "linux"
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, "arm64", em.Merged()["ARCH"])
+
+	// the defaults follow the running platform
+	em.TargetOS, em.TargetArch = "", ""
+	isNoErr(t, em.SortAndMergeStrict())
+	_, isLinuxArm := em.Merged()["ARCH"]
+	isEqual(t, runtime.GOOS == "linux" && runtime.GOARCH == "arm64", isLinuxArm)
+}
+
+func TestActiveTags(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.FeedReader(strings.NewReader(`name: common
+priority: 100
+env:
+  LOG_LEVEL: info
+---
+name: dev
+priority: 110
+tags: [dev]
+env:
+  LOG_LEVEL: debug
+---
+name: gpu
+priority: 120
+tags: [gpu, ml]
+env:
+  CUDA_VISIBLE_DEVICES: "0"
+`), "tags.yaml"))
+
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, 2, len(em.Merged()))
+
+	em.SetActiveTags("prod", "ml")
+	isFalse(t, em.sorted)
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, map[string]string{"LOG_LEVEL": "info", "CUDA_VISIBLE_DEVICES": "0"}, em.Merged())
+	var buf bytes.Buffer
+	isNoErr(t, em.BuildBashTo(&buf))
+	isFalse(t, strings.Contains(buf.String(), "Fragment: dev"))
+	isTrue(t, strings.Contains(buf.String(), "Fragment: common"))
+
+	em.SetActiveTags("dev")
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, map[string]string{"LOG_LEVEL": "debug"}, em.Merged())
+
+	em.SetActiveTags()
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, 2, len(em.Merged()))
+}
+
+func TestProfile(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.FeedReader(strings.NewReader(`name: common
+priority: 100
+env:
+  APP: web
+---
+name: dev
+priority: 110
+profile: dev
+env:
+  DB_HOST: localhost
+---
+name: prod
+priority: 110
+profile: prod
+env:
+  DB_HOST: db.internal
+`), "profiles.yaml"))
+
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, map[string]string{"APP": "web"}, em.Merged())
+
+	em.SetProfile("prod")
+	isFalse(t, em.sorted)
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, map[string]string{"APP": "web", "DB_HOST": "db.internal"}, em.Merged())
+
+	results, err := em.SearchOpts("DB_HOST", SearchOptions{KeysOnly: true})
+	isNoErr(t, err)
+	isEqual(t, 2, len(results))
+	results, err = em.SearchOpts("DB_HOST", SearchOptions{KeysOnly: true, ActiveOnly: true})
+	isNoErr(t, err)
+	isEqual(t, []SearchResult{{FragmentName: "prod", Key: "DB_HOST", Value: "db.internal", InKey: true}}, results)
+}
+
+func TestKeySources(t *testing.T) {
+	em := &EnvManager{}
+	isEqual(t, []string(nil), em.KeySources("PATH"))
+	isEqual(t, map[string][]string{}, em.AllKeySources())
+
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "user", Priority: 150, Env: map[string]string{"PATH": "/home/user/bin"}}))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "base", Priority: 100, Env: map[string]string{"PATH": "/usr/bin", "LANG": "C"}}))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	isEqual(t, []string{"base", "user"}, em.KeySources("PATH"))
+	isEqual(t, []string{"base"}, em.KeySources("LANG"))
+	isEqual(t, []string(nil), em.KeySources("UNKNOWN"))
+
+	all := em.AllKeySources()
+	isEqual(t, map[string][]string{"PATH": {"base", "user"}, "LANG": {"base"}}, all)
+	all["PATH"][0] = "changed"
+	isEqual(t, []string{"base", "user"}, em.KeySources("PATH"))
+}
+
+func TestOverridable(t *testing.T) {
+	dir := t.TempDir()
+	isNoErr(t, os.WriteFile(filepath.Join(dir, "a.yaml"), []byte(`name: system
+priority: 100
+overridable: [LOG_LEVEL, "APP_*"]
+env:
+  PATH: /usr/bin
+  LOG_LEVEL: info
+  APP_MODE: prod
+---
+name: locked
+priority: 110
+overridable: []
+env:
+  LANG: C
+---
+name: user
+priority: 150
+env:
+  PATH: /home/user/bin
+  LOG_LEVEL: debug
+  APP_MODE: dev
+  LANG: en_US.UTF-8
+`), 0o644))
+
+	em := &EnvManager{}
+	isNoErr(t, em.FeedDir(dir))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	isEqual(t, map[string]string{
+		"PATH":      "/usr/bin",
+		"LOG_LEVEL": "debug",
+		"APP_MODE":  "dev",
+		"LANG":      "C",
+	}, em.Merged())
+	isEqual(t, MergeReport{BlockedOverrides: []BlockedOverride{
+		{Key: "LANG", LockedBy: "locked", Fragment: "user", Value: "en_US.UTF-8"},
+		{Key: "PATH", LockedBy: "system", Fragment: "user", Value: "/home/user/bin"},
+	}}, em.MergeReport())
+	isEqual(t, []string{"system"}, em.KeySources("PATH"))
+}
+
+func newSearchManager(tb testing.TB) *EnvManager {
+	tb.Helper()
+
+	em := &EnvManager{}
+	isNoErr(tb, em.AddFragment(&EnvFragment{Name: "base", Priority: 100, Env: map[string]string{
+		"APP_HOST": "localhost",
+		"APP_PORT": "8080",
+		"LANG":     "C",
+	}}))
+	isNoErr(tb, em.AddFragment(&EnvFragment{Name: "app", Priority: 110, Env: map[string]string{
+		"APP_MODE": "dev",
+	}, Script: []Script{{Sh: "bash", Data: `echo "$APP_HOST"`}}}))
+	isNoErr(tb, em.SortAndMergeStrict())
+	return em
+}
+
+func TestSearch(t *testing.T) {
+	em := newSearchManager(t)
+	results, err := em.Search("APP_")
+	isNoErr(t, err)
+	isEqual(t, []SearchResult{
+		{FragmentName: "base", Key: "APP_HOST", Value: "localhost", InKey: true},
+		{FragmentName: "base", Key: "APP_PORT", Value: "8080", InKey: true},
+		{FragmentName: "app", Key: "APP_MODE", Value: "dev", InKey: true},
+		{FragmentName: "app", Key: "script[bash]", Value: `echo "$APP_HOST"`, Line: 1, MatchText: "APP_"},
+	}, results)
+
+	_, err = em.Search("(")
+	isTrue(t, err != nil)
+}
+
+func TestSearchOpts(t *testing.T) {
+	em := newSearchManager(t)
+
+	results, err := em.SearchOpts("app_", SearchOptions{CaseInsensitive: true, KeysOnly: true})
+	isNoErr(t, err)
+	isEqual(t, []SearchResult{
+		{FragmentName: "base", Key: "APP_HOST", Value: "localhost", InKey: true},
+		{FragmentName: "base", Key: "APP_PORT", Value: "8080", InKey: true},
+		{FragmentName: "app", Key: "APP_MODE", Value: "dev", InKey: true},
+	}, results)
+
+	results, err = em.SearchOpts("(?i)APP_HOST", SearchOptions{CaseInsensitive: true, IncludeScripts: true, FragmentFilter: "ap*"})
+	isNoErr(t, err)
+	isEqual(t, []SearchResult{
+		{FragmentName: "app", Key: "script[bash]", Value: `echo "$APP_HOST"`, Line: 1, MatchText: "APP_HOST"},
+	}, results)
+
+	results, err = em.SearchOpts("^(dev|C)$", SearchOptions{ValuesOnly: true})
+	isNoErr(t, err)
+	isEqual(t, 2, len(results))
+
+	results, err = em.SearchOpts("LANG", SearchOptions{ValuesOnly: true})
+	isNoErr(t, err)
+	isEqual(t, 0, len(results))
+
+	_, err = em.SearchOpts("x", SearchOptions{KeysOnly: true, ValuesOnly: true})
+	isErrorWithMessage(t, err, "KeysOnly and ValuesOnly are mutually exclusive")
+	_, err = (&EnvManager{}).SearchOpts("x", SearchOptions{})
+	isErrorWithMessage(t, err, "not build complete yet")
+}
+
+func TestSearchStream(t *testing.T) {
+	em := newSearchManager(t)
+	results, errc := em.SearchStream(context.Background(), "APP_")
+	var got []SearchResult
+	for r := range results {
+		got = append(got, r)
+	}
+	isNoErr(t, <-errc)
+	want, err := em.Search("APP_")
+	isNoErr(t, err)
+	isEqual(t, want, got)
+}
+
+func TestSearchStreamCancel(t *testing.T) {
+	em := newSearchManager(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	results, errc := em.SearchStream(ctx, "APP_")
+
+	first, ok := <-results
+	isTrue(t, ok)
+	isEqual(t, "APP_HOST", first.Key)
+	cancel()
+
+	for range results {
+		// drain whatever was sent before the cancellation was observed
+	}
+	err := <-errc
+	isTrue(t, errors.Is(err, context.Canceled))
+	_, open := <-errc
+	isFalse(t, open)
+}
+
+func TestSearchStreamInvalidPattern(t *testing.T) {
+	em := newSearchManager(t)
+	results, errc := em.SearchStream(context.Background(), "(")
+	_, ok := <-results
+	isFalse(t, ok)
+	isTrue(t, <-errc != nil)
+}
+
+func TestFeedReader(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.FeedReader(strings.NewReader(`name: base
+priority: 100
+env:
+  HOST: localhost
+---
+name: app
+priority: 110
+env:
+  PORT: "8080"
+`), "embedded:base.yaml"))
+
+	frags := em.Fragments()
+	isEqual(t, 2, len(frags))
+	isEqual(t, "embedded:base.yaml", frags[0].Source)
+	isEqual(t, "embedded:base.yaml", frags[1].Source)
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, map[string]string{"HOST": "localhost", "PORT": "8080"}, em.Merged())
+}
+
+func TestFeedReaderErrors(t *testing.T) {
+	em := &EnvManager{}
+	err := em.FeedReader(strings.NewReader("name: low\npriority: 1\n"), "buffer")
+	isErrorWithMessage(t, err, "validation failed for fragment low in buffer: custom fragment low priority must >=100, got 1")
+
+	err = em.FeedReader(strings.NewReader("name: [\n"), "buffer")
+	isTrue(t, err != nil)
+	isTrue(t, strings.HasPrefix(err.Error(), "failed to parse YAML in buffer: "))
+
+	err = em.FeedFile(filepath.Join(t.TempDir(), "missing.yaml"))
+	isTrue(t, err != nil)
+	isTrue(t, strings.HasPrefix(err.Error(), "failed to read file "))
+}
+
+func TestFeedReaderEmptyDocuments(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"empty", "", nil},
+		{"comments only", "# nothing here\n", nil},
+		{"leading separator", "---\nname: a\npriority: 100\n", []string{"a"}},
+		{"trailing separator", "name: a\npriority: 100\n---\n", []string{"a"}},
+		{"blank documents", "---\n\n---\nname: a\npriority: 100\n---\n# skipped\n---\n~\n---\nname: b\npriority: 100\n", []string{"a", "b"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			em := &EnvManager{}
+			isNoErr(t, em.FeedReader(strings.NewReader(tt.input), "buffer"))
+			var names []string
+			for _, frag := range em.Fragments() {
+				names = append(names, frag.Name)
+			}
+			isEqual(t, tt.want, names)
+		})
+	}
+
+	em := &EnvManager{}
+	err := em.FeedReader(strings.NewReader("---\n- not\n- a fragment\n"), "buffer")
+	isTrue(t, err != nil)
+	isTrue(t, strings.HasPrefix(err.Error(), "failed to parse YAML in buffer: "))
+	err = em.FeedReader(strings.NewReader("---\npriority: 100\n"), "buffer")
+	isErrorWithMessage(t, err, "validation failed for fragment  in buffer: fragment must have a name")
+}
+
+func TestFeedDuplicateKeys(t *testing.T) {
+	em := &EnvManager{}
+	err := em.FeedReader(strings.NewReader(`name: app
+priority: 100
+env:
+  PORT: "80"
+  HOST: localhost
+  PORT: "8080"
+`), "app.yaml")
+	isErrorWithMessage(t, err, "failed to parse YAML in app.yaml: yaml: unmarshal errors:\n  line 6: mapping key \"PORT\" already defined at line 4")
+	isEqual(t, 0, len(em.Fragments()))
+
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "app.toml")
+	isNoErr(t, os.WriteFile(fpath, []byte("name = \"app\"\npriority = 100\n[env]\nPORT = \"80\"\nPORT = \"8080\"\n"), 0o644))
+	err = em.FeedTOML(fpath)
+	isTrue(t, err != nil)
+	isTrue(t, strings.HasPrefix(err.Error(), "failed to parse TOML in "+fpath))
+	isTrue(t, strings.Contains(err.Error(), "PORT"))
+	isEqual(t, 0, len(em.Fragments()))
+}
+
+func TestFeedDirCollect(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.yaml":    "name: ok\npriority: 100\n---\nname: low\npriority: 5\n---\nname: ok2\npriority: 110\n",
+		"b.yml":     "name: [broken\n",
+		"c.yaml":    "priority: 120\n",
+		"d.yaml":    "name: fine\npriority: 130\n",
+		"notes.txt": "ignored",
+	}
+	for name, data := range files {
+		isNoErr(t, os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644))
+	}
+
+	em := &EnvManager{}
+	errs, err := em.FeedDirCollect(dir)
+	isNoErr(t, err)
+	isEqual(t, 3, len(errs))
+	isEqual(t, "validation failed for fragment low in "+filepath.Join(dir, "a.yaml")+": custom fragment low priority must >=100, got 5", errs[0].Error())
+	isTrue(t, strings.HasPrefix(errs[1].Error(), "failed to parse YAML in "+filepath.Join(dir, "b.yml")))
+	isEqual(t, "validation failed for fragment  in "+filepath.Join(dir, "c.yaml")+": fragment must have a name", errs[2].Error())
+
+	var names []string
+	for _, frag := range em.Fragments() {
+		names = append(names, frag.Name)
+	}
+	isEqual(t, []string{"ok", "ok2", "fine"}, names)
+
+	_, err = em.FeedDirCollect(filepath.Join(dir, "missing"))
+	isTrue(t, err != nil)
+}
+
+func TestFeedDirParallel(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"notes.txt": "ignored"}
+	var want []string
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("frag%02d", i)
+		files[name+".yaml"] = fmt.Sprintf("name: %s\npriority: %d\n---\nname: %s-b\npriority: 100\n", name, 100+i, name)
+		want = append(want, name, name+"-b")
+	}
+	writeFiles(t, dir, files)
+
+	em := &EnvManager{}
+	isNoErr(t, em.FeedDirParallel(dir, 4))
+	var names []string
+	for _, frag := range em.Fragments() {
+		names = append(names, frag.Name)
+	}
+	isEqual(t, want, names)
+
+	serial := &EnvManager{}
+	isNoErr(t, serial.FeedDir(dir))
+	isNoErr(t, serial.SortAndMergeStrict())
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, serial.Merged(), em.Merged())
+}
+
+func TestFeedDirParallelErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.yaml": "name: a\npriority: 100\n",
+		"b.yaml": "name: b\npriority: 100\n---\nname: low\npriority: 5\n",
+		"c.yml":  "name: [broken\n",
+		"d.yaml": "name: d\npriority: 100\n",
+	})
+
+	em := &EnvManager{}
+	err := em.FeedDirParallel(dir, 0)
+	isTrue(t, err != nil)
+	msg := err.Error()
+	isTrue(t, strings.HasPrefix(msg, "validation failed for fragment low in "+filepath.Join(dir, "b.yaml")+": custom fragment low priority must >=100, got 5\n"))
+	isTrue(t, strings.Contains(msg, "failed to parse YAML in "+filepath.Join(dir, "c.yml")))
+
+	// failing files add none of their fragments
+	var names []string
+	for _, frag := range em.Fragments() {
+		names = append(names, frag.Name)
+	}
+	isEqual(t, []string{"a", "d"}, names)
+
+	isTrue(t, em.FeedDirParallel(filepath.Join(dir, "missing"), 2) != nil)
+}
+
+func TestFeedDirCtxCanceled(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.yaml":     "name: a\npriority: 100\n",
+		"sub/b.yaml": "name: b\npriority: 100\n",
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for name, feed := range map[string]func(*EnvManager) error{
+		"dir":       func(em *EnvManager) error { return em.FeedDirCtx(ctx, dir) },
+		"recursive": func(em *EnvManager) error { return em.FeedDirRecursiveCtx(ctx, dir) },
+		"parallel":  func(em *EnvManager) error { return em.FeedDirParallelCtx(ctx, dir, 2) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			em := &EnvManager{}
+			isTrue(t, errors.Is(feed(em), context.Canceled))
+			isEqual(t, 0, len(em.Fragments()))
+		})
+	}
+
+	em := &EnvManager{}
+	isNoErr(t, em.FeedDirRecursiveCtx(context.Background(), dir))
+	isEqual(t, 2, len(em.Fragments()))
+}
+
+func TestFragmentExtensions(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"app.fragment":   "name: app\npriority: 110\nenv:\n  PORT: \"8080\"\n",
+		"base.yaml":      "name: base\npriority: 100\nenv:\n  PORT: \"80\"\n",
+		"db.toml":        tomlFragment,
+		"notes.txt":      "not a fragment",
+		"sub/x.fragment": "name: nested\npriority: 120\n",
+	})
+	names := func(em *EnvManager) []string {
+		var names []string
+		for _, frag := range em.Fragments() {
+			names = append(names, frag.Name)
+		}
+		return names
+	}
+
+	em := &EnvManager{FragmentExtensions: []string{".yaml", "fragment"}}
+	isNoErr(t, em.FeedDir(dir))
+	isEqual(t, []string{"app", "base"}, names(em))
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, "8080", em.Merged()["PORT"])
+
+	em = &EnvManager{FragmentExtensions: []string{".fragment", ".toml"}}
+	isNoErr(t, em.FeedDirRecursive(dir))
+	isEqual(t, []string{"app", "app", "nested"}, names(em))
+	isEqual(t, filepath.Join(dir, "db.toml"), em.Fragments()[1].Source)
+
+	em = &EnvManager{FragmentExtensions: []string{".toml"}}
+	isNoErr(t, em.FeedDir(dir))
+	isEqual(t, 1, len(em.Fragments()))
+	isEqual(t, filepath.Join(dir, "db.toml"), em.Fragments()[0].Source)
+
+	em = &EnvManager{FragmentExtensions: []string{".fragment"}}
+	isNoErr(t, em.FeedDirParallel(dir, 2))
+	isEqual(t, []string{"app"}, names(em))
+}
+
+func TestFeedDirRecursive(t *testing.T) {
+	dir := t.TempDir()
+	isNoErr(t, os.MkdirAll(filepath.Join(dir, "system"), 0o755))
+	isNoErr(t, os.MkdirAll(filepath.Join(dir, "apps", "web"), 0o755))
+	write := func(rel, content string) {
+		isNoErr(t, os.WriteFile(filepath.Join(dir, rel), []byte(content), 0o644))
+	}
+	write("root.yaml", "name: root\npriority: 100\n")
+	write(filepath.Join("system", "base.yml"), "name: base\npriority: 100\n")
+	write(filepath.Join("apps", "web", "web.yaml"), "name: web\npriority: 100\n")
+	write(filepath.Join("apps", "README.md"), "not a fragment")
+
+	em := &EnvManager{}
+	isNoErr(t, em.FeedDirRecursive(dir))
+	var names []string
+	for _, frag := range em.Fragments() {
+		names = append(names, frag.Name)
+	}
+	isEqual(t, []string{"web", "root", "base"}, names)
+
+	// the non recursive variant only sees the top level
+	em = &EnvManager{}
+	isNoErr(t, em.FeedDir(dir))
+	isEqual(t, 1, len(em.Fragments()))
+
+	isTrue(t, (&EnvManager{}).FeedDirRecursive(filepath.Join(dir, "missing")) != nil)
+}
+
+func TestConcurrentUse(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "base", Priority: 100, Env: map[string]string{"PORT": "80"}}))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			name := fmt.Sprintf("frag%d", i)
+			isNoErr(t, em.FeedReader(strings.NewReader("name: "+name+"\npriority: 110\nenv:\n  PORT: \"8080\"\n"), name+".yaml"))
+			isNoErr(t, em.SortAndMergeStrict())
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			em.Search("PORT")
+			em.Merged()
+			em.KeySources("PORT")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		dst := filepath.Join(t.TempDir(), "env.sh")
+		for i := 0; i < 50; i++ {
+			em.BuildBash(dst)
+			for range em.Fragments() {
+			}
+		}
+	}()
+	wg.Wait()
+
+	isEqual(t, 51, len(em.Fragments()))
+	isEqual(t, "8080", em.Merged()["PORT"])
+}
+
+func TestIsStale(t *testing.T) {
+	dir := t.TempDir()
+	stale, err := IsStale(filepath.Join(dir, "missing.meta"), time.Hour)
+	isNoErr(t, err)
+	isTrue(t, stale)
+
+	em := &EnvManager{}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "base", Priority: 100}))
+	isNoErr(t, em.SortAndMergeStrict())
+	plain := filepath.Join(dir, "env.meta")
+	isNoErr(t, em.WriteMeta(plain))
+	manifest := filepath.Join(dir, "meta.json")
+	isNoErr(t, em.WriteMetaJSON(manifest))
+	for _, meta := range []string{plain, manifest} {
+		stale, err = IsStale(meta, time.Hour)
+		isNoErr(t, err)
+		isFalse(t, stale)
+	}
+
+	old := filepath.Join(dir, "old.meta")
+	isNoErr(t, os.WriteFile(old, []byte(time.Now().Add(-25*time.Hour).Format(time.RFC3339)), 0o644))
+	stale, err = IsStale(old, 24*time.Hour)
+	isNoErr(t, err)
+	isTrue(t, stale)
+
+	bad := filepath.Join(dir, "bad.meta")
+	isNoErr(t, os.WriteFile(bad, []byte("yesterday"), 0o644))
+	_, err = IsStale(bad, time.Hour)
+	var perr MetaParseError
+	isTrue(t, errors.As(err, &perr))
+	isEqual(t, bad, perr.Path)
+}
+
+func TestSetCTime(t *testing.T) {
+	pinned := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	build := func(fixed time.Time) (*EnvManager, string) {
+		t.Helper()
+		em := newFilterManager(t)
+		em.SetCTime(fixed)
+		isNoErr(t, em.SortAndMergeStrict())
+		var buf bytes.Buffer
+		isNoErr(t, em.BuildBashTo(&buf))
+		return em, buf.String()
+	}
+
+	em, out := build(pinned)
+	isEqual(t, pinned, em.CTime())
+	isTrue(t, strings.Contains(out, "2024-01-02T03:04:05Z"))
+	_, again := build(pinned)
+	isEqual(t, out, again)
+
+	// a zero time goes back to the merge time
+	em.SetCTime(time.Time{})
+	isEqual(t, pinned, em.CTime())
+	isNoErr(t, em.SortAndMergeStrict())
+	isTrue(t, time.Since(em.CTime()) < time.Minute)
+}
+
+func TestFragmentsCopies(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.FeedReader(strings.NewReader(`name: base
+priority: 100
+env:
+  PORT: "80"
+overridable: []
+script:
+  - sh: [bash, zsh]
+    data: echo base
+`), "base.yaml"))
+
+	frags := em.Fragments()
+	isEqual(t, "base", frags[0].Name)
+	isEqual(t, 100, frags[0].Priority)
+	isEqual(t, "base.yaml", frags[0].Source)
+	isTrue(t, frags[0].Overridable != nil)
+
+	frags[0].Name = "changed"
+	frags[0].Env["PORT"] = "8080"
+	frags[0].Script[0].Shells[0] = "pwsh"
+	frags[0].Overridable = nil
+
+	frag := em.Fragments()[0]
+	isEqual(t, "base", frag.Name)
+	isEqual(t, "80", frag.Env["PORT"])
+	isEqual(t, []string{"bash", "zsh"}, frag.Script[0].Shells)
+	isTrue(t, frag.Overridable != nil)
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, "80", em.Merged()["PORT"])
+}
+
+func TestLookup(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "base", Priority: 100, Env: map[string]string{"PORT": "80", "EMPTY": ""}}))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "app", Priority: 110, Env: map[string]string{"PORT": "8080"}}))
+
+	_, ok := em.Lookup("PORT")
+	isFalse(t, ok)
+
+	isNoErr(t, em.SortAndMergeStrict())
+	v, ok := em.Lookup("PORT")
+	isTrue(t, ok)
+	isEqual(t, "8080", v)
+	isEqual(t, "8080", em.GetValue("PORT"))
+
+	v, ok = em.Lookup("EMPTY")
+	isTrue(t, ok)
+	isEqual(t, "", v)
+	_, ok = em.Lookup("MISSING")
+	isFalse(t, ok)
+	isEqual(t, "", em.GetValue("MISSING"))
+}
+
+func TestSearchSecrets(t *testing.T) {
+	em := &EnvManager{SecretKeys: []string{"*_TOKEN"}}
+	isNoErr(t, em.FeedReader(strings.NewReader(`name: base
+priority: 100
+secrets: [DB_PASSWORD]
+env:
+  DB_HOST: db
+  DB_PASSWORD: hunter2
+---
+name: app
+priority: 110
+env:
+  DB_PASSWORD: s3cret
+  API_TOKEN: abc
+`), "secrets.yaml"))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	isTrue(t, em.IsSecret("DB_PASSWORD"))
+	isTrue(t, em.IsSecret("API_TOKEN"))
+	isFalse(t, em.IsSecret("DB_HOST"))
+
+	results, err := em.Search("DB_|TOKEN")
+	isNoErr(t, err)
+	isEqual(t, []SearchResult{
+		{FragmentName: "base", Key: "DB_HOST", Value: "db", InKey: true},
+		{FragmentName: "base", Key: "DB_PASSWORD", Value: "***", InKey: true},
+		{FragmentName: "app", Key: "API_TOKEN", Value: "***", InKey: true},
+		{FragmentName: "app", Key: "DB_PASSWORD", Value: "***", InKey: true},
+	}, results)
+
+	results, err = em.SearchOpts("PASSWORD", SearchOptions{RevealSecrets: true})
+	isNoErr(t, err)
+	isEqual(t, []SearchResult{
+		{FragmentName: "base", Key: "DB_PASSWORD", Value: "hunter2", InKey: true},
+		{FragmentName: "app", Key: "DB_PASSWORD", Value: "s3cret", InKey: true},
+	}, results)
+
+	stream, errc := em.SearchStream(context.Background(), "TOKEN")
+	for r := range stream {
+		isEqual(t, "***", r.Value)
+	}
+	isNoErr(t, <-errc)
+
+	// secrets are still written to the generated files
+	var buf bytes.Buffer
+	isNoErr(t, em.BuildBashTo(&buf))
+	isTrue(t, strings.Contains(buf.String(), `export DB_PASSWORD="s3cret"`))
+}
+
+func TestBuildMergedYAML(t *testing.T) {
+	em := &EnvManager{}
+	isTrue(t, em.ExportMergedFragment("snapshot", 100) == nil)
+	isNoErr(t, em.FeedReader(strings.NewReader(`name: base
+priority: 100
+secrets: [DB_PASSWORD]
+env:
+  PORT: "80"
+  DB_PASSWORD: hunter2
+  DEBUG: "1"
+script:
+  - sh: bash
+    data: echo base
+---
+name: app
+priority: 110
+env:
+  PORT: "8080"
+unset: [DEBUG]
+script:
+  - sh: bash
+    data: echo app
+`), "fragments.yaml"))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	frag := em.ExportMergedFragment("snapshot", 150)
+	isEqual(t, "snapshot", frag.Name)
+	isEqual(t, 150, frag.Priority)
+	isEqual(t, map[string]string{"PORT": "8080", "DB_PASSWORD": "hunter2"}, frag.Env)
+	isEqual(t, []string{"DEBUG"}, frag.Unset)
+	isEqual(t, []string{"DB_PASSWORD"}, frag.Secrets)
+	isEqual(t, 2, len(frag.Script))
+	isEqual(t, "echo base", frag.Script[0].Data)
+
+	dst := filepath.Join(t.TempDir(), "merged.yaml")
+	isNoErr(t, em.BuildMergedYAML(dst))
+	first, err := os.ReadFile(dst)
+	isNoErr(t, err)
+	isTrue(t, strings.HasPrefix(string(first), "name: merged\npriority: 100\nenv:\n    DB_PASSWORD: hunter2\n    PORT: \"8080\"\n"))
+
+	// the snapshot builds the same variables as the original fragments
+	snap := &EnvManager{}
+	isNoErr(t, snap.FeedFile(dst))
+	isNoErr(t, snap.SortAndMergeStrict())
+	isEqual(t, em.Merged(), snap.Merged())
+	isNoErr(t, snap.BuildMergedYAML(dst))
+	again, err := os.ReadFile(dst)
+	isNoErr(t, err)
+	isEqual(t, string(first), string(again))
+
+	isErrorWithMessage(t, (&EnvManager{}).BuildMergedYAML(dst), "not build complete yet")
+}
+
+func TestFeedFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"defaults/b.yaml":     {Data: []byte("name: b\npriority: 110\ninclude: [../shared/common.yaml]\nenv:\n  B: b\n")},
+		"defaults/a.yml":      {Data: []byte("name: a\npriority: 100\nenv:\n  A: a\n")},
+		"defaults/sub/c.yaml": {Data: []byte("name: c\npriority: 120\n")},
+		"defaults/d.toml":     {Data: []byte("name = \"d\"\npriority = 130\n")},
+		"defaults/README.md":  {Data: []byte("not a fragment")},
+		"shared/common.yaml":  {Data: []byte("env:\n  SHARED: shared\n")},
+	}
+	sources := func(em *EnvManager) []string {
+		var sources []string
+		for _, frag := range em.Fragments() {
+			sources = append(sources, frag.Source)
+		}
+		return sources
+	}
+
+	em := &EnvManager{}
+	isNoErr(t, em.FeedFS(fsys, "defaults"))
+	isEqual(t, []string{"defaults/a.yml", "defaults/b.yaml", "defaults/sub/c.yaml"}, sources(em))
+	isEqual(t, map[string]string{"B": "b", "SHARED": "shared"}, em.Fragments()[1].Env)
+
+	em = &EnvManager{TOMLFiles: true}
+	isNoErr(t, em.FeedFS(fsys, "defaults"))
+	isEqual(t, []string{"defaults/a.yml", "defaults/b.yaml", "defaults/d.toml", "defaults/sub/c.yaml"}, sources(em))
+
+	// the root of fsys is "."
+	sub, err := fs.Sub(fsys, "defaults/sub")
+	isNoErr(t, err)
+	em = &EnvManager{}
+	isNoErr(t, em.FeedFS(sub, "."))
+	isEqual(t, []string{"c.yaml"}, sources(em))
+
+	err = (&EnvManager{}).FeedFS(fsys, "missing")
+	isTrue(t, errors.Is(err, fs.ErrNotExist))
+}
+
+func TestFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file permissions are not supported on windows")
+	}
+	em := newFilterManager(t)
+	dir := t.TempDir()
+	mode := func(name string) os.FileMode {
+		t.Helper()
+		info, err := os.Stat(filepath.Join(dir, name))
+		isNoErr(t, err)
+		return info.Mode().Perm()
+	}
+
+	isNoErr(t, em.BuildBash(filepath.Join(dir, "env.sh")))
+	isEqual(t, os.FileMode(0o644), mode("env.sh"))
+
+	em.FileMode = 0o600
+	for name, build := range map[string]func(string) error{
+		"env.sh":     em.BuildBash,
+		"env.ps1":    em.BuildPsh,
+		".env":       em.BuildDotenv,
+		"env.json":   em.BuildJSON,
+		"env.meta":   em.WriteMeta,
+		"meta.json":  em.WriteMetaJSON,
+		"env.lock":   em.WriteLock,
+		"all.yaml":   em.SaveAllYaml,
+		"merged.yml": em.BuildMergedYAML,
+	} {
+		isNoErr(t, build(filepath.Join(dir, name)))
+		isEqual(t, os.FileMode(0o600), mode(name))
+	}
+	isNoErr(t, em.BuildAll(dir, "all"))
+	isEqual(t, os.FileMode(0o600), mode("all.zsh"))
+}
+
+func TestFeedProcessEnv(t *testing.T) {
+	t.Setenv("FEEDTEST_HOME", "/home/dev")
+	t.Setenv("FEEDTEST_PORT", "80")
+	t.Setenv("OTHERTEST_X", "x")
+
+	em := &EnvManager{}
+	isNoErr(t, em.FeedProcessEnv("process", 100, "FEEDTEST_"))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "app", Priority: 110, Env: map[string]string{
+		"FEEDTEST_PORT": "8080",
+		"CACHE":         "$FEEDTEST_HOME/.cache",
+	}}))
+	frag := em.Fragments()[0]
+	isEqual(t, "process", frag.Source)
+	isEqual(t, map[string]string{"FEEDTEST_HOME": "/home/dev", "FEEDTEST_PORT": "80"}, frag.Env)
+
+	isNoErr(t, em.SortAndMergeStrict())
+	isNoErr(t, em.InterpolateMerged(true))
+	isEqual(t, map[string]string{
+		"FEEDTEST_HOME": "/home/dev",
+		"FEEDTEST_PORT": "8080",
+		"CACHE":         "/home/dev/.cache",
+	}, em.Merged())
+
+	em = &EnvManager{}
+	isNoErr(t, em.FeedProcessEnv("process", 100))
+	isEqual(t, "x", em.Fragments()[0].Env["OTHERTEST_X"])
+
+	em = &EnvManager{}
+	isErrorWithMessage(t, em.FeedProcessEnv("process", 5),
+		"validation failed for fragment process: custom fragment process priority must >=100, got 5")
+}
+
+func TestFragmentPrefix(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.FeedReader(strings.NewReader(`name: app
+priority: 100
+prefix: APP_
+overridable: [HOST]
+secrets: [TOKEN]
+env:
+  PORT: "8080"
+  HOST: localhost
+  TOKEN: abc
+---
+name: db
+priority: 100
+prefix: DB_
+env:
+  PORT: "5432"
+---
+name: ops
+priority: 110
+env:
+  APP_HOST: app.internal
+  APP_PORT: "9090"
+`), "teams.yaml"))
+
+	frag := em.Fragments()[0]
+	isEqual(t, "APP_", frag.Prefix)
+	isEqual(t, map[string]string{"APP_PORT": "8080", "APP_HOST": "localhost", "APP_TOKEN": "abc"}, frag.Env)
+	isEqual(t, []string{"APP_HOST"}, frag.Overridable)
+
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, map[string]string{
+		"APP_PORT":  "8080", // locked by overridable
+		"APP_HOST":  "app.internal",
+		"APP_TOKEN": "abc",
+		"DB_PORT":   "5432",
+	}, em.Merged())
+	isEqual(t, []string{"app", "ops"}, em.KeySources("APP_HOST"))
+	isTrue(t, em.IsSecret("APP_TOKEN"))
+
+	results, err := em.SearchOpts("PORT", SearchOptions{KeysOnly: true})
+	isNoErr(t, err)
+	isEqual(t, []SearchResult{
+		{FragmentName: "app", Key: "APP_PORT", Value: "8080", InKey: true},
+		{FragmentName: "db", Key: "DB_PORT", Value: "5432", InKey: true},
+		{FragmentName: "ops", Key: "APP_PORT", Value: "9090", InKey: true},
+	}, results)
+
+	// the caller's fragment keeps its own keys, whether rejected or added
+	// several times
+	web := &EnvFragment{Name: "web", Priority: 1, Prefix: "WEB_", Env: map[string]string{"PORT": "80"}}
+	em = &EnvManager{}
+	isTrue(t, em.AddFragment(web) != nil)
+	web.Priority = 100
+	isNoErr(t, em.AddFragment(web))
+	isNoErr(t, em.AddFragment(web))
+	isEqual(t, map[string]string{"PORT": "80"}, web.Env)
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, map[string]string{"WEB_PORT": "80"}, em.Merged())
+}
+
+func TestCheckRequired(t *testing.T) {
+	const fragments = `name: app
+priority: 100
+required: [API_KEY, DB_URL, HOST]
+env:
+  HOST: localhost
+---
+name: db
+priority: 110
+required: [DB_URL]
+env:
+  API_KEY: ""
+`
+	em := &EnvManager{}
+	isNoErr(t, em.FeedReader(strings.NewReader(fragments), "fragments.yaml"))
+	isErrorWithMessage(t, em.CheckRequired(), "not build complete yet")
+	isNoErr(t, em.SortAndMergeStrict())
+	isErrorWithMessage(t, em.CheckRequired(), "required keys missing or empty: API_KEY (app), DB_URL (app, db)")
+
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "secrets", Priority: 120, Env: map[string]string{"API_KEY": "k", "DB_URL": "postgres://"}}))
+	isNoErr(t, em.SortAndMergeStrict())
+	isNoErr(t, em.CheckRequired())
+
+	em = &EnvManager{StrictRequired: true}
+	isNoErr(t, em.FeedReader(strings.NewReader(fragments), "fragments.yaml"))
+	isErrorWithMessage(t, em.SortAndMergeStrict(), "required keys missing or empty: API_KEY (app), DB_URL (app, db)")
+	isErrorWithMessage(t, em.BuildBash(filepath.Join(t.TempDir(), "env.sh")), "not build complete yet")
+}
+
+func TestFragmentDefaults(t *testing.T) {
+	em := &EnvManager{DotenvSections: true}
+	isNoErr(t, em.FeedReader(strings.NewReader(`name: base
+priority: 100
+defaults:
+  PORT: "80"
+  LOG_LEVEL: info
+  CACHE: $HOME/.cache
+  DEBUG: "0"
+---
+name: app
+priority: 110
+env:
+  HOME: /home/app
+  PORT: "8080"
+defaults:
+  LOG_LEVEL: warn
+---
+name: ci
+priority: 120
+unset: [DEBUG]
+`), "fragments.yaml"))
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, map[string]string{
+		"HOME":      "/home/app",
+		"PORT":      "8080", // set by a lower priority fragment than the default
+		"LOG_LEVEL": "warn",
+		"CACHE":     "$HOME/.cache",
+	}, em.Merged())
+	isEqual(t, []string{"base"}, em.KeySources("CACHE"))
+
+	var buf bytes.Buffer
+	isNoErr(t, em.BuildBashTo(&buf))
+	out := buf.String()
+	isTrue(t, strings.Contains(out, "# --- Fragment: base ---\nexport CACHE=\"\\$HOME/.cache\"\n\n"))
+	isTrue(t, strings.Contains(out, "export PORT=\"8080\"\nexport LOG_LEVEL=\"warn\"\n"))
+	isFalse(t, strings.Contains(out, "PORT=\"80\""))
+	isFalse(t, strings.Contains(out, "info"))
+
+	dst := filepath.Join(t.TempDir(), ".env")
+	isNoErr(t, em.BuildDotenv(dst))
+	data, err := os.ReadFile(dst)
+	isNoErr(t, err)
+	isTrue(t, strings.Contains(string(data), "# --- Fragment: app ---\nHOME=/home/app\nLOG_LEVEL=warn\nPORT=8080\n"))
+
+	isNoErr(t, em.InterpolateMerged(true))
+	isEqual(t, "/home/app/.cache", em.GetValue("CACHE"))
+
+	err = em.AddFragment(&EnvFragment{Name: "bad", Priority: 100, Env: map[string]string{"A": "1"}, Defaults: map[string]string{"A": "2"}})
+	isErrorWithMessage(t, err, "validation failed for fragment bad: key A is both set and defaulted")
+}
+
+func TestHeaderFooter(t *testing.T) {
+	em := newFilterManager(t)
+	em.Header = "Copyright (C) Example Corp.\n\n# keep this line\nLicensed under MIT\n"
+	em.Footer = "END GENERATED"
+
+	var bash bytes.Buffer
+	isNoErr(t, em.BuildBashTo(&bash))
+	isTrue(t, strings.HasPrefix(bash.String(), "# Copyright (C) Example Corp.\n#\n# keep this line\n# Licensed under MIT\n# Env generated at "))
+	isTrue(t, strings.HasSuffix(bash.String(), "\n# END GENERATED\n"))
+
+	em.Header = "rem already formatted\nremember to source this"
+	var cmd bytes.Buffer
+	isNoErr(t, em.BuildCmdTo(&cmd))
+	isTrue(t, strings.HasPrefix(cmd.String(), "rem already formatted\nrem remember to source this\nrem Env generated at "))
+	isTrue(t, strings.HasSuffix(cmd.String(), "\nrem END GENERATED\n"))
+
+	dst := filepath.Join(t.TempDir(), ".env")
+	isNoErr(t, em.BuildDotenv(dst))
+	data, err := os.ReadFile(dst)
+	isNoErr(t, err)
+	isTrue(t, strings.HasPrefix(string(data), "# rem already formatted\n# remember to source this\nENV_CTIME="))
+	isTrue(t, strings.HasSuffix(string(data), "\n# END GENERATED\n"))
+}
+
+func TestFragmentComment(t *testing.T) {
+	em := &EnvManager{DotenvSections: true}
+	isNoErr(t, em.FeedReader(strings.NewReader(`name: proxy
+priority: 100
+comment: |
+  Corporate proxy settings.
+  Ask ops before changing.
+env:
+  HTTP_PROXY: http://proxy:3128
+---
+name: plain
+priority: 110
+env:
+  A: a
+`), "frags.yaml"))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	var bash, cmd bytes.Buffer
+	isNoErr(t, em.BuildBashTo(&bash))
+	isTrue(t, strings.Contains(bash.String(), "# --- Fragment: proxy ---\n# Corporate proxy settings.\n# Ask ops before changing.\nexport HTTP_PROXY="))
+	isTrue(t, strings.Contains(bash.String(), "# --- Fragment: plain ---\nexport A="))
+	isNoErr(t, em.BuildCmdTo(&cmd))
+	isTrue(t, strings.Contains(cmd.String(), "rem --- Fragment: proxy ---\nrem Corporate proxy settings.\nrem Ask ops before changing.\nset "))
+
+	dst := filepath.Join(t.TempDir(), ".env")
+	isNoErr(t, em.BuildDotenv(dst))
+	data, err := os.ReadFile(dst)
+	isNoErr(t, err)
+	isTrue(t, strings.Contains(string(data), "# --- Fragment: proxy ---\n# Corporate proxy settings.\n# Ask ops before changing.\nHTTP_PROXY="))
+}
+
+func TestShellEnv(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.FeedReader(strings.NewReader(`name: base
+priority: 100
+env:
+  SEP: ":"
+  TOOLS: /opt/tools
+shell_env:
+  pwsh:
+    SEP: ";"
+  cmd:
+    TOOLS: C:\tools
+`), "base.yaml"))
+	isNoErr(t, em.AddFragment(&EnvFragment{
+		Name:     "app",
+		Priority: 110,
+		Prefix:   "APP_",
+		Env:      map[string]string{"HOME": "/srv/app"},
+		ShellEnv: map[string]map[string]string{"powershell": {"HOME": `C:\app`}},
+	}))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	// the generic view uses the default values
+	isEqual(t, map[string]string{"SEP": ":", "TOOLS": "/opt/tools", "APP_HOME": "/srv/app"}, em.Merged())
+
+	var bash, pwsh, cmd bytes.Buffer
+	isNoErr(t, em.BuildBashTo(&bash))
+	isNoErr(t, em.BuildPshTo(&pwsh))
+	isNoErr(t, em.BuildCmdTo(&cmd))
+	isTrue(t, strings.Contains(bash.String(), "export SEP=\":\"\n"))
+	isTrue(t, strings.Contains(pwsh.String(), "$Env:SEP = \";\"\n"))
+	isTrue(t, strings.Contains(pwsh.String(), "$Env:APP_HOME = \"C:\\app\"\n"))
+	isTrue(t, strings.Contains(pwsh.String(), "$Env:TOOLS = \"/opt/tools\"\n"))
+	isTrue(t, strings.Contains(cmd.String(), "set \"TOOLS=C:\\tools\"\n"))
+
+	merged := em.ExportMergedFragment("merged", 100)
+	isEqual(t, map[string]map[string]string{
+		"pwsh":       {"SEP": ";"},
+		"cmd":        {"TOOLS": `C:\tools`},
+		"powershell": {"APP_HOME": `C:\app`},
+	}, merged.ShellEnv)
+
+	before, err := em.Hash()
+	isNoErr(t, err)
+	em.RemoveFragment("app")
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "app", Priority: 110, Env: map[string]string{"APP_HOME": "/srv/app"}}))
+	isNoErr(t, em.SortAndMergeStrict())
+	after, err := em.Hash()
+	isNoErr(t, err)
+	isTrue(t, before != after)
+}
+
+func TestShellEnvValidation(t *testing.T) {
+	for _, tt := range []struct {
+		frag *EnvFragment
+		want string
+	}{
+		{
+			&EnvFragment{Env: map[string]string{"A": "a"}, ShellEnv: map[string]map[string]string{"fish": {"A": "b"}}},
+			`shell_env has unknown shell "fish"`,
+		},
+		{
+			&EnvFragment{Env: map[string]string{"A": "a"}, ShellEnv: map[string]map[string]string{"pwsh": {"B": "b"}}},
+			"key B has a pwsh override but is not set",
+		},
+		{
+			&EnvFragment{Env: map[string]string{"PATH": "/bin"}, Append: []string{"PATH"}, ShellEnv: map[string]map[string]string{"bash": {"PATH": "/usr/bin"}}},
+			"key PATH is a list variable and cannot have a bash override",
+		},
+	} {
+		tt.frag.Name, tt.frag.Priority = "f", 100
+		em := &EnvManager{}
+		isErrorWithMessage(t, em.AddFragment(tt.frag), "validation failed for fragment f: "+tt.want)
+	}
+}
+
+func TestFragmentEnabled(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.FeedReader(strings.NewReader(`name: base
+priority: 100
+env:
+  MODE: stable
+---
+name: experimental
+priority: 110
+enabled: false
+env:
+  MODE: experimental
+  FEATURE: "on"
+`), "frags.yaml"))
+	// disabled fragments are still validated
+	isErrorWithMessage(t, em.FeedReader(strings.NewReader("name: off\npriority: 5\nenabled: false\n"), "off.yaml"),
+		"validation failed for fragment off in off.yaml: custom fragment off priority must >=100, got 5")
+
+	frags := em.Fragments()
+	isTrue(t, frags[0].IsEnabled())
+	isFalse(t, frags[1].IsEnabled())
+
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, map[string]string{"MODE": "stable"}, em.Merged())
+	var buf bytes.Buffer
+	isNoErr(t, em.BuildBashTo(&buf))
+	isFalse(t, strings.Contains(buf.String(), "experimental"))
+
+	results, err := em.Search("MODE")
+	isNoErr(t, err)
+	isEqual(t, []SearchResult{{FragmentName: "base", Key: "MODE", Value: "stable", InKey: true}}, results)
+	results, err = em.SearchOpts("MODE", SearchOptions{IncludeDisabled: true})
+	isNoErr(t, err)
+	isEqual(t, 2, len(results))
+	isEqual(t, "experimental", results[1].FragmentName)
+}
+
+func TestCtimeKey(t *testing.T) {
+	em := &EnvManager{CtimeKey: "GENERATED_AT"}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "app", Priority: 100, Env: map[string]string{"ENV_CTIME": "mine"}}))
+	em.SetCTime(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	dir := t.TempDir()
+	var bash bytes.Buffer
+	isNoErr(t, em.BuildBashTo(&bash))
+	isTrue(t, strings.Contains(bash.String(), `export GENERATED_AT="2024-05-01T12:00:00Z"`))
+	isTrue(t, strings.Contains(bash.String(), `export ENV_CTIME="mine"`))
+
+	dotenv := filepath.Join(dir, ".env")
+	isNoErr(t, em.BuildDotenv(dotenv))
+	data, err := os.ReadFile(dotenv)
+	isNoErr(t, err)
+	isEqual(t, "GENERATED_AT=2024-05-01T12:00:00Z\nENV_CTIME=mine\n", string(data))
+
+	em.NoCtime = true
+	bash.Reset()
+	isNoErr(t, em.BuildBashTo(&bash))
+	isFalse(t, strings.Contains(bash.String(), "GENERATED_AT"))
+	isFalse(t, strings.Contains(bash.String(), "generated at"))
+
+	isNoErr(t, em.BuildDotenv(dotenv))
+	data, err = os.ReadFile(dotenv)
+	isNoErr(t, err)
+	isEqual(t, "ENV_CTIME=mine\n", string(data))
+
+	js := filepath.Join(dir, "env.json")
+	isNoErr(t, em.BuildNodeEnvJSON(js, ""))
+	data, err = os.ReadFile(js)
+	isNoErr(t, err)
+	isEqual(t, "{\n  \"ENV_CTIME\": \"mine\"\n}\n", string(data))
+}
+
+func TestSortTieBreak(t *testing.T) {
+	frags := []*EnvFragment{
+		{Name: "b", Priority: 100, Env: map[string]string{"K": "b"}},
+		{Name: "a", Priority: 100, Source: "z.yaml", Env: map[string]string{"K": "a-z"}},
+		{Name: "a", Priority: 100, Source: "y.yaml", Env: map[string]string{"K": "a-y"}},
+		{Name: "c", Priority: 100, Env: map[string]string{"K": "c"}},
+		{Name: "low", Priority: 50},
+	}
+	var orders [][]string
+	for _, perm := range [][]int{{0, 1, 2, 3, 4}, {4, 3, 2, 1, 0}, {2, 0, 4, 1, 3}} {
+		em := &EnvManager{LenientPriorities: true}
+		for _, i := range perm {
+			f := *frags[i]
+			isNoErr(t, em.AddFragment(&f))
+		}
+		var order []string
+		for _, frag := range em.SortedFragments() {
+			order = append(order, frag.Name+":"+frag.Source)
+		}
+		orders = append(orders, order)
+
+		isNoErr(t, em.SortAndMergeStrict())
+		isEqual(t, "c", em.Merged()["K"])
+		isEqual(t, []string{"a", "a", "b", "c"}, em.KeySources("K"))
+	}
+	isEqual(t, []string{"low:", "a:y.yaml", "a:z.yaml", "b:", "c:"}, orders[0])
+	isEqual(t, orders[0], orders[1])
+	isEqual(t, orders[0], orders[2])
+}
+
+func TestSaveAllYamlComments(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.FeedReader(strings.NewReader(`# Proxy settings for the office network.
+name: proxy
+priority: 100
+env:
+  # the corporate proxy
+  HTTP_PROXY: http://proxy:3128
+  NO_PROXY: localhost # keep loopback direct
+script:
+  # announce the proxy
+  - sh: bash
+    data: echo proxy
+`), "proxy.yaml"))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "plain", Priority: 110, Env: map[string]string{"A": "a"}}))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	dir := t.TempDir()
+	saved := filepath.Join(dir, "all.yaml")
+	isNoErr(t, em.SaveAllYaml(saved))
+	data, err := os.ReadFile(saved)
+	isNoErr(t, err)
+	for _, comment := range []string{
+		"# Proxy settings for the office network.",
+		"# the corporate proxy\n",
+		"NO_PROXY: localhost # keep loopback direct\n",
+		"# announce the proxy\n",
+	} {
+		isTrue(t, strings.Contains(string(data), comment))
+	}
+
+	// comments added to the saved file survive loading and saving it again
+	edited := "# Saved environment, edit with care.\n" + strings.Replace(string(data), "      A: a\n", "      A: a # set by hand\n", 1)
+	isNoErr(t, os.WriteFile(saved, []byte(edited), 0o644))
+	loaded := &EnvManager{}
+	isNoErr(t, loaded.LoadAllYaml(saved))
+	resaved := filepath.Join(dir, "resaved.yaml")
+	isNoErr(t, loaded.SaveAllYaml(resaved))
+	data, err = os.ReadFile(resaved)
+	isNoErr(t, err)
+	isTrue(t, strings.HasPrefix(string(data), "# Saved environment, edit with care.\n"))
+	isTrue(t, strings.Contains(string(data), "A: a # set by hand\n"))
+	isTrue(t, strings.Contains(string(data), "# the corporate proxy\n"))
+	isEqual(t, em.Merged(), loaded.Merged())
+}
+
+func TestAnnotate(t *testing.T) {
+	em := &EnvManager{Annotate: true}
+	isNoErr(t, em.AddFragment(&EnvFragment{
+		Name:     "base",
+		Priority: 100,
+		Env:      map[string]string{"PORT": "80", "HOST": "localhost", "OLD": "x"},
+		Defaults: map[string]string{"LEVEL": "info"},
+	}))
+	isNoErr(t, em.AddFragment(&EnvFragment{
+		Name:     "user_service",
+		Priority: 110,
+		Env:      map[string]string{"PORT": "8080"},
+		Unset:    []string{"OLD"},
+	}))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	var bash, cmd bytes.Buffer
+	isNoErr(t, em.BuildBashTo(&bash))
+	for _, line := range []string{
+		`export HOST="localhost" # from base`,
+		`export PORT="80" # from base, overridden by user_service`,
+		`export OLD="x" # from base, unset by user_service`,
+		`export LEVEL="info" # default from base`,
+		`export PORT="8080" # from user_service`,
+		"unset OLD\n",
+	} {
+		isTrue(t, strings.Contains(bash.String(), line))
+	}
+	isNoErr(t, em.BuildCmdTo(&cmd))
+	isTrue(t, strings.Contains(cmd.String(), "rem from user_service\nset \"PORT=8080\"\n"))
+
+	dir := t.TempDir()
+	dotenv := filepath.Join(dir, ".env")
+	isNoErr(t, em.BuildDotenv(dotenv))
+	data, err := os.ReadFile(dotenv)
+	isNoErr(t, err)
+	isTrue(t, strings.Contains(string(data), "# from base\nHOST=localhost\n# default from base\nLEVEL=info\n# from user_service\nPORT=8080\n"))
+
+	// annotated files still parse
+	sh := filepath.Join(dir, "env.sh")
+	isNoErr(t, em.BuildBash(sh))
+	frag, err := ParseBash(sh)
+	isNoErr(t, err)
+	isEqual(t, "8080", frag.Env["PORT"])
+	parsed, err := ParseDotenv(dotenv)
+	isNoErr(t, err)
+	isEqual(t, em.Merged(), parsed.Env)
+}
+
+func TestFeedGlob(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"env.b.yaml":      "name: b\npriority: 110\n",
+		"env.a.yaml":      "name: a\npriority: 110\n",
+		"env.c.toml":      "name = \"c\"\npriority = 120\n",
+		"ci.yaml":         "stages: [build]\n",
+		"env.dir.yaml/x":  "not a fragment",
+		"other/env.d.yml": "name: d\npriority: 100\n",
+	})
+
+	em := &EnvManager{}
+	isNoErr(t, em.FeedGlob(filepath.Join(dir, "env.*")))
+	var names []string
+	for _, frag := range em.Fragments() {
+		names = append(names, frag.Name)
+	}
+	isEqual(t, []string{"a", "b", "c"}, names)
+
+	isNoErr(t, em.FeedGlob(filepath.Join(dir, "missing", "*.yaml")))
+	isEqual(t, 3, len(em.Fragments()))
+	isErrorWithMessage(t, em.FeedGlob("[x"), `invalid pattern "[x": syntax error in pattern`)
+	isTrue(t, em.FeedGlob(filepath.Join(dir, "*.yaml")) != nil) // ci.yaml has no name
+}
+
+func TestBuildToStdout(t *testing.T) {
+	var out bytes.Buffer
+	stdout = &out
+	t.Cleanup(func() { stdout = os.Stdout })
+	t.Chdir(t.TempDir())
+
+	em := newFilterManager(t)
+	isNoErr(t, em.BuildBash(StdoutPath))
+	var want bytes.Buffer
+	isNoErr(t, em.BuildBashTo(&want))
+	isEqual(t, want.String(), out.String())
+
+	out.Reset()
+	isNoErr(t, em.BuildDotenv("-"))
+	isTrue(t, strings.HasPrefix(out.String(), "ENV_CTIME="))
+	out.Reset()
+	isNoErr(t, em.BuildJSON("-"))
+	isTrue(t, strings.HasPrefix(out.String(), "{\n"))
+
+	_, err := os.Stat("-")
+	isTrue(t, os.IsNotExist(err))
+}
+
+func TestAbsorb(t *testing.T) {
+	base := &EnvManager{}
+	isNoErr(t, base.AddFragment(&EnvFragment{Name: "base", Priority: 100, Env: map[string]string{"PORT": "80", "HOST": "localhost"}}))
+	isNoErr(t, base.AddFragment(&EnvFragment{Name: "team", Priority: 300, Env: map[string]string{"HOST": "team.local"}}))
+	overlay := &EnvManager{}
+	isNoErr(t, overlay.AddFragment(&EnvFragment{Name: "local", Priority: 200, Env: map[string]string{"PORT": "8080", "HOST": "127.0.0.1"}}))
+
+	isNoErr(t, base.SortAndMergeStrict())
+	base.Absorb(overlay)
+	base.Absorb(base)
+	base.Absorb(nil)
+	isEqual(t, 3, len(base.Fragments()))
+
+	// the merge is invalidated until SortAndMerge runs again
+	isErrorWithMessage(t, base.BuildBashTo(io.Discard), "not build complete yet")
+	isNoErr(t, base.SortAndMergeStrict())
+	isEqual(t, "8080", base.Merged()["PORT"])
+	isEqual(t, "team.local", base.Merged()["HOST"])
+
+	// the absorbed fragments are copies
+	base.fragments[1].Env["PORT"] = "9090"
+	isEqual(t, "8080", overlay.Fragments()[0].Env["PORT"])
+}
+
+func TestFragmentEffect(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.AddFragment(&EnvFragment{
+		Name:     "base",
+		Priority: 100,
+		Env:      map[string]string{"PORT": "80", "HOST": "localhost", "DEBUG": "0"},
+		Defaults: map[string]string{"LANG": "C"},
+	}))
+	isNoErr(t, em.AddFragment(&EnvFragment{
+		Name:     "local",
+		Priority: 200,
+		Env:      map[string]string{"PORT": "8080"},
+		Unset:    []string{"DEBUG"},
+	}))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "stale", Priority: 150, Env: map[string]string{"HOST": "old"}}))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "top", Priority: 300, Env: map[string]string{"HOST": "example.com"}}))
+
+	won, shadowed := em.FragmentEffect("base")
+	isTrue(t, won == nil && shadowed == nil)
+
+	isNoErr(t, em.SortAndMergeStrict())
+	won, shadowed = em.FragmentEffect("base")
+	isEqual(t, []string{"LANG"}, won)
+	isEqual(t, []string{"DEBUG", "HOST", "PORT"}, shadowed)
+	won, shadowed = em.FragmentEffect("local")
+	isEqual(t, []string{"PORT"}, won)
+	isEqual(t, 0, len(shadowed))
+	won, shadowed = em.FragmentEffect("stale")
+	isEqual(t, 0, len(won))
+	isEqual(t, []string{"HOST"}, shadowed)
+
+	won, shadowed = em.FragmentEffect("missing")
+	isTrue(t, won == nil && shadowed == nil)
+}
+
+func TestAppendOutput(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "profile.sh")
+	isNoErr(t, os.WriteFile(dst, []byte("# shared profile\n"), 0o644))
+
+	for _, name := range []string{"first", "second"} {
+		em := &EnvManager{AppendOutput: true, Header: "header", Footer: "end of " + name}
+		isNoErr(t, em.AddFragment(&EnvFragment{Name: name, Priority: 100, Env: map[string]string{"FROM_" + strings.ToUpper(name): "1"}}))
+		isNoErr(t, em.SortAndMergeStrict())
+		isNoErr(t, em.BuildBash(dst))
+	}
+	data, err := os.ReadFile(dst)
+	isNoErr(t, err)
+	isEqual(t, `# shared profile
+# --- Fragment: first ---
+export FROM_FIRST="1"
+
+# end of first
+# --- Fragment: second ---
+export FROM_SECOND="1"
+
+# end of second
+`, string(data))
+
+	em := &EnvManager{AppendOutput: true}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "app", Priority: 100, Env: map[string]string{"PORT": "80"}}))
+	isNoErr(t, em.SortAndMergeStrict())
+	dotenv := filepath.Join(t.TempDir(), ".env")
+	isNoErr(t, em.BuildDotenv(dotenv))
+	isNoErr(t, em.BuildDotenv(dotenv))
+	data, err = os.ReadFile(dotenv)
+	isNoErr(t, err)
+	isEqual(t, "PORT=80\nPORT=80\n", string(data))
+}
+
+func TestSearchMatchPosition(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.AddFragment(&EnvFragment{
+		Name:     "app",
+		Priority: 100,
+		Env:      map[string]string{"HOST_URL": "http://host", "PORT": "80"},
+		Script:   []Script{{Sh: "bash", Data: "set -e\nif true; then\n  export URL=http://host\nfi\n"}},
+	}))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	results, err := em.Search("host|HOST")
+	isNoErr(t, err)
+	isEqual(t, []SearchResult{
+		{FragmentName: "app", Key: "HOST_URL", Value: "http://host", InKey: true, InValue: true},
+		{FragmentName: "app", Key: "script[bash]", Value: "set -e\nif true; then\n  export URL=http://host\nfi\n", Line: 3, MatchText: "host"},
+	}, results)
+
+	results, err = em.SearchOpts("^80$", SearchOptions{})
+	isNoErr(t, err)
+	isEqual(t, []SearchResult{{FragmentName: "app", Key: "PORT", Value: "80", InValue: true}}, results)
+}
+
+func TestLocalVariables(t *testing.T) {
+	em := &EnvManager{NoCtime: true}
+	isNoErr(t, em.AddFragment(&EnvFragment{
+		Name:     "app",
+		Priority: 100,
+		Prefix:   "APP_",
+		Env:      map[string]string{"PORT": "80", "TMP_DIR": "/tmp/app"},
+		Defaults: map[string]string{"TMP_MODE": "fast"},
+		Local:    []string{"TMP_*"},
+	}))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	for _, tt := range []struct {
+		build func(io.Writer) error
+		want  []string
+	}{
+		{em.BuildBashTo, []string{"export APP_PORT=\"80\"\n", "\nAPP_TMP_DIR=\"/tmp/app\"\n", "\nAPP_TMP_MODE=\"fast\"\n"}},
+		{em.BuildPshTo, []string{"$Env:APP_PORT = \"80\"\n", "\n$APP_TMP_DIR = \"/tmp/app\"\n"}},
+		{em.BuildNuTo, []string{"$env.APP_PORT = \"80\"\n", "\nlet APP_TMP_DIR = \"/tmp/app\"\n"}},
+		{em.BuildCmdTo, []string{"set \"APP_PORT=80\"\n", "set \"APP_TMP_DIR=/tmp/app\"\n"}},
+	} {
+		var buf bytes.Buffer
+		isNoErr(t, tt.build(&buf))
+		for _, want := range tt.want {
+			isTrue(t, strings.Contains(buf.String(), want))
+		}
+	}
+	isEqual(t, []string{"APP_TMP_DIR", "APP_TMP_MODE"}, em.ExportMergedFragment("merged", 100).Local)
+
+	requireShell(t, "bash")
+	dst := filepath.Join(t.TempDir(), "env.sh")
+	isNoErr(t, em.BuildBash(dst))
+	out, err := exec.Command("bash", "-c", `. "$1"; echo "$APP_TMP_DIR"; bash -c 'echo "$APP_PORT:$APP_TMP_DIR"'`, "bash", dst).Output()
+	isNoErr(t, err)
+	isEqual(t, "/tmp/app\n80:\n", string(out))
+}
+
+func TestFeedSameFileTwice(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"app.yaml": "name: app\npriority: 100\nenv:\n  PORT: \"80\"\nscript:\n  - sh: bash\n    data: echo setup\n---\nname: extra\npriority: 110\n",
+		"db.yaml":  "name: db\npriority: 120\n",
+	})
+	app := filepath.Join(dir, "app.yaml")
+
+	em := &EnvManager{}
+	isNoErr(t, em.FeedFile(app))
+	isNoErr(t, em.FeedFile(app))
+	isNoErr(t, em.FeedDir(dir))
+	isNoErr(t, em.FeedDirParallel(dir, 2))
+	var names []string
+	for _, frag := range em.Fragments() {
+		names = append(names, frag.Name)
+	}
+	isEqual(t, []string{"app", "extra", "db"}, names)
+
+	isNoErr(t, em.SortAndMergeStrict())
+	var buf bytes.Buffer
+	isNoErr(t, em.BuildBashTo(&buf))
+	isEqual(t, 1, strings.Count(buf.String(), "echo setup"))
+
+	// fragments without a source are never duplicates
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "mem", Priority: 100}))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "mem", Priority: 100}))
+	isEqual(t, 5, len(em.Fragments()))
+
+	em = &EnvManager{StrictDuplicates: true}
+	isNoErr(t, em.FeedFile(app))
+	dotted := dir + "/./app.yaml"
+	isErrorWithMessage(t, em.FeedFile(dotted),
+		fmt.Sprintf("validation failed for fragment app in %s: fragment app from %s is already loaded", dotted, dotted))
+	err := em.FeedDirParallel(dir, 2)
+	isErrorWithMessage(t, err, fmt.Sprintf("validation failed for fragment app in %s: fragment app from %s is already loaded", app, app))
+	isEqual(t, 3, len(em.Fragments()))
+}
@@ -0,0 +1,54 @@
+// Copyright (C) Kumo inc. and its affiliates.
+// Author: Jeff.li lijippy@163.com
+// All rights reserved.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package env
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ParseFragmentNodes parses the fragment file at fpath into its raw YAML
+// document nodes, one per document, without decoding them into EnvFragment.
+// The nodes keep comments and line and column positions, which tooling such
+// as linters and editors can use to report precise locations or rewrite the
+// file without losing formatting.
+func ParseFragmentNodes(fpath string) ([]*yaml.Node, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", fpath, err)
+	}
+	defer f.Close()
+
+	var docs []*yaml.Node
+	dec := yaml.NewDecoder(f)
+	for {
+		var doc yaml.Node
+		if err := dec.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("failed to parse YAML in %s: %w", fpath, err)
+		}
+		docs = append(docs, &doc)
+	}
+	return docs, nil
+}
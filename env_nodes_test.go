@@ -0,0 +1,49 @@
+package env
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseFragmentNodes(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "app.yaml")
+	isNoErr(t, os.WriteFile(fpath, []byte(`# application settings
+name: app
+priority: 100
+env:
+  PORT: "8080" # default port
+---
+name: late
+priority: 120
+`), 0o644))
+
+	docs, err := ParseFragmentNodes(fpath)
+	isNoErr(t, err)
+	isEqual(t, 2, len(docs))
+
+	root := docs[0].Content[0]
+	isEqual(t, yaml.MappingNode, root.Kind)
+	isEqual(t, "# application settings", root.Content[0].HeadComment)
+
+	env := root.Content[5]
+	port := env.Content[1]
+	isEqual(t, "8080", port.Value)
+	isEqual(t, 5, port.Line)
+	isEqual(t, 9, port.Column)
+	isEqual(t, "# default port", port.LineComment)
+
+	isEqual(t, 7, docs[1].Content[0].Line)
+}
+
+func TestParseFragmentNodesInvalid(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "bad.yaml")
+	isNoErr(t, os.WriteFile(fpath, []byte("name: [unclosed\n"), 0o644))
+	_, err := ParseFragmentNodes(fpath)
+	isTrue(t, err != nil)
+
+	_, err = ParseFragmentNodes(filepath.Join(t.TempDir(), "missing.yaml"))
+	isTrue(t, err != nil)
+}
@@ -0,0 +1,120 @@
+// Copyright (C) Kumo inc. and its affiliates.
+// Author: Jeff.li lijippy@163.com
+// All rights reserved.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package env
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// FeedDirParallel loads the fragment files of dir like FeedDir, but reads and
+// parses them with up to workers goroutines, which pays off for directories
+// holding many files on slow storage. A workers value below 1 uses
+// runtime.GOMAXPROCS(0) goroutines.
+//
+// The fragments are added in filename order once every file has been read,
+// so the result does not depend on scheduling. Unlike FeedDir, a failing file
+// does not stop the feed: it adds none of its fragments, the other files are
+// still added, and the errors of all failing files are returned joined in
+// filename order.
+func (e *EnvManager) FeedDirParallel(dir string, workers int) error {
+	return e.FeedDirParallelCtx(context.Background(), dir, workers)
+}
+
+// FeedDirParallelCtx is like FeedDirParallel but stops handing out files once
+// ctx is done and returns ctx.Err(). No fragment is added in that case, since
+// the files are only added after all of them have been read.
+func (e *EnvManager) FeedDirParallelCtx(ctx context.Context, dir string, workers int) error {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for _, file := range files {
+		if !file.IsDir() && e.isFragmentFile(file.Name()) {
+			paths = append(paths, filepath.Join(dir, file.Name()))
+		}
+	}
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	// each file is fed into its own scratch manager, which validates the
+	// fragments without touching e
+	loaded := make([]*EnvManager, len(paths))
+	errs := make([]error, len(paths))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(workers, len(paths)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				scratch := e.scratch()
+				errs[i] = scratch.feedPath(paths[i])
+				loaded[i] = scratch
+			}
+		}()
+	}
+dispatch:
+	for i := range paths {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, scratch := range loaded {
+		var fresh []*EnvFragment
+		for _, frag := range scratch.fragments {
+			if errs[i] != nil {
+				break
+			}
+			skip, err := e.checkDuplicate(frag)
+			if err != nil {
+				errs[i] = fmt.Errorf("validation failed for fragment %s in %s: %w", frag.Name, frag.Source, err)
+			} else if !skip {
+				fresh = append(fresh, frag)
+			}
+		}
+		if errs[i] != nil {
+			e.log().Warn("file rejected", "source", paths[i], "error", errs[i])
+			continue
+		}
+		for _, frag := range fresh {
+			e.adopt(frag)
+			e.sorted = false
+			e.log().Info("fragment loaded", "fragment", frag.Name, "priority", frag.Priority, "source", frag.Source)
+		}
+		e.warnings = append(e.warnings, scratch.warnings...)
+	}
+	return errors.Join(errs...)
+}
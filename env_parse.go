@@ -0,0 +1,333 @@
+// Copyright (C) Kumo inc. and its affiliates.
+// Author: Jeff.li lijippy@163.com
+// All rights reserved.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package env
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ParseBash reads a bash environment file, such as one written by BuildBash
+// or maintained by hand, into a fragment. It understands assignments of the
+// form [export] KEY=VALUE, with single quoted, double quoted, $'...' quoted,
+// backslash escaped or bare values, including values spanning several lines inside
+// quotes. Comments and every other statement are skipped, as is the ENV_CTIME
+// key written by the builders. Assignments are read line by line regardless
+// of surrounding control flow, and variable references in values are kept as
+// written.
+//
+// The fragment is named after the file without its extension, has priority
+// 100 and its Source set to path.
+func ParseBash(path string) (*EnvFragment, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", path, err)
+	}
+	frag := newParsedFragment(path)
+	p := &shellParser{src: string(data), line: 1}
+	for !p.eof() {
+		line := p.line
+		if err := p.statement(frag.Env); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: line %d: %w", path, line, err)
+		}
+	}
+	delete(frag.Env, ENV_CTIME_KEY)
+	return frag, nil
+}
+
+// ParseDotenv reads a dotenv file, such as one written by BuildDotenv, into a
+// fragment named and prioritized like the one returned by ParseBash. Each
+// non-comment line must be [export] KEY=VALUE, where VALUE is bare, single
+// quoted, or double quoted with \\, \", \$, \n and \r escapes. A # preceded by
+// a space starts a comment after a bare value.
+func ParseDotenv(path string) (*EnvFragment, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", path, err)
+	}
+	frag := newParsedFragment(path)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, err := parseDotenvLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: line %d: %w", path, n, err)
+		}
+		frag.Env[key] = value
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", path, err)
+	}
+	delete(frag.Env, ENV_CTIME_KEY)
+	return frag, nil
+}
+
+func newParsedFragment(path string) *EnvFragment {
+	name := filepath.Base(path)
+	if trimmed := strings.TrimSuffix(name, filepath.Ext(name)); trimmed != "" {
+		name = trimmed // keep ".env" rather than an empty name
+	}
+	return &EnvFragment{
+		Name:     name,
+		Priority: 100,
+		Env:      make(map[string]string),
+		Source:   path,
+	}
+}
+
+func parseDotenvLine(line string) (string, string, error) {
+	line = strings.TrimPrefix(line, "export ")
+	key, raw, ok := strings.Cut(line, "=")
+	key = strings.TrimSpace(key)
+	if !ok || !isVarName(key) {
+		return "", "", fmt.Errorf("expected KEY=VALUE, got %q", line)
+	}
+	raw = strings.TrimSpace(raw)
+	switch {
+	case strings.HasPrefix(raw, "'"):
+		end := strings.IndexByte(raw[1:], '\'')
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated single quote in %s", key)
+		}
+		return key, raw[1 : end+1], nil
+	case strings.HasPrefix(raw, `"`):
+		var sb strings.Builder
+		for i := 1; i < len(raw); i++ {
+			switch c := raw[i]; c {
+			case '"':
+				return key, sb.String(), nil
+			case '\\':
+				if i+1 == len(raw) {
+					break
+				}
+				i++
+				switch raw[i] {
+				case 'n':
+					sb.WriteByte('\n')
+				case 'r':
+					sb.WriteByte('\r')
+				default:
+					sb.WriteByte(raw[i])
+				}
+			default:
+				sb.WriteByte(c)
+			}
+		}
+		return "", "", fmt.Errorf("unterminated double quote in %s", key)
+	}
+	if i := strings.Index(raw, " #"); i >= 0 {
+		raw = strings.TrimSpace(raw[:i])
+	}
+	return key, raw, nil
+}
+
+// shellParser parses the assignment subset of bash described in ParseBash.
+type shellParser struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (p *shellParser) eof() bool { return p.pos >= len(p.src) }
+
+func (p *shellParser) peek() byte { return p.src[p.pos] }
+
+func (p *shellParser) next() byte {
+	c := p.src[p.pos]
+	p.pos++
+	if c == '\n' {
+		p.line++
+	}
+	return c
+}
+
+// skipBlanks skips spaces and tabs, but not newlines.
+func (p *shellParser) skipBlanks() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.next()
+	}
+}
+
+// skipLine skips to the start of the next line.
+func (p *shellParser) skipLine() {
+	for !p.eof() && p.next() != '\n' {
+	}
+}
+
+// statement parses one line: zero or more assignments, optionally preceded
+// by export. Lines that are not assignments are skipped.
+func (p *shellParser) statement(env map[string]string) error {
+	p.skipBlanks()
+	if strings.HasPrefix(p.src[p.pos:], "export ") {
+		p.pos += len("export ")
+		p.skipBlanks()
+	}
+	for {
+		name, ok := p.name()
+		if !ok {
+			p.skipLine()
+			return nil
+		}
+		value, err := p.word()
+		if err != nil {
+			return err
+		}
+		env[name] = value
+		p.skipBlanks()
+		if p.eof() {
+			return nil
+		}
+		switch p.peek() {
+		case '\n':
+			p.next()
+			return nil
+		case ';', '#':
+			p.skipLine()
+			return nil
+		}
+	}
+}
+
+// name consumes NAME= and returns NAME. Nothing is consumed if the input does
+// not start with an assignment.
+func (p *shellParser) name() (string, bool) {
+	n := 0
+	for p.pos+n < len(p.src) && isVarByte(p.src[p.pos+n], n == 0) {
+		n++
+	}
+	if n == 0 || p.pos+n >= len(p.src) || p.src[p.pos+n] != '=' {
+		return "", false
+	}
+	name := p.src[p.pos : p.pos+n]
+	p.pos += n + 1
+	return name, true
+}
+
+// word consumes a shell word made of quoted and unquoted parts and returns
+// its value after quote removal.
+func (p *shellParser) word() (string, error) {
+	var sb strings.Builder
+	for !p.eof() {
+		switch c := p.peek(); c {
+		case ' ', '\t', '\n', ';':
+			return sb.String(), nil
+		case '\'':
+			p.next()
+			end := strings.IndexByte(p.src[p.pos:], '\'')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated single quote")
+			}
+			for i := 0; i < end; i++ {
+				sb.WriteByte(p.next())
+			}
+			p.next()
+		case '"':
+			p.next()
+			if err := p.doubleQuoted(&sb); err != nil {
+				return "", err
+			}
+		case '$':
+			if !strings.HasPrefix(p.src[p.pos:], "$'") {
+				sb.WriteByte(p.next())
+				break
+			}
+			p.pos += len("$'")
+			if err := p.ansiQuoted(&sb); err != nil {
+				return "", err
+			}
+		case '\\':
+			p.next()
+			if p.eof() {
+				return sb.String(), nil
+			}
+			if c := p.next(); c != '\n' {
+				sb.WriteByte(c)
+			}
+		default:
+			sb.WriteByte(p.next())
+		}
+	}
+	return sb.String(), nil
+}
+
+// ansiEscapes maps the single character escapes of a $'...' string to the
+// bytes they stand for.
+var ansiEscapes = map[byte]byte{
+	'a': '\a', 'b': '\b', 'e': 0x1b, 'E': 0x1b, 'f': '\f', 'n': '\n',
+	'r': '\r', 't': '\t', 'v': '\v', '\\': '\\', '\'': '\'', '"': '"', '?': '?',
+}
+
+// ansiQuoted consumes the rest of an ANSI-C $'...' string, as written by
+// BuildBash for values with line breaks. Single character escapes are
+// decoded; other escapes such as octal or hex codes are kept as written.
+func (p *shellParser) ansiQuoted(sb *strings.Builder) error {
+	for !p.eof() {
+		c := p.next()
+		switch c {
+		case '\'':
+			return nil
+		case '\\':
+			if p.eof() {
+				break
+			}
+			if b, ok := ansiEscapes[p.peek()]; ok {
+				p.next()
+				sb.WriteByte(b)
+			} else {
+				sb.WriteByte(c)
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return fmt.Errorf("unterminated $' quote")
+}
+
+// doubleQuoted consumes the rest of a double quoted string. As in bash, a
+// backslash only escapes $, `, ", \ and a newline.
+func (p *shellParser) doubleQuoted(sb *strings.Builder) error {
+	for !p.eof() {
+		c := p.next()
+		switch c {
+		case '"':
+			return nil
+		case '\\':
+			if p.eof() {
+				break
+			}
+			switch n := p.peek(); n {
+			case '$', '`', '"', '\\':
+				sb.WriteByte(p.next())
+			case '\n':
+				p.next()
+			default:
+				sb.WriteByte(c)
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return fmt.Errorf("unterminated double quote")
+}
@@ -0,0 +1,112 @@
+package env
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newCorpusManager(tb testing.TB, mode QuoteMode) *EnvManager {
+	tb.Helper()
+
+	env := make(map[string]string, len(quoteCorpus))
+	for i, v := range quoteCorpus {
+		env[fmt.Sprintf("V%02d", i)] = v
+	}
+	em := &EnvManager{QuoteMode: mode}
+	isNoErr(tb, em.AddFragment(&EnvFragment{Name: "corpus", Priority: 100, Env: env}))
+	isNoErr(tb, em.SortAndMergeStrict())
+	return em
+}
+
+func TestParseBashRoundTrip(t *testing.T) {
+	for _, mode := range []QuoteMode{QuoteDouble, QuoteSingle} {
+		em := newCorpusManager(t, mode)
+		dst := filepath.Join(t.TempDir(), "corpus.sh")
+		isNoErr(t, em.BuildBash(dst))
+
+		frag, err := ParseBash(dst)
+		isNoErr(t, err)
+		isEqual(t, "corpus", frag.Name)
+		isEqual(t, 100, frag.Priority)
+		isEqual(t, dst, frag.Source)
+		isEqual(t, em.Merged(), frag.Env)
+	}
+}
+
+func TestParseBashLegacy(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "legacy.env.sh")
+	isNoErr(t, os.WriteFile(dst, []byte(`#!/bin/bash
+# legacy settings
+export JAVA_HOME=/opt/java   # trailing comment
+PATH=$JAVA_HOME/bin:$PATH
+export A=1 B='two words'; echo done
+MSG="multi
+line"
+SPLIT=long\
+value
+echo "not an assignment"
+if [ -z "$X" ]; then
+  export X="fallback"
+fi
+`), 0o644))
+
+	frag, err := ParseBash(dst)
+	isNoErr(t, err)
+	isEqual(t, "legacy.env", frag.Name)
+	isEqual(t, map[string]string{
+		"JAVA_HOME": "/opt/java",
+		"PATH":      "$JAVA_HOME/bin:$PATH",
+		"A":         "1",
+		"B":         "two words",
+		"MSG":       "multi\nline",
+		"SPLIT":     "longvalue",
+		"X":         "fallback",
+	}, frag.Env)
+}
+
+func TestParseBashErrors(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "bad.sh")
+	isNoErr(t, os.WriteFile(dst, []byte("A=1\nB=\"open\n\n"), 0o644))
+	_, err := ParseBash(dst)
+	isErrorWithMessage(t, err, "failed to parse "+dst+": line 2: unterminated double quote")
+
+	_, err = ParseBash(filepath.Join(t.TempDir(), "missing.sh"))
+	isTrue(t, err != nil)
+}
+
+func TestParseDotenvRoundTrip(t *testing.T) {
+	em := newCorpusManager(t, QuoteDouble)
+	dst := filepath.Join(t.TempDir(), "corpus.env")
+	isNoErr(t, em.BuildDotenv(dst))
+
+	frag, err := ParseDotenv(dst)
+	isNoErr(t, err)
+	isEqual(t, "corpus", frag.Name)
+	isEqual(t, em.Merged(), frag.Env)
+}
+
+func TestParseDotenv(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), ".env")
+	isNoErr(t, os.WriteFile(dst, []byte(`# comment
+PORT=8080 # inline comment
+export HOST=localhost
+QUOTED="a \"b\" \$c\nd"
+RAW='x # y'
+`), 0o644))
+
+	frag, err := ParseDotenv(dst)
+	isNoErr(t, err)
+	isEqual(t, ".env", frag.Name)
+	isEqual(t, map[string]string{
+		"PORT":   "8080",
+		"HOST":   "localhost",
+		"QUOTED": "a \"b\" $c\nd",
+		"RAW":    "x # y",
+	}, frag.Env)
+
+	isNoErr(t, os.WriteFile(dst, []byte("PORT=1\nnot valid\n"), 0o644))
+	_, err = ParseDotenv(dst)
+	isErrorWithMessage(t, err, "failed to parse "+dst+`: line 2: expected KEY=VALUE, got "not valid"`)
+}
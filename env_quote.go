@@ -0,0 +1,192 @@
+// Copyright (C) Kumo inc. and its affiliates.
+// Author: Jeff.li lijippy@163.com
+// All rights reserved.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package env
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The quoting helpers below turn an arbitrary value into a literal of the
+// target shell that evaluates back to exactly that value: no variable
+// or command expansion takes place when the generated file is sourced.
+
+// shSingleQuote quotes s for bash and zsh using single quotes. Nothing is
+// special inside single quotes, so an embedded quote ends the quoted
+// string, is written escaped and a new quoted string is started.
+func shSingleQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shDoubleQuote quotes s for bash and zsh using double quotes, escaping the
+// characters that keep their meaning inside them: $, `, " and \.
+func shDoubleQuote(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s) + 2)
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '$', '`', '"', '\\':
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// pwshSingleQuote quotes s for PowerShell using single quotes. PowerShell
+// also accepts the typographic quotes ‘ ’ ‚ ‛ as single quotes, so every one
+// of them is doubled, not just the ASCII quote.
+func pwshSingleQuote(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s) + 2)
+	sb.WriteByte('\'')
+	for _, r := range s {
+		if isPwshSingleQuote(r) {
+			sb.WriteRune(r)
+		}
+		sb.WriteRune(r)
+	}
+	sb.WriteByte('\'')
+	return sb.String()
+}
+
+// pwshDoubleQuote quotes s for PowerShell using double quotes. The escape
+// character is the backtick; $, the backtick itself and every double quote
+// form PowerShell recognizes (“ ” „ and ") are escaped with it.
+func pwshDoubleQuote(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s) + 2)
+	sb.WriteByte('"')
+	for _, r := range s {
+		if r == '$' || r == '`' || isPwshDoubleQuote(r) {
+			sb.WriteByte('`')
+		}
+		sb.WriteRune(r)
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// shANSIQuote quotes s for bash and zsh as an ANSI-C $'...' string, which
+// keeps a value with line breaks on a single line. Backslash, the single
+// quote, newline, carriage return and tab are written as escape sequences.
+func shANSIQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return "$'" + r.Replace(s) + "'"
+}
+
+// pwshEscapedQuote is like pwshDoubleQuote but also writes newline, carriage
+// return and tab as the escape sequences `n, `r and `t, so the value stays
+// on a single line.
+func pwshEscapedQuote(s string) string {
+	r := strings.NewReplacer("\n", "`n", "\r", "`r", "\t", "`t")
+	return r.Replace(pwshDoubleQuote(s))
+}
+
+func isPwshSingleQuote(r rune) bool {
+	switch r {
+	case '\'', '‘', '’', '‚', '‛':
+		return true
+	}
+	return false
+}
+
+func isPwshDoubleQuote(r rune) bool {
+	switch r {
+	case '"', '“', '”', '„':
+		return true
+	}
+	return false
+}
+
+// nuDoubleQuote quotes s for Nushell using double quotes, inside which a
+// backslash starts an escape sequence and an unknown one is an error. The
+// backslash, the double quote, newline, carriage return and tab are escaped,
+// other control characters are written as \u{...}. Double quoted strings
+// are not interpolated, so $ needs no escaping.
+func nuDoubleQuote(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s) + 2)
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '"':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case r == '\n':
+			sb.WriteString(`\n`)
+		case r == '\r':
+			sb.WriteString(`\r`)
+		case r == '\t':
+			sb.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&sb, `\u{%x}`, r)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// nuSingleQuote quotes s for Nushell using single quotes, inside which
+// nothing is special. A single quoted string cannot hold a single quote and
+// control characters are best kept visible, so such values are double quoted
+// instead.
+func nuSingleQuote(s string) string {
+	if strings.ContainsFunc(s, func(r rune) bool { return r == '\'' || r < 0x20 || r == 0x7f }) {
+		return nuDoubleQuote(s)
+	}
+	return "'" + s + "'"
+}
+
+// cshQuote quotes s for csh and tcsh using single quotes, inside which only
+// ! keeps its meaning, as history substitution. An embedded single quote or
+// ! ends the quoted string, is written escaped with a backslash and a new
+// quoted string is started. Line breaks cannot be represented and are left to
+// the caller.
+func cshQuote(s string) string {
+	r := strings.NewReplacer("'", `'\''`, "!", `'\!'`)
+	return "'" + r.Replace(s) + "'"
+}
+
+// cmdQuote escapes s for the value part of a cmd.exe batch line of the form
+// set "KEY=VALUE". Percent signs are doubled so they are not expanded, and
+// once an embedded double quote has switched cmd out of quoted mode, the
+// metacharacters & | < > ( ) ^ are escaped with a caret until the next quote
+// switches it back. Line breaks cannot be represented in a set line and are
+// left to the caller.
+func cmdQuote(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s))
+	quoted := true
+	for _, r := range s {
+		switch {
+		case r == '%':
+			sb.WriteByte('%')
+		case r == '"':
+			quoted = !quoted
+		case !quoted && strings.ContainsRune("&|<>()^", r):
+			sb.WriteByte('^')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
@@ -0,0 +1,368 @@
+package env
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// quoteCorpus holds values that break naive quoting in at least one shell.
+var quoteCorpus = []string{
+	"",
+	"plain",
+	"with space",
+	"  leading and trailing  ",
+	`say "hi"`,
+	"it's",
+	`back\slash`,
+	`trailing\`,
+	"back`tick`",
+	"$HOME",
+	"${HOME}",
+	"$(echo pwned)",
+	"`echo pwned`",
+	"pa$$word",
+	"!bang !! !$",
+	"semi;colon & amp | pipe > out < in",
+	"(paren) {brace} [bracket]",
+	"*glob? ~tilde #hash",
+	"percent %PATH% caret ^",
+	`mixed '"'"' quotes`,
+	"“smart” ‘quotes’ „low‚",
+	"unicode ✓ 日本語",
+	"new\nline",
+	"tab\there",
+	`\n not a newline`,
+}
+
+func TestQuoteHelpers(t *testing.T) {
+	for _, tt := range []struct {
+		quote func(string) string
+		in    string
+		want  string
+	}{
+		{shSingleQuote, "", `''`},
+		{shSingleQuote, "it's $HOME", `'it'\''s $HOME'`},
+		{shDoubleQuote, "", `""`},
+		{shDoubleQuote, "a \"b\" $c `d` \\e", "\"a \\\"b\\\" \\$c \\`d\\` \\\\e\""},
+		{shDoubleQuote, "it's", `"it's"`},
+		{pwshSingleQuote, "it's ‘x’", `'it''s ‘‘x’’'`},
+		{pwshSingleQuote, `"$x"`, `'"$x"'`},
+		{pwshDoubleQuote, "$x `y` \"z\" “w”", "\"`$x ``y`` `\"z`\" `“w`”\""},
+		{pwshDoubleQuote, `back\slash`, `"back\slash"`},
+		{shANSIQuote, "it's\n\\n", `$'it\'s\n\\n'`},
+		{pwshEscapedQuote, "$x\r\n`y`", "\"`$x`r`n``y``\""},
+		{nuDoubleQuote, "$x \"y\" \\z\n\x01", `"$x \"y\" \\z\n\u{1}"`},
+		{nuSingleQuote, `$x "y" \z`, `'$x "y" \z'`},
+		{nuSingleQuote, "it's", `"it's"`},
+		{cmdQuote, "100%", "100%%"},
+		{cmdQuote, "a&b", "a&b"},
+		{cmdQuote, `say "a&b" & c`, `say "a^&b" & c`},
+	} {
+		isEqual(t, tt.want, tt.quote(tt.in))
+	}
+}
+
+// evalQuoted sources one assignment per value in shell and returns the values
+// the shell ends up with.
+func evalQuoted(tb testing.TB, shell string, quote func(string) string, values []string) []string {
+	tb.Helper()
+	requireShell(tb, shell)
+
+	var sb strings.Builder
+	var args []string
+	for i, v := range values {
+		switch shell {
+		case "bash", "zsh":
+			fmt.Fprintf(&sb, "V%d=%s\n", i, quote(v))
+			fmt.Fprintf(&sb, "printf '%%s\\0' \"$V%d\"\n", i)
+		case "pwsh":
+			fmt.Fprintf(&sb, "$V%d = %s\n", i, quote(v))
+			fmt.Fprintf(&sb, "[Console]::Out.Write($V%d + [char]0)\n", i)
+		default:
+			tb.Fatalf("no evaluator for %s", shell)
+		}
+	}
+	script := filepath.Join(tb.TempDir(), "quote")
+	isNoErr(tb, os.WriteFile(script, []byte(sb.String()), 0o644))
+	switch shell {
+	case "pwsh":
+		args = []string{"-NoProfile", "-NonInteractive", "-File", script + ".ps1"}
+		isNoErr(tb, os.Rename(script, script+".ps1"))
+	default:
+		args = []string{script}
+	}
+	out, err := exec.Command(shell, args...).Output()
+	isNoErr(tb, err)
+	got := strings.Split(string(out), "\x00")
+	return got[:len(got)-1]
+}
+
+func TestQuoteRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		shell string
+		quote func(string) string
+	}{
+		{"bash single", "bash", shSingleQuote},
+		{"bash double", "bash", shDoubleQuote},
+		{"zsh single", "zsh", shSingleQuote},
+		{"zsh double", "zsh", shDoubleQuote},
+		{"pwsh single", "pwsh", pwshSingleQuote},
+		{"pwsh double", "pwsh", pwshDoubleQuote},
+		{"bash ansi", "bash", shANSIQuote},
+		{"zsh ansi", "zsh", shANSIQuote},
+		{"pwsh escaped", "pwsh", pwshEscapedQuote},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			isEqual(t, quoteCorpus, evalQuoted(t, tt.shell, tt.quote, quoteCorpus))
+		})
+	}
+}
+
+func TestBuildBashRoundTrip(t *testing.T) {
+	requireShell(t, "bash")
+
+	env := make(map[string]string, len(quoteCorpus))
+	for i, v := range quoteCorpus {
+		env[fmt.Sprintf("V%02d", i)] = v
+	}
+	em := &EnvManager{}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "corpus", Priority: 100, Env: env}))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	dst := filepath.Join(t.TempDir(), "env.sh")
+	isNoErr(t, em.BuildBash(dst))
+	out, err := exec.Command("bash", "-c", `. "$1" && for k in $(compgen -v V); do printf '%s\0' "${!k}"; done`, "bash", dst).Output()
+	isNoErr(t, err)
+	got := strings.Split(string(out), "\x00")
+	isEqual(t, quoteCorpus, got[:len(got)-1])
+}
+
+func TestBuildMultilineValues(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "keys", Priority: 100, Env: map[string]string{
+		"PEM": "-----BEGIN KEY-----\nabc\n-----END KEY-----\n",
+	}}))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	for _, tt := range []struct {
+		mode  QuoteMode
+		build func(*EnvManager, io.Writer) error
+		want  string
+	}{
+		{QuoteDouble, (*EnvManager).BuildBashTo, `export PEM=$'-----BEGIN KEY-----\nabc\n-----END KEY-----\n'`},
+		{QuoteSingle, (*EnvManager).BuildZshTo, `export PEM=$'-----BEGIN KEY-----\nabc\n-----END KEY-----\n'`},
+		{QuoteSingle, (*EnvManager).BuildPshTo, "$Env:PEM = \"-----BEGIN KEY-----`nabc`n-----END KEY-----`n\""},
+	} {
+		em.QuoteMode = tt.mode
+		var buf bytes.Buffer
+		isNoErr(t, tt.build(em, &buf))
+		isTrue(t, strings.Contains(buf.String(), "\n"+tt.want+"\n"))
+	}
+
+	var buf bytes.Buffer
+	isErrorWithMessage(t, em.BuildCmdTo(&buf), "key PEM in fragment keys: value contains a line break, which cmd cannot represent")
+	isEqual(t, 0, buf.Len())
+
+	// a filtered key does not fail the build
+	em.Denylist = []string{"PEM"}
+	isNoErr(t, em.BuildCmdTo(&buf))
+}
+
+func TestBuildNu(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.AddFragment(&EnvFragment{
+		Name:     "app",
+		Priority: 100,
+		Env:      map[string]string{"GREETING": `say "hi" to $USER`, "PEM": "a\nb"},
+		Unset:    []string{"OLD"},
+		Script: []Script{
+			{Sh: "nu", Data: "print 'nu'"},
+			{Sh: "bash", Data: "echo bash"},
+		},
+	}))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	var buf bytes.Buffer
+	isNoErr(t, em.BuildNuTo(&buf))
+	out := buf.String()
+	isTrue(t, strings.Contains(out, "\n$env.GREETING = \"say \\\"hi\\\" to $USER\"\n"))
+	isTrue(t, strings.Contains(out, "\n$env.PEM = \"a\\nb\"\n"))
+	isTrue(t, strings.Contains(out, "\nhide-env --ignore-errors OLD\n"))
+	isTrue(t, strings.Contains(out, "\nprint 'nu'\n"))
+	isFalse(t, strings.Contains(out, "echo bash"))
+	isTrue(t, strings.Contains(out, "$env.ENV_CTIME = \""))
+
+	em.QuoteMode = QuoteSingle
+	buf.Reset()
+	isNoErr(t, em.BuildNuTo(&buf))
+	isTrue(t, strings.Contains(buf.String(), "\n$env.GREETING = 'say \"hi\" to $USER'\n"))
+}
+
+func TestBuildCsh(t *testing.T) {
+	em := &EnvManager{QuoteMode: QuoteDouble}
+	isNoErr(t, em.AddFragment(&EnvFragment{
+		Name:     "app",
+		Priority: 100,
+		Env:      map[string]string{"GREETING": `it's "$USER"!`, "PATH_LIST": "/opt/bin:/usr/bin", "EMPTY": ""},
+		Unset:    []string{"OLD"},
+		Script: []Script{
+			{Sh: "tcsh", Data: "alias ll 'ls -l'"},
+			{Sh: "bash", Data: "echo bash"},
+		},
+	}))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	var buf bytes.Buffer
+	isNoErr(t, em.BuildCshTo(&buf))
+	out := buf.String()
+	isTrue(t, strings.Contains(out, "\nsetenv GREETING 'it'\\''s \"$USER\"'\\!''\n"))
+	isTrue(t, strings.Contains(out, "\nsetenv PATH_LIST '/opt/bin:/usr/bin'\n"))
+	isTrue(t, strings.Contains(out, "\nsetenv EMPTY ''\n"))
+	isTrue(t, strings.Contains(out, "\nunsetenv OLD\n"))
+	isTrue(t, strings.Contains(out, "\nalias ll 'ls -l'\n"))
+	isFalse(t, strings.Contains(out, "echo bash"))
+	isTrue(t, strings.HasPrefix(out, "# Env generated at "))
+	isTrue(t, strings.Contains(out, "\nsetenv ENV_CTIME '"))
+
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "pem", Priority: 110, Env: map[string]string{"PEM": "a\nb"}}))
+	isNoErr(t, em.SortAndMergeStrict())
+	isErrorWithMessage(t, em.BuildCshTo(io.Discard), "key PEM in fragment pem: value contains a line break, which csh cannot represent")
+}
+
+func TestBuildCshRoundTrip(t *testing.T) {
+	requireShell(t, "tcsh")
+
+	values := []string{"plain", "with space", `it's`, `say "hi"`, "$HOME and `date`", "wow!", "a\\b", "*?[x]", "~user"}
+	em := &EnvManager{}
+	env := make(map[string]string)
+	for i, v := range values {
+		env[fmt.Sprintf("V%d", i)] = v
+	}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "app", Priority: 100, Env: env}))
+	isNoErr(t, em.SortAndMergeStrict())
+	dst := filepath.Join(t.TempDir(), "env.csh")
+	isNoErr(t, em.BuildCsh(dst))
+	isNoErr(t, ValidateShellFile(dst, "tcsh"))
+
+	for i, v := range values {
+		out, err := exec.Command("tcsh", "-f", "-c", fmt.Sprintf("source %s; printenv V%d", dst, i)).Output()
+		isNoErr(t, err)
+		isEqual(t, v+"\n", string(out))
+	}
+}
+
+func TestBuildPshEscaping(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "app", Priority: 100, Env: map[string]string{
+		"PASSWORD": "pa$$word",
+		"TICK":     "a`b",
+		"QUOTES":   `say "hi" it's`,
+		"SMART":    "“curly” ‘single’",
+		"VAR":      "$Env:HOME and ${x}",
+	}}))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	for _, tt := range []struct {
+		mode QuoteMode
+		want []string
+	}{
+		{QuoteDouble, []string{
+			"$Env:PASSWORD = \"pa`$`$word\"",
+			"$Env:TICK = \"a``b\"",
+			"$Env:QUOTES = \"say `\"hi`\" it's\"",
+			"$Env:SMART = \"`“curly`” ‘single’\"",
+			"$Env:VAR = \"`$Env:HOME and `${x}\"",
+		}},
+		{QuoteSingle, []string{
+			"$Env:PASSWORD = 'pa$$word'",
+			"$Env:TICK = 'a`b'",
+			"$Env:QUOTES = 'say \"hi\" it''s'",
+			"$Env:SMART = '“curly” ‘‘single’’'",
+			"$Env:VAR = '$Env:HOME and ${x}'",
+		}},
+	} {
+		em.QuoteMode = tt.mode
+		var buf bytes.Buffer
+		isNoErr(t, em.BuildPshTo(&buf))
+		for _, line := range tt.want {
+			isTrue(t, strings.Contains(buf.String(), "\n"+line+"\n"))
+		}
+	}
+}
+
+func newNastyManager(tb testing.TB, mode QuoteMode, pwned string) *EnvManager {
+	tb.Helper()
+
+	em := &EnvManager{QuoteMode: mode}
+	isNoErr(tb, em.AddFragment(&EnvFragment{Name: "nasty", Priority: 100, Env: map[string]string{
+		"PASSWORD": `he said "hi"`,
+		"SUBST":    "$(touch " + pwned + ")",
+		"TICKS":    "`touch " + pwned + "`",
+		"VAR":      "${HOME} and \\$HOME",
+		"QUOTE":    "it's",
+	}}))
+	isNoErr(tb, em.SortAndMergeStrict())
+	return em
+}
+
+func TestBuildBashNoInjection(t *testing.T) {
+	requireShell(t, "bash")
+
+	for _, mode := range []QuoteMode{QuoteDouble, QuoteSingle} {
+		dir := t.TempDir()
+		pwned := filepath.Join(dir, "pwned")
+		em := newNastyManager(t, mode, pwned)
+
+		dst := filepath.Join(dir, "env.sh")
+		isNoErr(t, em.BuildBash(dst))
+		out, err := exec.Command("bash", "-c", `. "$1" && printf '%s\0' "$PASSWORD" "$SUBST" "$TICKS" "$VAR" "$QUOTE"`, "bash", dst).Output()
+		isNoErr(t, err)
+		isEqual(t, `he said "hi"`+"\x00$(touch "+pwned+")\x00`touch "+pwned+"`\x00${HOME} and \\$HOME\x00it's\x00", string(out))
+		_, err = os.Stat(pwned)
+		isTrue(t, os.IsNotExist(err))
+	}
+}
+
+func TestBuildQuoteModes(t *testing.T) {
+	for _, tt := range []struct {
+		mode  QuoteMode
+		build func(*EnvManager, string) error
+		want  []string
+	}{
+		{QuoteDouble, (*EnvManager).BuildBash, []string{
+			`export PASSWORD="he said \"hi\""`,
+			"export TICKS=\"\\`touch x\\`\"",
+			`export VAR="\${HOME} and \\\$HOME"`,
+		}},
+		{QuoteSingle, (*EnvManager).BuildZsh, []string{
+			`export PASSWORD='he said "hi"'`,
+			`export QUOTE='it'\''s'`,
+			`export VAR='${HOME} and \$HOME'`,
+		}},
+		{QuoteDouble, (*EnvManager).BuildPsh, []string{
+			"$Env:PASSWORD = \"he said `\"hi`\"\"",
+			"$Env:SUBST = \"`$(touch x)\"",
+			"$Env:TICKS = \"``touch x``\"",
+		}},
+		{QuoteSingle, (*EnvManager).BuildPsh, []string{
+			`$Env:QUOTE = 'it''s'`,
+			`$Env:SUBST = '$(touch x)'`,
+		}},
+	} {
+		em := newNastyManager(t, tt.mode, "x")
+		dst := filepath.Join(t.TempDir(), "env")
+		isNoErr(t, tt.build(em, dst))
+		data, err := os.ReadFile(dst)
+		isNoErr(t, err)
+		for _, line := range tt.want {
+			isTrue(t, strings.Contains(string(data), line+"\n"))
+		}
+	}
+}
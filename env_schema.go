@@ -0,0 +1,93 @@
+// Copyright (C) Kumo inc. and its affiliates.
+// Author: Jeff.li lijippy@163.com
+// All rights reserved.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package env
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	fragmentFields = yamlFields(reflect.TypeOf(EnvFragment{}))
+	scriptFields   = yamlFields(reflect.TypeOf(Script{}))
+)
+
+// yamlFields returns the YAML keys of the struct type t, the exported fields
+// with a yaml tag. Untagged fields such as Source are set by the loader, not
+// by fragment files.
+func yamlFields(t reflect.Type) map[string]bool {
+	fields := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, ok := f.Tag.Lookup("yaml")
+		if !f.IsExported() || !ok {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		switch name {
+		case "-":
+			continue
+		case "":
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = true
+	}
+	return fields
+}
+
+// checkKnownFields returns an error for the first key of the fragment
+// document doc, or of one of its scripts, that EnvFragment does not define.
+// The error names the field and, if doc was parsed from text, its line.
+func checkKnownFields(doc *yaml.Node) error {
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		doc = doc.Content[0]
+	}
+	if doc.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		key, value := doc.Content[i], doc.Content[i+1]
+		if !fragmentFields[key.Value] {
+			return unknownFieldError(key, key.Value)
+		}
+		if key.Value != "script" || value.Kind != yaml.SequenceNode {
+			continue
+		}
+		for j, sc := range value.Content {
+			if sc.Kind != yaml.MappingNode {
+				continue
+			}
+			for k := 0; k < len(sc.Content); k += 2 {
+				if field := sc.Content[k]; !scriptFields[field.Value] {
+					return unknownFieldError(field, fmt.Sprintf("script[%d].%s", j, field.Value))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func unknownFieldError(key *yaml.Node, field string) error {
+	if key.Line == 0 {
+		return fmt.Errorf("unknown field %q", field)
+	}
+	return fmt.Errorf("line %d: unknown field %q", key.Line, field)
+}
@@ -0,0 +1,67 @@
+package env
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStrictSchema(t *testing.T) {
+	const typo = "name: app\npriorty: 110\nenv:\n  A: a\n"
+	const scriptTypo = `name: app
+priority: 100
+script:
+  - sh: bash
+    data: echo ok
+  - sh: bash
+    dat: echo typo
+`
+	const valid = `name: app
+priority: 100
+env:
+  A: a
+allow_override: [A]
+include: []
+script:
+  - sh: [bash, zsh]
+    shells: [pwsh]
+    data: echo ok
+`
+
+	// unknown fields are ignored by default, here leaving the priority unset
+	em := &EnvManager{}
+	isErrorWithMessage(t, em.FeedReader(strings.NewReader(typo), "app.yaml"),
+		"validation failed for fragment app in app.yaml: custom fragment app priority must >=100, got 0")
+
+	em = &EnvManager{StrictSchema: true}
+	isErrorWithMessage(t, em.FeedReader(strings.NewReader(typo), "app.yaml"),
+		`failed to parse YAML in app.yaml: line 2: unknown field "priorty"`)
+	isErrorWithMessage(t, em.FeedReader(strings.NewReader(scriptTypo), "app.yaml"),
+		`failed to parse YAML in app.yaml: line 7: unknown field "script[1].dat"`)
+	isErrorWithMessage(t, em.FeedReader(strings.NewReader("name: a\npriority: 100\nscripts: []\n"), "a.yaml"),
+		`failed to parse YAML in a.yaml: line 3: unknown field "scripts"`)
+	for _, field := range []string{"node", "autopriority", "source"} {
+		isErrorWithMessage(t, em.FeedReader(strings.NewReader("name: a\npriority: 100\n"+field+": x\n"), "a.yaml"),
+			`failed to parse YAML in a.yaml: line 3: unknown field "`+field+`"`)
+	}
+	isEqual(t, 0, len(em.Fragments()))
+
+	isNoErr(t, em.FeedReader(strings.NewReader(valid), "app.yaml"))
+	isEqual(t, 1, len(em.Fragments()))
+}
+
+func TestStrictSchemaTOML(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"typo.toml":   "name = \"app\"\npriorty = 110\n",
+		"script.toml": "name = \"app\"\npriority = 110\n[[script]]\nshell = \"bash\"\ndata = \"echo\"\n",
+		"ok.toml":     tomlFragment,
+	})
+
+	em := &EnvManager{StrictSchema: true}
+	fpath := filepath.Join(dir, "typo.toml")
+	isErrorWithMessage(t, em.FeedTOML(fpath), `failed to parse TOML in `+fpath+`: unknown field "priorty"`)
+	fpath = filepath.Join(dir, "script.toml")
+	isErrorWithMessage(t, em.FeedTOML(fpath), `failed to parse TOML in `+fpath+`: unknown field "script[0].shell"`)
+	isNoErr(t, em.FeedTOML(filepath.Join(dir, "ok.toml")))
+}
@@ -0,0 +1,148 @@
+// Copyright (C) Kumo inc. and its affiliates.
+// Author: Jeff.li lijippy@163.com
+// All rights reserved.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package env
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// UnmarshalYAML implements yaml.Unmarshaler, accepting sh as a single shell
+// name or as a list of names.
+func (s *Script) UnmarshalYAML(value *yaml.Node) error {
+	var raw struct {
+		Sh     yaml.Node `yaml:"sh"`
+		Shells []string  `yaml:"shells"`
+		Data   string    `yaml:"data"`
+		File   string    `yaml:"file"`
+		Order  int       `yaml:"order"`
+	}
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+	*s = Script{Shells: raw.Shells, Data: raw.Data, File: raw.File, Order: raw.Order}
+	switch {
+	case raw.Sh.Kind == 0, raw.Sh.Tag == "!!null":
+	case raw.Sh.Kind == yaml.ScalarNode:
+		s.Sh = raw.Sh.Value
+	case raw.Sh.Kind == yaml.SequenceNode:
+		var list []string
+		if err := raw.Sh.Decode(&list); err != nil {
+			return err
+		}
+		s.Shells = append(list, s.Shells...)
+	default:
+		return fmt.Errorf("line %d: sh must be a shell name or a list of shell names", raw.Sh.Line)
+	}
+	return nil
+}
+
+// shellNames returns every shell the script applies to.
+func (s Script) shellNames() []string {
+	if s.Sh == "" {
+		return s.Shells
+	}
+	return append([]string{s.Sh}, s.Shells...)
+}
+
+// shellList returns the shells of the script as a comma separated list.
+func (s Script) shellList() string {
+	return strings.Join(s.shellNames(), ",")
+}
+
+// orderedScript is a script with an explicit order and its fragment.
+type orderedScript struct {
+	frag   *EnvFragment
+	script Script
+}
+
+// orderedScripts returns the scripts of frags for dialect d that have a
+// non-zero order, sorted by order. The sort is stable, so ties keep the
+// order of frags and of each fragment's scripts.
+func orderedScripts(frags []*EnvFragment, d shellDialect) []orderedScript {
+	var ordered []orderedScript
+	for _, frag := range frags {
+		for _, sc := range frag.Script {
+			if sc.Order != 0 && d.includesAny(sc.shellNames()) {
+				ordered = append(ordered, orderedScript{frag, sc})
+			}
+		}
+	}
+	slices.SortStableFunc(ordered, func(a, b orderedScript) int {
+		return cmp.Compare(a.script.Order, b.script.Order)
+	})
+	return ordered
+}
+
+var (
+	// scriptShellsMu guards scriptShells.
+	scriptShellsMu sync.RWMutex
+	// scriptShells holds the shell tags registered with RegisterScriptShell.
+	scriptShells = make(map[string]bool)
+)
+
+// RegisterScriptShell declares name as a valid shell tag for scripts, on top
+// of the tags of the built-in Build* functions: bash, zsh, pw, pwsh,
+// powershell, cmd, bat, nu, nushell, csh and tcsh. Use it for scripts
+// consumed by other tools, e.g. through Search. Registration is global and
+// affects every EnvManager.
+func RegisterScriptShell(name string) {
+	scriptShellsMu.Lock()
+	defer scriptShellsMu.Unlock()
+	scriptShells[name] = true
+}
+
+// UnregisterScriptShell removes a tag registered by RegisterScriptShell.
+func UnregisterScriptShell(name string) {
+	scriptShellsMu.Lock()
+	defer scriptShellsMu.Unlock()
+	delete(scriptShells, name)
+}
+
+// isKnownShell reports whether a script may use the shell tag name.
+func isKnownShell(name string) bool {
+	if _, ok := shellDialects[name]; ok {
+		return true
+	}
+	scriptShellsMu.RLock()
+	defer scriptShellsMu.RUnlock()
+	return scriptShells[name]
+}
+
+// validateScripts rejects scripts that no output would include: scripts
+// without a shell and scripts naming an unknown shell, such as a misspelled
+// bahs.
+func validateScripts(frag *EnvFragment) error {
+	for i, sc := range frag.Script {
+		shells := sc.shellNames()
+		if len(shells) == 0 {
+			return fmt.Errorf("script %d has no shell", i)
+		}
+		for _, sh := range shells {
+			if !isKnownShell(sh) {
+				return fmt.Errorf("script %d has unknown shell %q", i, sh)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package env
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestScriptShells(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.FeedReader(strings.NewReader(`name: app
+priority: 100
+script:
+  - sh: bash
+    data: echo bash-only
+  - sh: [bash, zsh]
+    data: echo posix
+  - shells: [pwsh]
+    data: Write-Host pwsh
+  - sh: zsh
+    shells: [bash]
+    data: echo both
+`), "app.yaml"))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	scripts := em.Fragments()[0].Script
+	isEqual(t, Script{Sh: "bash", Data: "echo bash-only"}, scripts[0])
+	isEqual(t, Script{Shells: []string{"bash", "zsh"}, Data: "echo posix"}, scripts[1])
+	isEqual(t, []string{"zsh", "bash"}, scripts[3].shellNames())
+
+	var bash, zsh, pwsh bytes.Buffer
+	isNoErr(t, em.BuildBashTo(&bash))
+	isNoErr(t, em.BuildZshTo(&zsh))
+	isNoErr(t, em.BuildPshTo(&pwsh))
+	isTrue(t, strings.Contains(bash.String(), "echo bash-only\necho posix\necho both\n"))
+	isTrue(t, strings.Contains(zsh.String(), "---\necho posix\necho both\n"))
+	isTrue(t, strings.Contains(pwsh.String(), "---\nWrite-Host pwsh\n"))
+
+	results, err := em.Search("posix")
+	isNoErr(t, err)
+	isEqual(t, "script[bash,zsh]", results[0].Key)
+}
+
+func TestScriptUnmarshalYAML(t *testing.T) {
+	var sc Script
+	isNoErr(t, yaml.Unmarshal([]byte("sh: [bash, zsh]\ndata: x\n"), &sc))
+	data, err := yaml.Marshal(sc)
+	isNoErr(t, err)
+	var back Script
+	isNoErr(t, yaml.Unmarshal(data, &back))
+	isEqual(t, sc, back)
+
+	err = yaml.Unmarshal([]byte("sh: {bash: true}\n"), &sc)
+	isErrorWithMessage(t, err, "line 1: sh must be a shell name or a list of shell names")
+}
+
+func TestScriptOrder(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.FeedReader(strings.NewReader(`name: tools
+priority: 110
+script:
+  - sh: bash
+    data: echo tools-plain
+  - sh: [bash, zsh]
+    order: 20
+    data: echo activate-tools
+---
+name: base
+priority: 100
+script:
+  - sh: bash
+    order: 20
+    data: echo base-late
+  - sh: [bash, zsh]
+    order: 10
+    data: echo setup-base
+  - sh: bash
+    data: echo base-plain
+`), "scripts.yaml"))
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, 10, em.Fragments()[0].Script[1].Order)
+
+	var bash, zsh bytes.Buffer
+	isNoErr(t, em.BuildBashTo(&bash))
+	isNoErr(t, em.BuildZshTo(&zsh))
+	isTrue(t, strings.HasSuffix(bash.String(), `# --- Fragment: base ---
+echo base-plain
+
+# --- Fragment: tools ---
+echo tools-plain
+
+# --- Ordered scripts ---
+# order 10: base
+echo setup-base
+# order 20: base
+echo base-late
+# order 20: tools
+echo activate-tools
+
+`))
+	isTrue(t, strings.HasSuffix(zsh.String(), `# --- Ordered scripts ---
+# order 10: base
+echo setup-base
+# order 20: tools
+echo activate-tools
+
+`))
+
+	// without ordered scripts there is no section
+	var pwsh bytes.Buffer
+	isNoErr(t, em.BuildPshTo(&pwsh))
+	isFalse(t, strings.Contains(pwsh.String(), "Ordered scripts"))
+}
+
+func TestScriptShellValidation(t *testing.T) {
+	em := &EnvManager{}
+	err := em.FeedReader(strings.NewReader("name: app\npriority: 100\nscript:\n  - sh: bash\n    data: ok\n  - sh: bahs\n    data: typo\n"), "app.yaml")
+	isErrorWithMessage(t, err, `validation failed for fragment app in app.yaml: script 1 has unknown shell "bahs"`)
+
+	err = em.AddFragment(&EnvFragment{Name: "app", Priority: 100, Script: []Script{{Data: "echo"}}})
+	isErrorWithMessage(t, err, "validation failed for fragment app: script 0 has no shell")
+
+	err = em.AddFragment(&EnvFragment{Name: "app", Priority: 100, Script: []Script{{Sh: "bash", Shells: []string{"fsh"}, Data: "echo"}}})
+	isErrorWithMessage(t, err, `validation failed for fragment app: script 0 has unknown shell "fsh"`)
+	isEqual(t, 0, len(em.Fragments()))
+
+	RegisterScriptShell("fsh")
+	defer UnregisterScriptShell("fsh")
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "app", Priority: 100, Script: []Script{{Sh: "bash", Shells: []string{"fsh"}, Data: "echo"}}}))
+	for _, sh := range []string{"bash", "zsh", "pw", "pwsh", "powershell", "cmd", "bat"} {
+		isTrue(t, isKnownShell(sh))
+	}
+}
+
+func TestScriptFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"frags/app.yaml": `name: app
+priority: 100
+include: [common/base.yaml]
+script:
+  - sh: bash
+    file: scripts/setup.bash
+  - sh: zsh
+    data: echo inline
+`,
+		"frags/scripts/setup.bash": "echo from file\n",
+		"frags/common/base.yaml":   "script:\n  - sh: bash\n    file: base.bash\n",
+		"frags/common/base.bash":   "echo base\n",
+		"bad/both.yaml":            "name: both\npriority: 100\nscript:\n  - sh: bash\n    data: echo\n    file: x.bash\n",
+		"bad/missing.yaml":         "name: missing\npriority: 100\nscript:\n  - sh: bash\n    file: missing.bash\n",
+	})
+
+	em := &EnvManager{StrictSchema: true}
+	isNoErr(t, em.FeedFile(filepath.Join(dir, "frags", "app.yaml")))
+	isEqual(t, []Script{
+		{Sh: "bash", Data: "echo base\n"},
+		{Sh: "bash", Data: "echo from file\n"},
+		{Sh: "zsh", Data: "echo inline"},
+	}, em.Fragments()[0].Script)
+
+	fsem := &EnvManager{}
+	isNoErr(t, fsem.FeedFS(os.DirFS(dir), "frags/app.yaml"))
+	isEqual(t, em.Fragments()[0].Script, fsem.Fragments()[0].Script)
+
+	both := filepath.Join(dir, "bad", "both.yaml")
+	isErrorWithMessage(t, em.FeedFile(both), "failed to read script files for fragment both in "+both+": script 0 has both data and file")
+	missing := filepath.Join(dir, "bad", "missing.yaml")
+	err := em.FeedFile(missing)
+	isTrue(t, err != nil)
+	isTrue(t, strings.HasPrefix(err.Error(), "failed to read script files for fragment missing in "+missing+": failed to read script file for script 0: open "))
+}
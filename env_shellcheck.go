@@ -0,0 +1,79 @@
+// Copyright (C) Kumo inc. and its affiliates.
+// Author: Jeff.li lijippy@163.com
+// All rights reserved.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package env
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// pwshParseScript asks the PowerShell parser to check the file named by
+// $args[0] without running it, printing every parse error it finds.
+const pwshParseScript = `$errs = $null; ` +
+	`[System.Management.Automation.Language.Parser]::ParseFile($args[0], [ref]$null, [ref]$errs) | Out-Null; ` +
+	`if ($errs.Count -gt 0) { $errs | ForEach-Object { $_.ToString() }; exit 1 }`
+
+// syntaxCheckCommand returns the interpreter and arguments used to check
+// the syntax of path for the given shell.
+func syntaxCheckCommand(path, shell string) (string, []string, error) {
+	switch shell {
+	case "bash":
+		return "bash", []string{"-n", path}, nil
+	case "zsh":
+		return "zsh", []string{"-n", path}, nil
+	case "pw", "pwsh", "powershell":
+		return "pwsh", []string{"-NoProfile", "-NonInteractive", "-Command", pwshParseScript, path}, nil
+	case "csh", "tcsh":
+		return shell, []string{"-f", "-n", path}, nil
+	case "fish":
+		return "fish", []string{"--no-execute", path}, nil
+	default:
+		return "", nil, fmt.Errorf("unsupported shell %q", shell)
+	}
+}
+
+// ValidateShellFile runs the syntax checker of the given shell (bash -n,
+// zsh -n, the PowerShell parser, csh -n, fish --no-execute) against a
+// generated file without executing it.
+// If the interpreter is not installed the check is skipped and nil is
+// returned, so it can be used as a best-effort safety net after a build.
+func ValidateShellFile(path, shell string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	name, args, err := syntaxCheckCommand(path, shell)
+	if err != nil {
+		return err
+	}
+	bin, err := exec.LookPath(name)
+	if err != nil {
+		return nil // interpreter not available, nothing to check with
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command(bin, args...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s syntax check failed for %s: %w: %s", shell, path, err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
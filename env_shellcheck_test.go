@@ -0,0 +1,64 @@
+package env
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func requireShell(tb testing.TB, name string) {
+	tb.Helper()
+
+	if _, err := exec.LookPath(name); err != nil {
+		tb.Skipf("%s not available", name)
+	}
+}
+
+func TestValidateShellFile(t *testing.T) {
+	requireShell(t, "bash")
+
+	em := &EnvManager{}
+	isNoErr(t, em.Feed(&EnvFragment{
+		Name:     "web",
+		Priority: 100,
+		Env:      map[string]string{"PORT": "8080"},
+		Script:   []Script{{Sh: "bash", Data: `if [ -z "$URL" ]; then export URL="http://localhost:$PORT"; fi`}},
+	}))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	dst := filepath.Join(t.TempDir(), "env.sh")
+	isNoErr(t, em.BuildBash(dst))
+	isNoErr(t, ValidateShellFile(dst, "bash"))
+}
+
+func TestValidateShellFileBroken(t *testing.T) {
+	requireShell(t, "bash")
+
+	em := &EnvManager{}
+	isNoErr(t, em.Feed(&EnvFragment{
+		Name:     "broken",
+		Priority: 100,
+		Script:   []Script{{Sh: "bash", Data: `if [ -z "$URL" ]; then`}},
+	}))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	dst := filepath.Join(t.TempDir(), "env.sh")
+	isNoErr(t, em.BuildBash(dst))
+	err := ValidateShellFile(dst, "bash")
+	isTrue(t, err != nil)
+	isTrue(t, strings.Contains(err.Error(), "bash syntax check failed"))
+}
+
+func TestValidateShellFileUnsupported(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "env.txt")
+	em := &EnvManager{}
+	isNoErr(t, em.SortAndMergeStrict())
+	isNoErr(t, em.BuildBash(dst))
+	isErrorWithMessage(t, ValidateShellFile(dst, "tcl"), `unsupported shell "tcl"`)
+}
+
+func TestValidateShellFileMissing(t *testing.T) {
+	err := ValidateShellFile(filepath.Join(t.TempDir(), "nope.sh"), "bash")
+	isTrue(t, err != nil)
+}
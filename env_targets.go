@@ -0,0 +1,205 @@
+// Copyright (C) Kumo inc. and its affiliates.
+// Author: Jeff.li lijippy@163.com
+// All rights reserved.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package env
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// TargetSpec describes one output file written by BuildTargets.
+type TargetSpec struct {
+	// Path is the file the target is written to.
+	Path string
+	// Shell selects the output format: "bash", "zsh", "pwsh" (or "pw",
+	// "powershell"), "cmd" (or "bat"), "nu" (or "nushell"), "csh" (or
+	// "tcsh") or "dotenv".
+	Shell string
+	// Allowlist and Denylist filter the keys of this target. They work like
+	// the EnvManager fields of the same name and apply on top of them.
+	Allowlist []string
+	Denylist  []string
+	// Tags and OS select the fragments of this target the way SetActiveTags
+	// and TargetOS select them for the merge: with Tags set only fragments
+	// carrying one of them or no tags at all, with OS set only fragments
+	// whose OS list is empty or holds it. Keys whose merged value comes from
+	// a fragment left out are left out as well.
+	Tags []string
+	OS   string
+}
+
+// selects reports whether the Tags and OS of spec select frag.
+func (spec TargetSpec) selects(frag *EnvFragment) bool {
+	if spec.OS != "" && len(frag.OS) > 0 && !slices.Contains(frag.OS, spec.OS) {
+		return false
+	}
+	return matchTags(frag, spec.Tags)
+}
+
+// shellDialects maps the shell names accepted by TargetSpec to their dialect.
+var shellDialects = map[string]shellDialect{
+	"bash":       bashDialect,
+	"zsh":        zshDialect,
+	"pw":         pwshDialect,
+	"pwsh":       pwshDialect,
+	"powershell": pwshDialect,
+	"cmd":        cmdDialect,
+	"bat":        cmdDialect,
+	"nu":         nuDialect,
+	"nushell":    nuDialect,
+	"csh":        cshDialect,
+	"tcsh":       cshDialect,
+}
+
+// BuildTargets writes every target in specs from the current merge, so that
+// several differently filtered outputs, e.g. a full file for development and
+// a restricted one for production, share a single load and merge. A failing
+// target does not stop the others; the errors of all failed targets are
+// returned together.
+func (e *EnvManager) BuildTargets(specs []TargetSpec) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if !e.sorted {
+		return fmt.Errorf("not build complete yet")
+	}
+	var errs []error
+	for _, spec := range specs {
+		if err := e.buildTarget(spec); err != nil {
+			errs = append(errs, fmt.Errorf("target %s: %w", spec.Path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// defaultShells lists the formats written by BuildAll when no shell is
+// named.
+var defaultShells = []string{"bash", "zsh", "pwsh"}
+
+// BuildAll writes the environment for each of shells to dir, creating it if
+// missing, as basename with the extension of the shell: basename.sh for
+// bash, basename.zsh, basename.ps1 for PowerShell, basename.bat for cmd,
+// basename.nu for Nushell, basename.csh for csh and basename.env for dotenv.
+// Shells takes the values of TargetSpec.Shell and defaults to bash, zsh and
+// pwsh. A failing file does not stop the others; their errors are returned
+// together.
+func (e *EnvManager) BuildAll(dir, basename string, shells ...string) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.buildAll(dir, basename, shells)
+}
+
+func (e *EnvManager) buildAll(dir, basename string, shells []string) error {
+	if !e.sorted {
+		return fmt.Errorf("not build complete yet")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	var errs []error
+	for _, shell := range shellsOrDefault(shells) {
+		ext, ok := shellExtensions[shell]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unsupported shell %q", shell))
+			continue
+		}
+		dst := filepath.Join(dir, basename+"."+ext)
+		if err := e.buildFormat(dst, shell, e.active, e.keyAllowed); err != nil {
+			errs = append(errs, fmt.Errorf("target %s: %w", dst, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// shellsOrDefault returns shells, or defaultShells if it is empty.
+func shellsOrDefault(shells []string) []string {
+	if len(shells) == 0 {
+		return defaultShells
+	}
+	return shells
+}
+
+// BuildIfChanged writes the files BuildAll writes for shells, with the same
+// default, and a WriteMetaJSON manifest, basename.meta.json, to dir, unless
+// the manifest there records the current Hash and all files exist. It
+// reports whether the files were written. A missing or unreadable manifest
+// causes a rebuild. Only what Hash covers is compared: set HashScripts to
+// rebuild on script changes, and delete the manifest after changing output
+// settings such as QuoteMode or Header.
+func (e *EnvManager) BuildIfChanged(dir, basename string, shells ...string) (bool, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	hash, err := e.hash()
+	if err != nil {
+		return false, err
+	}
+	metaPath := filepath.Join(dir, basename+".meta.json")
+	if meta, err := ReadMetaJSON(metaPath); err == nil && meta.Hash == hash && allBuilt(dir, basename, shells) {
+		e.log().Info("build skipped", "dir", dir, "hash", hash)
+		return false, nil
+	}
+	if err := e.buildAll(dir, basename, shells); err != nil {
+		return false, err
+	}
+	return true, e.writeMetaJSON(metaPath)
+}
+
+// allBuilt reports whether every file BuildAll writes for shells exists in
+// dir.
+func allBuilt(dir, basename string, shells []string) bool {
+	for _, shell := range shellsOrDefault(shells) {
+		if _, err := os.Stat(filepath.Join(dir, basename+"."+shellExtensions[shell])); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *EnvManager) buildTarget(spec TargetSpec) error {
+	var frags []*EnvFragment
+	for _, frag := range e.active {
+		if spec.selects(frag) {
+			frags = append(frags, frag)
+		}
+	}
+	allowed := func(key string) bool {
+		if !e.keyAllowed(key) || matchAnyKey(spec.Denylist, key) {
+			return false
+		}
+		if owner := e.owners[key]; owner != nil && !spec.selects(owner) {
+			return false
+		}
+		return len(spec.Allowlist) == 0 || matchAnyKey(spec.Allowlist, key)
+	}
+	return e.buildFormat(spec.Path, spec.Shell, frags, allowed)
+}
+
+// buildFormat writes frags to dst in the format named by shell, one of the
+// TargetSpec shells, leaving out the keys allowed rejects.
+func (e *EnvManager) buildFormat(dst, shell string, frags []*EnvFragment, allowed func(key string) bool) error {
+	if shell == "dotenv" {
+		return e.buildDotenv(dst, frags, allowed)
+	}
+	d, ok := shellDialects[shell]
+	if !ok {
+		return fmt.Errorf("unsupported shell %q", shell)
+	}
+	return e.buildShell(dst, d, frags, allowed)
+}
@@ -0,0 +1,186 @@
+package env
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildTargets(t *testing.T) {
+	em := newFilterManager(t)
+	em.Denylist = []string{"APP_HOST"}
+	dir := t.TempDir()
+	dev := filepath.Join(dir, "dev.sh")
+	prod := filepath.Join(dir, "prod.env")
+
+	isNoErr(t, em.BuildTargets([]TargetSpec{
+		{Path: dev, Shell: "bash"},
+		{Path: prod, Shell: "dotenv", Denylist: []string{"DB_*"}},
+	}))
+
+	data, err := os.ReadFile(dev)
+	isNoErr(t, err)
+	isTrue(t, strings.Contains(string(data), `export APP_PORT="8080"`))
+	isTrue(t, strings.Contains(string(data), `export DB_PASSWORD="hunter2"`))
+	isFalse(t, strings.Contains(string(data), "APP_HOST"))
+
+	data, err = os.ReadFile(prod)
+	isNoErr(t, err)
+	isTrue(t, strings.Contains(string(data), "APP_PORT=8080\n"))
+	isFalse(t, strings.Contains(string(data), "DB_PASSWORD"))
+	isFalse(t, strings.Contains(string(data), "APP_HOST"))
+}
+
+func TestBuildTargetsSelect(t *testing.T) {
+	em := &EnvManager{TargetOS: "windows"}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "base", Priority: 100, Env: map[string]string{"HOST": "localhost"}}))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "gpu", Priority: 110, Tags: []string{"gpu"}, Env: map[string]string{"CUDA": "1"}}))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "win", Priority: 120, OS: []string{"windows"}, Env: map[string]string{"TOOLS": "C:/tools"}}))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "prod", Priority: 130, Tags: []string{"prod"}, Env: map[string]string{"LOG": "warn"}}))
+	isNoErr(t, em.SortAndMergeStrict())
+	dir := t.TempDir()
+	prod := filepath.Join(dir, "prod.sh")
+	gpu := filepath.Join(dir, "gpu.env")
+
+	isNoErr(t, em.BuildTargets([]TargetSpec{
+		{Path: prod, Shell: "bash", Tags: []string{"prod"}, OS: "linux"},
+		{Path: gpu, Shell: "dotenv", Tags: []string{"gpu"}, OS: "windows"},
+	}))
+
+	data, err := os.ReadFile(prod)
+	isNoErr(t, err)
+	isTrue(t, strings.Contains(string(data), `export HOST="localhost"`))
+	isTrue(t, strings.Contains(string(data), `export LOG="warn"`))
+	isFalse(t, strings.Contains(string(data), "CUDA"))
+	isFalse(t, strings.Contains(string(data), "TOOLS"))
+
+	values := readDotenv(t, gpu)
+	isEqual(t, "localhost", values["HOST"])
+	isEqual(t, "1", values["CUDA"])
+	isEqual(t, "C:/tools", values["TOOLS"])
+	_, ok := values["LOG"]
+	isFalse(t, ok)
+}
+
+func TestBuildTargetsErrors(t *testing.T) {
+	em := newFilterManager(t)
+	dir := t.TempDir()
+	ok := filepath.Join(dir, "ok.ps1")
+
+	err := em.BuildTargets([]TargetSpec{
+		{Path: filepath.Join(dir, "a.tcl"), Shell: "tcl"},
+		{Path: ok, Shell: "pwsh", Allowlist: []string{"APP_PORT"}},
+		{Path: filepath.Join(dir, "missing", "b.sh"), Shell: "bash"},
+	})
+	isTrue(t, err != nil)
+	isTrue(t, strings.Contains(err.Error(), `a.tcl: unsupported shell "tcl"`))
+	isTrue(t, strings.Contains(err.Error(), "b.sh: open"))
+
+	data, err := os.ReadFile(ok)
+	isNoErr(t, err)
+	isTrue(t, strings.Contains(string(data), `$Env:APP_PORT = "8080"`))
+	isFalse(t, strings.Contains(string(data), "DB_PASSWORD"))
+
+	isErrorWithMessage(t, (&EnvManager{}).BuildTargets(nil), "not build complete yet")
+}
+
+func TestBuildAll(t *testing.T) {
+	em := newFilterManager(t)
+	dir := filepath.Join(t.TempDir(), "out", "env")
+	isNoErr(t, em.BuildAll(dir, "generated"))
+
+	for _, tt := range []struct {
+		name  string
+		build func(*EnvManager, string) error
+	}{
+		{"generated.sh", (*EnvManager).BuildBash},
+		{"generated.zsh", (*EnvManager).BuildZsh},
+		{"generated.ps1", (*EnvManager).BuildPsh},
+	} {
+		got, err := os.ReadFile(filepath.Join(dir, tt.name))
+		isNoErr(t, err)
+		want := filepath.Join(t.TempDir(), tt.name)
+		isNoErr(t, tt.build(em, want))
+		data, err := os.ReadFile(want)
+		isNoErr(t, err)
+		isEqual(t, string(data), string(got))
+	}
+	entries, err := os.ReadDir(dir)
+	isNoErr(t, err)
+	isEqual(t, 3, len(entries))
+
+	isErrorWithMessage(t, (&EnvManager{}).BuildAll(dir, "generated"), "not build complete yet")
+}
+
+func TestBuildAllShells(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "app", Priority: 100, Env: map[string]string{"PEM": "a\nb"}}))
+	isNoErr(t, em.SortAndMergeStrict())
+	dir := t.TempDir()
+
+	// a multi-line value is fine for the default shells
+	isNoErr(t, em.BuildAll(dir, "default"))
+	built, err := em.BuildIfChanged(dir, "default")
+	isNoErr(t, err)
+	isTrue(t, built)
+	built, err = em.BuildIfChanged(dir, "default")
+	isNoErr(t, err)
+	isFalse(t, built)
+
+	err = em.BuildAll(dir, "more", "nu", "cmd", "dotenv", "fish")
+	isErrorWithMessage(t, err, fmt.Sprintf("target %s: key PEM in fragment app: value contains a line break, which cmd cannot represent\n", filepath.Join(dir, "more.bat"))+
+		`unsupported shell "fish"`)
+	for _, name := range []string{"more.nu", "more.env"} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		isNoErr(t, err)
+	}
+}
+
+func TestBuildIfChanged(t *testing.T) {
+	em := newFilterManager(t)
+	dir := filepath.Join(t.TempDir(), "env")
+
+	built, err := em.BuildIfChanged(dir, "generated")
+	isNoErr(t, err)
+	isTrue(t, built)
+	meta, err := ReadMetaJSON(filepath.Join(dir, "generated.meta.json"))
+	isNoErr(t, err)
+	hash, err := em.Hash()
+	isNoErr(t, err)
+	isEqual(t, hash, meta.Hash)
+
+	// unchanged: nothing is written
+	sh := filepath.Join(dir, "generated.sh")
+	isNoErr(t, os.WriteFile(sh, []byte("edited\n"), 0o644))
+	built, err = em.BuildIfChanged(dir, "generated")
+	isNoErr(t, err)
+	isFalse(t, built)
+	data, err := os.ReadFile(sh)
+	isNoErr(t, err)
+	isEqual(t, "edited\n", string(data))
+
+	// a missing file, a corrupt manifest and a changed environment rebuild
+	isNoErr(t, os.Remove(filepath.Join(dir, "generated.ps1")))
+	built, err = em.BuildIfChanged(dir, "generated")
+	isNoErr(t, err)
+	isTrue(t, built)
+
+	isNoErr(t, os.WriteFile(filepath.Join(dir, "generated.meta.json"), []byte("{broken"), 0o644))
+	built, err = em.BuildIfChanged(dir, "generated")
+	isNoErr(t, err)
+	isTrue(t, built)
+
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "more", Priority: 300, Env: map[string]string{"EXTRA": "1"}}))
+	isNoErr(t, em.SortAndMergeStrict())
+	built, err = em.BuildIfChanged(dir, "generated")
+	isNoErr(t, err)
+	isTrue(t, built)
+	data, err = os.ReadFile(sh)
+	isNoErr(t, err)
+	isTrue(t, strings.Contains(string(data), `export EXTRA="1"`))
+
+	_, err = (&EnvManager{}).BuildIfChanged(dir, "generated")
+	isErrorWithMessage(t, err, "not build complete yet")
+}
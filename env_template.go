@@ -0,0 +1,103 @@
+// Copyright (C) Kumo inc. and its affiliates.
+// Author: Jeff.li lijippy@163.com
+// All rights reserved.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package env
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// ExpandTemplates runs the merged values containing "{{" through
+// text/template, for values computed from other variables such as
+//
+//	CACHE_DIR: "{{ .HOME }}/.cache/myapp"
+//
+// The template data maps every merged variable, and every variable of the
+// process environment the merge does not set, to its value. Values are
+// expanded once against the values before expansion, so a template referring
+// to another templated variable sees its template text. A reference to a
+// variable that is not set is an error; use env and default for optional
+// ones. The functions available are:
+//
+//	env NAME         the variable NAME, or "" if it is not set
+//	default DEF V    V, or DEF if V is empty: {{ env "PORT" | default "80" }}
+//	upper S, lower S S in upper or lower case
+//
+// funcs adds functions or replaces the ones above. Every failing value is
+// reported, naming its key, and the merged map is left unchanged.
+func (e *EnvManager) ExpandTemplates(funcs template.FuncMap) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.sorted {
+		return fmt.Errorf("not build complete yet")
+	}
+
+	data := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok && k != "" {
+			data[k] = v
+		}
+	}
+	for k, v := range e.merged {
+		data[k] = v
+	}
+	fm := template.FuncMap{
+		"env": func(name string) string { return data[name] },
+		"default": func(def, v string) string {
+			if v == "" {
+				return def
+			}
+			return v
+		},
+		"upper": strings.ToUpper,
+		"lower": strings.ToLower,
+	}
+	for name, fn := range funcs {
+		fm[name] = fn
+	}
+
+	expanded := make(map[string]string)
+	var errs []error
+	for _, k := range sortedKeys(e.merged) {
+		v := e.merged[k]
+		if !strings.Contains(v, "{{") {
+			continue
+		}
+		tmpl, err := template.New(k).Funcs(fm).Option("missingkey=error").Parse(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("key %s: %w", k, err))
+			continue
+		}
+		var sb strings.Builder
+		if err := tmpl.Execute(&sb, data); err != nil {
+			errs = append(errs, fmt.Errorf("key %s: %w", k, err))
+			continue
+		}
+		expanded[k] = sb.String()
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("template expansion failed: %w", errors.Join(errs...))
+	}
+	for k, v := range expanded {
+		e.merged[k] = v
+	}
+	return nil
+}
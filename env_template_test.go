@@ -0,0 +1,49 @@
+package env
+
+import (
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestExpandTemplates(t *testing.T) {
+	t.Setenv("TEMPLATE_TEST_HOME", "/home/dev")
+	em := &EnvManager{}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "app", Priority: 100, Env: map[string]string{
+		"NAME":      "MyApp",
+		"CACHE_DIR": "{{ .TEMPLATE_TEST_HOME }}/.cache/{{ lower .NAME }}",
+		"PORT":      `{{ env "TEMPLATE_TEST_PORT" | default "8080" }}`,
+		"LABEL":     "{{ upper .NAME }}-{{ greet }}",
+		"PLAIN":     "$HOME/{ not a template }",
+	}}))
+
+	isErrorWithMessage(t, em.ExpandTemplates(nil), "not build complete yet")
+	isNoErr(t, em.SortAndMergeStrict())
+	isNoErr(t, em.ExpandTemplates(template.FuncMap{"greet": func() string { return "hi" }}))
+	isEqual(t, map[string]string{
+		"NAME":      "MyApp",
+		"CACHE_DIR": "/home/dev/.cache/myapp",
+		"PORT":      "8080",
+		"LABEL":     "MYAPP-hi",
+		"PLAIN":     "$HOME/{ not a template }",
+	}, em.Merged())
+}
+
+func TestExpandTemplatesErrors(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "app", Priority: 100, Env: map[string]string{
+		"TYPO":   "{{ .TEMPLATE_TEST_MISSING }}",
+		"BROKEN": "{{ .NAME ",
+		"OK":     `{{ "fine" }}`,
+	}}))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	err := em.ExpandTemplates(nil)
+	isTrue(t, err != nil)
+	msg := err.Error()
+	isTrue(t, strings.HasPrefix(msg, "template expansion failed: key BROKEN: "))
+	isTrue(t, strings.Contains(msg, "\nkey TYPO: "))
+	isTrue(t, strings.Contains(msg, `map has no entry for key "TEMPLATE_TEST_MISSING"`))
+	// nothing is expanded on failure
+	isEqual(t, `{{ "fine" }}`, em.Merged()["OK"])
+}
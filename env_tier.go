@@ -0,0 +1,174 @@
+// Copyright (C) Kumo inc. and its affiliates.
+// Author: Jeff.li lijippy@163.com
+// All rights reserved.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package env
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Tier is the priority band a fragment belongs to.
+type Tier string
+
+const (
+	TierSystem   Tier = "system"   // priorities 0-19
+	TierInternal Tier = "internal" // priorities 20-99
+	TierCustom   Tier = "custom"   // priorities 100 and above
+)
+
+// tierOf returns the tier of a fragment from its priority.
+func tierOf(frag *EnvFragment) Tier {
+	switch {
+	case frag.Priority < 20:
+		return TierSystem
+	case frag.Priority < 100:
+		return TierInternal
+	}
+	return TierCustom
+}
+
+// PriorityInfo describes where a fragment sits in the priority bands.
+type PriorityInfo struct {
+	Name     string
+	Source   string
+	Priority int
+	// Tier is the band the priority falls in.
+	Tier Tier
+	// Expected is the tier the name is registered for: TierSystem with
+	// RegisterSystemFragment, TierInternal with RegisterInnerComponent and
+	// TierCustom otherwise. It differs from Tier for fragments accepted
+	// with LenientPriorities outside their band.
+	Expected Tier
+	// AtBoundary is set for the priorities next to another band, 19, 20,
+	// 99 and 100, where an off-by-one changes the tier.
+	AtBoundary bool
+}
+
+// PriorityReport lists the tier of every loaded fragment in the order
+// SortAndMerge merges them. It does not need a merge.
+func (e *EnvManager) PriorityReport() []PriorityInfo {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	var report []PriorityInfo
+	for _, frag := range e.fragmentsByPriority() {
+		report = append(report, PriorityInfo{
+			Name:       frag.Name,
+			Source:     frag.Source,
+			Priority:   frag.Priority,
+			Tier:       tierOf(frag),
+			Expected:   registeredTier(frag.Name),
+			AtBoundary: frag.Priority == 19 || frag.Priority == 20 || frag.Priority == 99 || frag.Priority == 100,
+		})
+	}
+	return report
+}
+
+// registeredTier returns the tier name is registered for.
+func registeredTier(name string) Tier {
+	tierMu.RLock()
+	defer tierMu.RUnlock()
+	switch {
+	case SystemEnv[name] > 0:
+		return TierSystem
+	case InnerComponentEnv[name] > 0:
+		return TierInternal
+	}
+	return TierCustom
+}
+
+// VariableTiers maps every merged key to the tier of the fragment whose value
+// won the merge. It returns nil before SortAndMerge.
+func (e *EnvManager) VariableTiers() map[string]Tier {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.variableTiers()
+}
+
+func (e *EnvManager) variableTiers() map[string]Tier {
+	if !e.sorted {
+		return nil
+	}
+	tiers := make(map[string]Tier, len(e.owners))
+	for k, frag := range e.owners {
+		tiers[k] = tierOf(frag)
+	}
+	return tiers
+}
+
+// shellExtensions maps the shells accepted by BuildByTier and BuildAll to a
+// file extension.
+var shellExtensions = map[string]string{
+	"bash":       "sh",
+	"zsh":        "zsh",
+	"pw":         "ps1",
+	"pwsh":       "ps1",
+	"powershell": "ps1",
+	"cmd":        "bat",
+	"bat":        "bat",
+	"nu":         "nu",
+	"nushell":    "nu",
+	"csh":        "csh",
+	"tcsh":       "csh",
+	"dotenv":     "env",
+}
+
+// BuildByTier writes one file per tier to dir, system.<ext>, internal.<ext>
+// and custom.<ext>, in the format named by shell, which takes the same values
+// as TargetSpec.Shell. Each file holds the fragments of its tier and only the
+// keys whose final value comes from that tier, as reported by VariableTiers,
+// along with the unset statements of the keys its fragments remove, so the
+// files can be deployed as independent layers and sourced in tier order.
+// Every tier file is written, even when empty.
+func (e *EnvManager) BuildByTier(dir, shell string) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if !e.sorted {
+		return fmt.Errorf("not build complete yet")
+	}
+	ext, ok := shellExtensions[shell]
+	if !ok {
+		return fmt.Errorf("unsupported shell %q", shell)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	tiers := e.variableTiers()
+	var errs []error
+	for _, tier := range []Tier{TierSystem, TierInternal, TierCustom} {
+		var frags []*EnvFragment
+		for _, frag := range e.active {
+			if tierOf(frag) == tier {
+				frags = append(frags, frag)
+			}
+		}
+		allowed := func(key string) bool {
+			if unsetBy := e.unset[key]; unsetBy != nil {
+				return e.keyAllowed(key) && tierOf(unsetBy) == tier
+			}
+			return e.keyAllowed(key) && tiers[key] == tier
+		}
+		dst := filepath.Join(dir, string(tier)+"."+ext)
+		if err := e.buildFormat(dst, shell, frags, allowed); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
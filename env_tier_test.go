@@ -0,0 +1,109 @@
+package env
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildByTier(t *testing.T) {
+	RegisterSystemFragment("os")
+	RegisterInnerComponent("runtime")
+	t.Cleanup(func() {
+		UnregisterSystemFragment("os")
+		UnregisterInnerComponent("runtime")
+	})
+
+	em := &EnvManager{}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "os", Priority: 10, Env: map[string]string{
+		"LANG": "C",
+		"PATH": "/usr/bin",
+	}}))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "runtime", Priority: 50, Env: map[string]string{
+		"LANG":     "en_US.UTF-8",
+		"APP_HOME": "/opt/app",
+	}}))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "user", Priority: 100, Env: map[string]string{
+		"APP_HOME": "/home/user/app",
+	}}))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	isEqual(t, map[string]Tier{
+		"PATH":     TierSystem,
+		"LANG":     TierInternal,
+		"APP_HOME": TierCustom,
+	}, em.VariableTiers())
+
+	dir := filepath.Join(t.TempDir(), "tiers")
+	isNoErr(t, em.BuildByTier(dir, "dotenv"))
+	for file, want := range map[string][]string{
+		"system.env":   {"PATH=/usr/bin"},
+		"internal.env": {"LANG=en_US.UTF-8"},
+		"custom.env":   {"APP_HOME=/home/user/app"},
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		isNoErr(t, err)
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		isTrue(t, strings.HasPrefix(lines[0], "ENV_CTIME="))
+		isEqual(t, want, lines[1:])
+	}
+
+	isNoErr(t, em.BuildByTier(dir, "bash"))
+	data, err := os.ReadFile(filepath.Join(dir, "system.sh"))
+	isNoErr(t, err)
+	isTrue(t, strings.Contains(string(data), `export PATH="/usr/bin"`))
+	isFalse(t, strings.Contains(string(data), "LANG"))
+	isFalse(t, strings.Contains(string(data), "Fragment: runtime"))
+
+	isErrorWithMessage(t, em.BuildByTier(dir, "tcl"), `unsupported shell "tcl"`)
+	isErrorWithMessage(t, (&EnvManager{}).BuildByTier(dir, "bash"), "not build complete yet")
+	isTrue(t, (&EnvManager{}).VariableTiers() == nil)
+}
+
+func TestBuildByTierUnset(t *testing.T) {
+	RegisterSystemFragment("os")
+	t.Cleanup(func() { UnregisterSystemFragment("os") })
+
+	em := &EnvManager{}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "os", Priority: 10, Env: map[string]string{"FOO": "system", "BAR": "system"}}))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "user", Priority: 100, Unset: []string{"FOO"}}))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	dir := t.TempDir()
+	isNoErr(t, em.BuildByTier(dir, "bash"))
+	system, err := os.ReadFile(filepath.Join(dir, "system.sh"))
+	isNoErr(t, err)
+	isFalse(t, strings.Contains(string(system), "FOO"))
+	custom, err := os.ReadFile(filepath.Join(dir, "custom.sh"))
+	isNoErr(t, err)
+	isTrue(t, strings.Contains(string(custom), "\nunset FOO\n"))
+
+	requireShell(t, "bash")
+	out, err := exec.Command("bash", "-c", `FOO=inherited; for f in system internal custom; do . "$1/$f.sh"; done; echo "${FOO-unset} $BAR"`, "bash", dir).Output()
+	isNoErr(t, err)
+	isEqual(t, "unset system\n", string(out))
+}
+
+func TestPriorityReport(t *testing.T) {
+	RegisterSystemFragment("os")
+	RegisterInnerComponent("runtime")
+	t.Cleanup(func() {
+		UnregisterSystemFragment("os")
+		UnregisterInnerComponent("runtime")
+	})
+
+	em := &EnvManager{LenientPriorities: true}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "user", Priority: 150, Source: "user.yaml"}))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "runtime", Priority: 20}))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "os", Priority: 5}))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "tool", Priority: 99}))
+
+	isEqual(t, []PriorityInfo{
+		{Name: "os", Priority: 5, Tier: TierSystem, Expected: TierSystem},
+		{Name: "runtime", Priority: 20, Tier: TierInternal, Expected: TierInternal, AtBoundary: true},
+		{Name: "tool", Priority: 99, Tier: TierInternal, Expected: TierCustom, AtBoundary: true},
+		{Name: "user", Source: "user.yaml", Priority: 150, Tier: TierCustom, Expected: TierCustom},
+	}, em.PriorityReport())
+}
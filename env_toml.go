@@ -0,0 +1,89 @@
+// Copyright (C) Kumo inc. and its affiliates.
+// Author: Jeff.li lijippy@163.com
+// All rights reserved.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package env
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// FeedTOML reads a fragment written in TOML and adds it to the manager. The
+// schema is the one of the YAML form, with the same keys:
+//
+//	name = "app"
+//	priority = 100
+//	allow_override = ["PORT"]
+//
+//	[env]
+//	PORT = "8080"
+//
+//	[[script]]
+//	sh = "bash"
+//	data = "echo hello"
+//
+// A TOML file holds a single fragment.
+func (e *EnvManager) FeedTOML(fpath string) error {
+	return e.feedTOML(fpath, nil, nil)
+}
+
+// feedTOML converts the TOML fragment at fpath to YAML and feeds it through
+// feedReader, so both forms are decoded and validated the same way. The file
+// is read from fsys, or from the OS file system if fsys is nil.
+func (e *EnvManager) feedTOML(fpath string, fsys fs.FS, report func(error)) error {
+	var data []byte
+	var err error
+	if fsys != nil {
+		data, err = fs.ReadFile(fsys, fpath)
+	} else {
+		data, err = os.ReadFile(fpath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read file %s: %w", fpath, err)
+	}
+	var doc map[string]interface{}
+	if err := toml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse TOML in %s: %w", fpath, err)
+	}
+	if len(doc) == 0 {
+		return nil
+	}
+	if e.StrictSchema {
+		var node yaml.Node
+		if err := node.Encode(doc); err != nil {
+			return fmt.Errorf("failed to convert TOML in %s: %w", fpath, err)
+		}
+		if err := checkKnownFields(&node); err != nil {
+			return fmt.Errorf("failed to parse TOML in %s: %w", fpath, err)
+		}
+	}
+	converted, err := yaml.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("failed to convert TOML in %s: %w", fpath, err)
+	}
+	return e.feedReader(bytes.NewReader(converted), fpath, fsys, report)
+}
+
+func isTOMLFile(name string) bool {
+	return strings.HasSuffix(name, ".toml")
+}
@@ -0,0 +1,103 @@
+package env
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const tomlFragment = `name = "app"
+priority = 110
+allow_override = ["PORT"]
+tags = ["dev"]
+
+[env]
+PORT = 8080
+HOST = "localhost"
+
+[[script]]
+sh = ["bash", "zsh"]
+data = "echo hello"
+`
+
+func TestFeedTOML(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"app.toml": tomlFragment})
+	fpath := filepath.Join(dir, "app.toml")
+
+	em := &EnvManager{}
+	isNoErr(t, em.FeedTOML(fpath))
+	frags := em.Fragments()
+	isEqual(t, 1, len(frags))
+	frag := frags[0]
+	isEqual(t, "app", frag.Name)
+	isEqual(t, 110, frag.Priority)
+	isEqual(t, fpath, frag.Source)
+	isEqual(t, []string{"PORT"}, frag.AllowOverride)
+	isEqual(t, []string{"dev"}, frag.Tags)
+	isEqual(t, map[string]string{"PORT": "8080", "HOST": "localhost"}, frag.Env)
+	isEqual(t, []Script{{Shells: []string{"bash", "zsh"}, Data: "echo hello"}}, frag.Script)
+
+	// the same fragment in YAML yields the same result
+	yem := &EnvManager{}
+	isNoErr(t, yem.FeedReader(strings.NewReader(`name: app
+priority: 110
+allow_override: [PORT]
+tags: [dev]
+env:
+  PORT: 8080
+  HOST: localhost
+script:
+  - sh: [bash, zsh]
+    data: echo hello
+`), fpath))
+	yfrag := *yem.Fragments()[0]
+	yfrag.LoadedAt, yfrag.node = frag.LoadedAt, frag.node
+	isEqual(t, yfrag, *frag)
+}
+
+func TestFeedTOMLErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"bad.toml":   "name = \n",
+		"low.toml":   "name = \"low\"\npriority = 5\n",
+		"empty.toml": "",
+	})
+
+	em := &EnvManager{}
+	err := em.FeedTOML(filepath.Join(dir, "bad.toml"))
+	isTrue(t, err != nil)
+	isTrue(t, strings.HasPrefix(err.Error(), "failed to parse TOML in "+filepath.Join(dir, "bad.toml")))
+	isErrorWithMessage(t, em.FeedTOML(filepath.Join(dir, "low.toml")),
+		"validation failed for fragment low in "+filepath.Join(dir, "low.toml")+": custom fragment low priority must >=100, got 5")
+	isNoErr(t, em.FeedTOML(filepath.Join(dir, "empty.toml")))
+	isEqual(t, 0, len(em.Fragments()))
+}
+
+func TestFeedDirTOML(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"app.toml":  tomlFragment,
+		"base.yaml": "name: base\npriority: 100\nenv:\n  PORT: \"80\"\n",
+	})
+
+	em := &EnvManager{}
+	isNoErr(t, em.FeedDir(dir))
+	isEqual(t, 1, len(em.Fragments()))
+
+	em = &EnvManager{TOMLFiles: true}
+	isNoErr(t, em.FeedDir(dir))
+	isEqual(t, 2, len(em.Fragments()))
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, "8080", em.Merged()["PORT"])
+
+	em = &EnvManager{TOMLFiles: true}
+	isNoErr(t, em.FeedDirRecursive(dir))
+	isEqual(t, 2, len(em.Fragments()))
+
+	em = &EnvManager{TOMLFiles: true}
+	errs, err := em.FeedDirCollect(dir)
+	isNoErr(t, err)
+	isEqual(t, 0, len(errs))
+	isEqual(t, 2, len(em.Fragments()))
+}
@@ -0,0 +1,297 @@
+// Copyright (C) Kumo inc. and its affiliates.
+// Author: Jeff.li lijippy@163.com
+// All rights reserved.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package env
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Warning is a non-fatal problem reported by Validate.
+type Warning struct {
+	Key      string // env key the warning is about, if any
+	Fragment string // fragment the warning is about, if any
+	Message  string
+}
+
+func (w Warning) String() string {
+	switch {
+	case w.Key != "" && w.Fragment != "":
+		return fmt.Sprintf("%s (fragment %s): %s", w.Key, w.Fragment, w.Message)
+	case w.Key != "":
+		return fmt.Sprintf("%s: %s", w.Key, w.Message)
+	case w.Fragment != "":
+		return fmt.Sprintf("fragment %s: %s", w.Fragment, w.Message)
+	}
+	return w.Message
+}
+
+// ValidateOptions selects the optional checks run by Validate.
+type ValidateOptions struct {
+	// CheckRepresentations flags keys whose values look like different
+	// representations of the same thing across fragments, e.g. DEBUG=true in
+	// one fragment and DEBUG=1 in another. The check is heuristic.
+	CheckRepresentations bool
+
+	// CheckTemplateMarkers flags merged values that still contain template
+	// markers, which usually means a templating step did not run on them.
+	// It needs a completed SortAndMerge and only looks at keys the Build*
+	// functions write.
+	CheckTemplateMarkers bool
+	// TemplateMarkers overrides the markers looked for by
+	// CheckTemplateMarkers. The default is DefaultTemplateMarkers.
+	TemplateMarkers []string
+
+	// CheckLineBreaks flags merged values containing line breaks, such as a
+	// PEM key. The shell builders write them on one line with escape
+	// sequences, but BuildCmd cannot represent them and fails. It needs a
+	// completed SortAndMerge and only looks at keys the Build* functions
+	// write.
+	CheckLineBreaks bool
+}
+
+// DefaultTemplateMarkers are the markers CheckTemplateMarkers looks for
+// unless ValidateOptions.TemplateMarkers is set: Go and Jinja style
+// delimiters and an unresolved shell style ${ reference.
+var DefaultTemplateMarkers = []string{"{{", "}}", "${"}
+
+// Validate runs the checks selected by opts over the loaded fragments and
+// returns the warnings found. Problems tolerated while feeding, such as
+// priority band violations with LenientPriorities, come first in load order,
+// followed by the optional checks ordered by key. It does not require
+// SortAndMerge.
+func (e *EnvManager) Validate(opts ValidateOptions) []Warning {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	warnings := append([]Warning(nil), e.warnings...)
+	if opts.CheckRepresentations {
+		warnings = append(warnings, e.checkRepresentations()...)
+	}
+	if opts.CheckTemplateMarkers {
+		markers := opts.TemplateMarkers
+		if markers == nil {
+			markers = DefaultTemplateMarkers
+		}
+		warnings = append(warnings, e.checkTemplateMarkers(markers)...)
+	}
+	if opts.CheckLineBreaks {
+		warnings = append(warnings, e.checkLineBreaks()...)
+	}
+	return warnings
+}
+
+// fragmentsByPriority returns the fragments in the merge order of
+// SortAndMerge without reordering the manager's own slice.
+func (e *EnvManager) fragmentsByPriority() []*EnvFragment {
+	frags := append([]*EnvFragment(nil), e.fragments...)
+	sort.SliceStable(frags, func(i, j int) bool {
+		return fragmentLess(frags[i], frags[j])
+	})
+	return frags
+}
+
+func (e *EnvManager) checkRepresentations() []Warning {
+	type setting struct {
+		fragment string
+		value    string
+	}
+	settings := make(map[string][]setting)
+	for _, frag := range e.fragmentsByPriority() {
+		for k, v := range frag.Env {
+			settings[k] = append(settings[k], setting{frag.Name, v})
+		}
+	}
+
+	var warnings []Warning
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if len(settings[k]) < 2 {
+			continue
+		}
+		values := make([]string, 0, len(settings[k]))
+		for _, s := range settings[k] {
+			values = append(values, s.value)
+		}
+		concept := inconsistentRepresentation(values)
+		if concept == "" {
+			continue
+		}
+		parts := make([]string, 0, len(settings[k]))
+		for _, s := range settings[k] {
+			parts = append(parts, fmt.Sprintf("%q (%s)", s.value, s.fragment))
+		}
+		warnings = append(warnings, Warning{
+			Key:     k,
+			Message: fmt.Sprintf("inconsistent %s representations: %s", concept, strings.Join(parts, ", ")),
+		})
+	}
+	return warnings
+}
+
+// inconsistentRepresentation returns "boolean" or "numeric" when all values
+// express that kind of value but in more than one style, and "" otherwise.
+func inconsistentRepresentation(values []string) string {
+	boolStyles := make(map[string]bool)
+	numStyles := make(map[string]bool)
+	allBool, allNum := true, true
+	for _, v := range values {
+		if style, ok := booleanStyle(v); ok {
+			boolStyles[style] = true
+		} else {
+			allBool = false
+		}
+		if style, ok := numericStyle(v); ok {
+			numStyles[style] = true
+		} else {
+			allNum = false
+		}
+	}
+	switch {
+	case allBool && len(boolStyles) > 1:
+		return "boolean"
+	case allNum && len(numStyles) > 1:
+		return "numeric"
+	}
+	return ""
+}
+
+func booleanStyle(v string) (string, bool) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "true", "false":
+		return "true/false", true
+	case "yes", "no":
+		return "yes/no", true
+	case "on", "off":
+		return "on/off", true
+	case "1", "0":
+		return "1/0", true
+	}
+	return "", false
+}
+
+func numericStyle(v string) (string, bool) {
+	v = strings.TrimSpace(v)
+	if _, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return "integer", true
+	}
+	if _, err := strconv.ParseInt(v, 0, 64); err == nil {
+		return "prefixed integer", true
+	}
+	if _, err := strconv.ParseFloat(v, 64); err == nil {
+		return "decimal", true
+	}
+	return "", false
+}
+
+// checkTemplateMarkers warns about every merged key whose value contains one
+// of markers. It reports nothing before SortAndMerge.
+func (e *EnvManager) checkTemplateMarkers(markers []string) []Warning {
+	if !e.sorted {
+		return nil
+	}
+	var warnings []Warning
+	for _, k := range sortedKeys(e.merged) {
+		if !e.keyAllowed(k) {
+			continue
+		}
+		var found []string
+		for _, m := range markers {
+			if m != "" && strings.Contains(e.merged[k], m) {
+				found = append(found, strconv.Quote(m))
+			}
+		}
+		if len(found) == 0 {
+			continue
+		}
+		warnings = append(warnings, Warning{
+			Key:      k,
+			Fragment: e.owners[k].Name,
+			Message:  fmt.Sprintf("value contains template markers %s", strings.Join(found, ", ")),
+		})
+	}
+	return warnings
+}
+
+// checkLineBreaks warns about every merged key whose value contains a line
+// break. It reports nothing before SortAndMerge.
+func (e *EnvManager) checkLineBreaks() []Warning {
+	if !e.sorted {
+		return nil
+	}
+	var warnings []Warning
+	for _, k := range sortedKeys(e.merged) {
+		if e.keyAllowed(k) && hasLineBreak(e.merged[k]) {
+			warnings = append(warnings, Warning{Key: k, Fragment: e.owners[k].Name, Message: "value contains a line break"})
+		}
+	}
+	return warnings
+}
+
+// malformedValues reports the values of frag, including defaults and shell
+// overrides, that are not valid UTF-8 or contain a byte order mark or a
+// control character other than a tab or line break, ordered by key. Such
+// values often come from copying out of Windows tools and silently break the
+// generated files.
+func malformedValues(frag *EnvFragment) []Warning {
+	var problems []Warning
+	check := func(k, v string) {
+		if msg := malformedValue(v); msg != "" {
+			problems = append(problems, Warning{Key: k, Fragment: frag.Name, Message: msg})
+		}
+	}
+	for _, k := range sortedKeys(frag.Env) {
+		check(k, frag.Env[k])
+	}
+	for _, k := range sortedKeys(frag.Defaults) {
+		check(k, frag.Defaults[k])
+	}
+	for _, sh := range sortedKeys(frag.ShellEnv) {
+		for _, k := range sortedKeys(frag.ShellEnv[sh]) {
+			check(k, frag.ShellEnv[sh][k])
+		}
+	}
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Key < problems[j].Key
+	})
+	return problems
+}
+
+// malformedValue describes what is wrong with v, or returns "" if nothing is.
+func malformedValue(v string) string {
+	if !utf8.ValidString(v) {
+		return "value is not valid UTF-8"
+	}
+	for _, c := range v {
+		switch {
+		case c == '\ufeff':
+			return "value contains a byte order mark"
+		case c == '\t' || c == '\n' || c == '\r':
+		case unicode.IsControl(c):
+			return fmt.Sprintf("value contains control character %U", c)
+		}
+	}
+	return ""
+}
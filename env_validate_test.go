@@ -0,0 +1,198 @@
+package env
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateRepresentations(t *testing.T) {
+	em := &EnvManager{}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "override", Priority: 150, Env: map[string]string{
+		"DEBUG":   "1",
+		"VERBOSE": "false",
+		"TIMEOUT": "1.5",
+		"PORT":    "8080",
+		"NAME":    "b",
+	}}))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "base", Priority: 100, Env: map[string]string{
+		"DEBUG":   "true",
+		"VERBOSE": "true",
+		"TIMEOUT": "2",
+		"PORT":    "9090",
+		"NAME":    "a",
+	}}))
+
+	isEqual(t, 0, len(em.Validate(ValidateOptions{})))
+
+	warnings := em.Validate(ValidateOptions{CheckRepresentations: true})
+	isEqual(t, []Warning{
+		{Key: "DEBUG", Message: `inconsistent boolean representations: "true" (base), "1" (override)`},
+		{Key: "TIMEOUT", Message: `inconsistent numeric representations: "2" (base), "1.5" (override)`},
+	}, warnings)
+	isEqual(t, `DEBUG: inconsistent boolean representations: "true" (base), "1" (override)`, warnings[0].String())
+}
+
+func TestValidateTemplateMarkers(t *testing.T) {
+	em := &EnvManager{Denylist: []string{"IGNORED"}}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "app", Priority: 100, Env: map[string]string{
+		"URL":     "http://{{ .Host }}:8080",
+		"HOME":    "${APP_HOME}/data",
+		"CLEAN":   "http://localhost:8080",
+		"PRICE":   "$5",
+		"IGNORED": "{{ .Secret }}",
+		"JINJA":   "<%= name %>",
+	}}))
+
+	// markers are only checked after the merge
+	isEqual(t, 0, len(em.Validate(ValidateOptions{CheckTemplateMarkers: true})))
+
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, []Warning{
+		{Key: "HOME", Fragment: "app", Message: `value contains template markers "${"`},
+		{Key: "URL", Fragment: "app", Message: `value contains template markers "{{", "}}"`},
+	}, em.Validate(ValidateOptions{CheckTemplateMarkers: true}))
+
+	isEqual(t, []Warning{
+		{Key: "JINJA", Fragment: "app", Message: `value contains template markers "<%"`},
+	}, em.Validate(ValidateOptions{CheckTemplateMarkers: true, TemplateMarkers: []string{"<%"}}))
+}
+
+func TestInconsistentRepresentation(t *testing.T) {
+	for _, tt := range []struct {
+		values []string
+		want   string
+	}{
+		{[]string{"true", "1"}, "boolean"},
+		{[]string{"yes", "off"}, "boolean"},
+		{[]string{"true", "FALSE"}, ""},
+		{[]string{"1", "0"}, ""},
+		{[]string{"1", "2"}, ""},
+		{[]string{"16", "0x10"}, "numeric"},
+		{[]string{"1", "1.0"}, "numeric"},
+		{[]string{"true", "maybe"}, ""},
+		{[]string{"abc", "def"}, ""},
+	} {
+		isEqual(t, tt.want, inconsistentRepresentation(tt.values))
+	}
+}
+
+func TestPriorityBandStrict(t *testing.T) {
+	em := &EnvManager{}
+	err := em.FeedReader(strings.NewReader("name: low\npriority: 50\n"), "low.yaml")
+	isErrorWithMessage(t, err, "validation failed for fragment low in low.yaml: custom fragment low priority must >=100, got 50")
+	isEqual(t, 0, len(em.Fragments()))
+	isEqual(t, 0, len(em.Validate(ValidateOptions{})))
+}
+
+func TestPriorityBandLenient(t *testing.T) {
+	em := &EnvManager{LenientPriorities: true}
+	isNoErr(t, em.FeedReader(strings.NewReader("name: low\npriority: 50\nenv:\n  A: a\n"), "low.yaml"))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "ok", Priority: 100}))
+	isEqual(t, 2, len(em.Fragments()))
+	isEqual(t, []Warning{
+		{Fragment: "low", Message: "custom fragment low priority must >=100, got 50"},
+	}, em.Validate(ValidateOptions{}))
+
+	// a missing name is still an error
+	isErrorWithMessage(t, em.AddFragment(&EnvFragment{Priority: 5}), "validation failed for fragment : fragment must have a name")
+
+	// a fragment rejected by a later check leaves no priority warning
+	isTrue(t, em.AddFragment(&EnvFragment{
+		Name:     "bad",
+		Priority: 50,
+		Env:      map[string]string{"B": "b"},
+		Unset:    []string{"B"},
+	}) != nil)
+	isEqual(t, 2, len(em.Fragments()))
+	isEqual(t, 1, len(em.Validate(ValidateOptions{})))
+
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, "a", em.Merged()["A"])
+}
+
+func TestValidateLineBreaks(t *testing.T) {
+	em := &EnvManager{Denylist: []string{"IGNORED"}}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "app", Priority: 100, Env: map[string]string{
+		"PEM":     "line1\nline2",
+		"CRLF":    "a\r\n",
+		"PLAIN":   "one line",
+		"IGNORED": "x\ny",
+	}}))
+
+	isEqual(t, 0, len(em.Validate(ValidateOptions{CheckLineBreaks: true})))
+
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, []Warning{
+		{Key: "CRLF", Fragment: "app", Message: "value contains a line break"},
+		{Key: "PEM", Fragment: "app", Message: "value contains a line break"},
+	}, em.Validate(ValidateOptions{CheckLineBreaks: true}))
+}
+
+func TestMalformedValuesStrict(t *testing.T) {
+	em := &EnvManager{}
+	err := em.FeedReader(strings.NewReader("name: app\npriority: 100\nenv:\n  OK: \"a\\tb\\nc\"\n  BELL: \"ring\\a\"\n"), "app.yaml")
+	isErrorWithMessage(t, err, "validation failed for fragment app in app.yaml: key BELL: value contains control character U+0007")
+	isEqual(t, 0, len(em.Fragments()))
+
+	err = em.AddFragment(&EnvFragment{Name: "bom", Priority: 100, Env: map[string]string{"NAME": "\ufeffvalue"}})
+	isErrorWithMessage(t, err, "validation failed for fragment bom: key NAME: value contains a byte order mark")
+	err = em.AddFragment(&EnvFragment{Name: "latin1", Priority: 100, Defaults: map[string]string{"CITY": "M\xfcnchen"}})
+	isErrorWithMessage(t, err, "validation failed for fragment latin1: key CITY: value is not valid UTF-8")
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "clean", Priority: 100, Env: map[string]string{"CITY": "München", "PEM": "a\r\nb"}}))
+}
+
+func TestMalformedValuesLenient(t *testing.T) {
+	em := &EnvManager{LenientValues: true}
+	isNoErr(t, em.AddFragment(&EnvFragment{
+		Name:     "app",
+		Priority: 100,
+		Env:      map[string]string{"NAME": "\ufeffvalue", "ESC": "\x1b[0m", "OK": "fine"},
+		ShellEnv: map[string]map[string]string{"pwsh": {"ESC": "\x00"}},
+	}))
+	isEqual(t, []Warning{
+		{Key: "ESC", Fragment: "app", Message: "value contains control character U+001B"},
+		{Key: "ESC", Fragment: "app", Message: "value contains control character U+0000"},
+		{Key: "NAME", Fragment: "app", Message: "value contains a byte order mark"},
+	}, em.Validate(ValidateOptions{}))
+}
+
+func TestAutoPriorities(t *testing.T) {
+	em := &EnvManager{}
+	err := em.AddFragment(&EnvFragment{Name: "app"})
+	isErrorWithMessage(t, err, "validation failed for fragment app: custom fragment app priority must >=100, got 0")
+
+	em = &EnvManager{AutoPriorities: true}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "a", Env: map[string]string{"K": "a"}}))
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "fixed", Priority: 150}))
+	// a rejected fragment does not use up a priority
+	isTrue(t, em.AddFragment(&EnvFragment{Name: "bad", Unset: []string{"K"}, Env: map[string]string{"K": "x"}}) != nil)
+	isNoErr(t, em.FeedReader(strings.NewReader("name: b\nenv:\n  K: b\n"), "b.yaml"))
+
+	frags := em.Fragments()
+	isEqual(t, 100, frags[0].Priority)
+	isEqual(t, 150, frags[1].Priority)
+	isEqual(t, 101, frags[2].Priority)
+	isNoErr(t, em.SortAndMergeStrict())
+	isEqual(t, "b", em.Merged()["K"])
+
+	em = &EnvManager{AutoPriorities: true, AutoPriorityBase: 500}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "a"}))
+	isEqual(t, 500, em.Fragments()[0].Priority)
+}
+
+func TestAutoPrioritiesParallel(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.yaml": "name: a\nenv:\n  K: a\n",
+		"b.yaml": "name: b\nenv:\n  K: b\n",
+		"c.yaml": "name: c\nenv:\n  K: c\n",
+	})
+	em := &EnvManager{AutoPriorities: true}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "first"}))
+	isNoErr(t, em.FeedDirParallel(dir, 3))
+	var got []int
+	for _, frag := range em.Fragments() {
+		got = append(got, frag.Priority)
+	}
+	isEqual(t, []int{100, 101, 102, 103}, got)
+}
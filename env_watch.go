@@ -0,0 +1,178 @@
+// Copyright (C) Kumo inc. and its affiliates.
+// Author: Jeff.li lijippy@163.com
+// All rights reserved.
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package env
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long Watch waits for further changes before it
+// reloads, so an editor saving several files or writing a file in steps
+// triggers a single reload.
+var watchDebounce = 200 * time.Millisecond
+
+// Watch watches dir for fragment files being created, modified, renamed or
+// deleted: the files selected by FragmentExtensions and, with TOMLFiles set,
+// TOML files. After each burst of changes it reloads the fragments of dir,
+// replacing those previously fed from it, runs SortAndMerge and calls
+// onChange, e.g. to rebuild the environment files. Fragments fed from other
+// places are kept. Feed dir once before watching it to start from its
+// current state.
+//
+// A reload that fails, such as on a fragment being edited that does not
+// parse yet, is logged and onChange is not called until a later change
+// reloads successfully. Watch returns the error of onChange, or ctx.Err()
+// once ctx is cancelled.
+func (e *EnvManager) Watch(ctx context.Context, dir string, onChange func(*EnvManager) error) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if err := w.Add(dir); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(watchDebounce)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if e.isFragmentFile(ev.Name) && !ev.Has(fsnotify.Chmod) {
+				timer.Reset(watchDebounce)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			e.log().Warn("watch error", "dir", dir, "error", err)
+		case <-timer.C:
+			if err := e.reloadDir(dir); err != nil {
+				e.log().Warn("reload failed", "dir", dir, "error", err)
+				continue
+			}
+			if err := onChange(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// reloadDir replaces the fragments fed from dir with its current content and
+// merges again. The fragments and the merge result are left as they were if
+// dir fails to load or the new fragments fail to merge.
+func (e *EnvManager) reloadDir(dir string) error {
+	scratch := e.scratch()
+	if err := scratch.FeedDir(dir); err != nil {
+		return err
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	fragments, warnings, autoAssigned := e.fragments, e.warnings, e.autoAssigned
+	state := e.saveMerge()
+	var kept []*EnvFragment
+	for _, frag := range e.fragments {
+		if frag.Source == "" || !inDir(frag.Source, absDir) {
+			kept = append(kept, frag)
+		}
+	}
+	e.fragments = kept
+	for _, frag := range scratch.fragments {
+		e.adopt(frag)
+	}
+	e.warnings = append(e.warnings, scratch.warnings...)
+	e.sorted = false
+	if err := e.sortAndMerge(); err != nil {
+		e.fragments, e.warnings, e.autoAssigned = fragments, warnings, autoAssigned
+		e.restoreMerge(state)
+		return fmt.Errorf("merge after reload failed: %w", err)
+	}
+	e.log().Info("fragments reloaded", "dir", dir, "fragments", len(scratch.fragments))
+	return nil
+}
+
+// mergeState is the result of the last merge, saved by reloadDir to be put
+// back as it was, Ctime included, when a reload fails to merge.
+type mergeState struct {
+	active       []*EnvFragment
+	merged       map[string]string
+	keySources   map[string][]string
+	sorted       bool
+	ctime        time.Time
+	conflicts    []Conflict
+	owners       map[string]*EnvFragment
+	blocked      []BlockedOverride
+	unset        map[string]*EnvFragment
+	defaulted    map[string]*EnvFragment
+	listValues   map[*EnvFragment]map[string]string
+	interpolated map[*EnvFragment]map[string]string
+	effects      map[string]*fragmentEffect
+	stats        MergeStats
+}
+
+// saveMerge returns the result of the last merge. sortAndMerge replaces
+// rather than modifies the maps and slices, so they need no copy.
+func (e *EnvManager) saveMerge() mergeState {
+	return mergeState{
+		active:       e.active,
+		merged:       e.merged,
+		keySources:   e.keySources,
+		sorted:       e.sorted,
+		ctime:        e.Ctime,
+		conflicts:    e.conflicts,
+		owners:       e.owners,
+		blocked:      e.blocked,
+		unset:        e.unset,
+		defaulted:    e.defaulted,
+		listValues:   e.listValues,
+		interpolated: e.interpolated,
+		effects:      e.effects,
+		stats:        e.stats,
+	}
+}
+
+// restoreMerge puts back a merge result saved by saveMerge.
+func (e *EnvManager) restoreMerge(s mergeState) {
+	e.active, e.merged, e.keySources, e.sorted, e.Ctime = s.active, s.merged, s.keySources, s.sorted, s.ctime
+	e.conflicts, e.owners, e.blocked = s.conflicts, s.owners, s.blocked
+	e.unset, e.defaulted, e.listValues, e.interpolated = s.unset, s.defaulted, s.listValues, s.interpolated
+	e.effects, e.stats = s.effects, s.stats
+}
+
+// inDir reports whether the file fpath lies directly in the directory
+// absDir, whether fpath is absolute or relative to the working directory.
+func inDir(fpath, absDir string) bool {
+	abs, err := filepath.Abs(fpath)
+	return err == nil && filepath.Dir(abs) == absDir
+}
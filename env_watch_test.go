@@ -0,0 +1,125 @@
+package env
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	defer func(d time.Duration) { watchDebounce = d }(watchDebounce)
+	watchDebounce = 20 * time.Millisecond
+
+	dir := t.TempDir()
+	write := func(name, data string) {
+		t.Helper()
+		isNoErr(t, os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644))
+	}
+	write("base.yaml", "name: base\npriority: 100\nenv:\n  PORT: \"80\"\n")
+
+	em := &EnvManager{}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "inline", Priority: 150, Env: map[string]string{"MODE": "dev"}}))
+	isNoErr(t, em.FeedDir(dir))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan map[string]string)
+	done := make(chan error, 1)
+	go func() {
+		done <- em.Watch(ctx, dir, func(m *EnvManager) error {
+			changes <- m.Merged()
+			return nil
+		})
+	}()
+
+	next := func() map[string]string {
+		t.Helper()
+		select {
+		case merged := <-changes:
+			return merged
+		case <-time.After(5 * time.Second):
+			t.Fatal("no change reported")
+		}
+		return nil
+	}
+
+	// give the watcher time to start
+	time.Sleep(50 * time.Millisecond)
+	write("app.yaml", "name: app\npriority: 110\nenv:\n  PORT: \"8080\"\n")
+	write("notes.txt", "ignored")
+	isEqual(t, map[string]string{"PORT": "8080", "MODE": "dev"}, next())
+
+	// a broken file is skipped until it is fixed
+	write("app.yaml", "name: [broken\n")
+	time.Sleep(100 * time.Millisecond)
+	write("app.yaml", "name: app\npriority: 110\nenv:\n  PORT: \"9090\"\n")
+	isEqual(t, map[string]string{"PORT": "9090", "MODE": "dev"}, next())
+
+	isNoErr(t, os.Remove(filepath.Join(dir, "app.yaml")))
+	isEqual(t, map[string]string{"PORT": "80", "MODE": "dev"}, next())
+	isEqual(t, 2, len(em.Fragments()))
+
+	cancel()
+	isTrue(t, errors.Is(<-done, context.Canceled))
+}
+
+func TestWatchCallbackError(t *testing.T) {
+	defer func(d time.Duration) { watchDebounce = d }(watchDebounce)
+	watchDebounce = 20 * time.Millisecond
+
+	dir := t.TempDir()
+	em := &EnvManager{}
+	done := make(chan error, 1)
+	go func() {
+		done <- em.Watch(context.Background(), dir, func(*EnvManager) error {
+			return errors.New("build failed")
+		})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	isNoErr(t, os.WriteFile(filepath.Join(dir, "a.yml"), []byte("name: a\npriority: 100\n"), 0o644))
+
+	select {
+	case err := <-done:
+		isErrorWithMessage(t, err, "build failed")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch did not return")
+	}
+}
+
+func TestReloadDir(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "conf")
+	writeFiles(t, dir, map[string]string{
+		"base.yaml": "name: base\npriority: 100\nenv:\n  PORT: \"80\"\n",
+	})
+	t.Chdir(parent)
+
+	em := &EnvManager{StrictMerge: true}
+	isNoErr(t, em.AddFragment(&EnvFragment{Name: "inline", Priority: 150, Env: map[string]string{"MODE": "dev"}}))
+	isNoErr(t, em.FeedDir(dir))
+	isNoErr(t, em.SortAndMergeStrict())
+
+	// fed with an absolute path, reloaded with a relative one
+	writeFiles(t, dir, map[string]string{
+		"base.yaml": "name: base\npriority: 100\nenv:\n  PORT: \"8080\"\n",
+	})
+	isNoErr(t, em.reloadDir("conf"))
+	isEqual(t, 2, len(em.Fragments()))
+	isEqual(t, map[string]string{"MODE": "dev", "PORT": "8080"}, em.Merged())
+	ctime := em.Ctime
+
+	// a reload that fails to merge keeps the previous fragments and result
+	writeFiles(t, dir, map[string]string{
+		"override.yaml": "name: override\npriority: 200\nenv:\n  MODE: prod\n",
+	})
+	isErrorWithMessage(t, em.reloadDir(dir), "merge after reload failed: strict merge: keys defined by more than one fragment: MODE (inline, override)")
+	isEqual(t, 2, len(em.Fragments()))
+	isEqual(t, map[string]string{"MODE": "dev", "PORT": "8080"}, em.Merged())
+	isEqual(t, ctime, em.Ctime)
+	isNoErr(t, em.BuildBashTo(io.Discard))
+}
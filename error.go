@@ -171,3 +171,18 @@ func newParseValueError(message string, err error) error {
 func (e ParseValueError) Error() string {
 	return fmt.Sprintf("%s: %v", e.Msg, e.Err)
 }
+
+// This error occurs when a meta file holds neither an RFC3339 time nor a
+// JSON manifest.
+type MetaParseError struct {
+	Path string
+	Err  error
+}
+
+func (e MetaParseError) Error() string {
+	return fmt.Sprintf("failed to parse meta file %s: %v", e.Path, e.Err)
+}
+
+func (e MetaParseError) Unwrap() error {
+	return e.Err
+}